@@ -1,32 +1,50 @@
 import "./App.css";
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import useSWR from "swr";
 import AddTodo from "./components/AddTodo";
 import EditTodo from "./components/EditTodo";
+import Login from "./components/Login";
+import { apiFetch, getToken, setToken, setUnauthorizedHandler } from "./api";
 
-export const ENDPOINT = "http://localhost:4000";
+export { ENDPOINT } from "./api";
 
-const fetcher = (url) => fetch(`${ENDPOINT}/${url}`).then((r) => r.json());
+const fetcher = (url) => apiFetch(url).then((r) => (r.ok ? r.json() : Promise.reject(new Error(r.statusText))));
 
 function App() {
-	const { data, mutate } = useSWR("api/todos", fetcher);
+	const [token, setLoggedInToken] = useState(getToken());
+	// Without a token there is nothing to fetch until the user logs in
+	const { data, mutate } = useSWR(token ? "api/todos" : null, fetcher);
 	const [editTodo, setEditTodo] = useState(null);
 	const [selectedCategory, setSelectedCategory] = useState("All");
 
+	useEffect(() => {
+		setUnauthorizedHandler(() => setLoggedInToken(null));
+	}, []);
+
+	if (!token) {
+		return <Login onLogin={setLoggedInToken} />;
+	}
+
+	const logOut = async () => {
+		await apiFetch("api/auth/logout", { method: "POST" });
+		setToken(null);
+		setLoggedInToken(null);
+	};
+
 	const markTodoDone = async (id) => {
 		const updatedTodos = data.map((todo) => (todo.id === id ? { ...todo, done: !todo.done } : todo));
 
 		mutate(updatedTodos, false);
 
-		await fetch(`${ENDPOINT}/api/todos/${id}/done`, {
+		await apiFetch(`api/todos/${id}/done`, {
 			method: "PATCH",
-		}).then((r) => r.json());
+		});
 
 		mutate();
 	};
 
 	const updateTodo = async (todo) => {
-		await fetch(`${ENDPOINT}/api/todos/${todo.id}`, {
+		await apiFetch(`api/todos/${todo.id}`, {
 			method: "PUT",
 			headers: {
 				"Content-Type": "application/json",
@@ -39,7 +57,7 @@ function App() {
 	};
 
 	const deleteTodo = async (id) => {
-		await fetch(`${ENDPOINT}/api/todos/${id}`, {
+		await apiFetch(`api/todos/${id}`, {
 			method: "DELETE",
 		});
 
@@ -50,6 +68,12 @@ function App() {
 
 	return (
 		<>
+			<div className="flex justify-end my-2">
+				<button onClick={logOut} className="bg-gray-300 hover:bg-gray-400 text-gray-700 px-4 py-2 rounded-md">
+					Log out
+				</button>
+			</div>
+
 			<div className="p-4 bg-gray-100 rounded-md shadow-md">
 				{/* Display data or loading message */}
 				{data ? (
@@ -0,0 +1,36 @@
+export const ENDPOINT = "http://localhost:4000";
+
+const TOKEN_KEY = "token";
+
+export const getToken = () => localStorage.getItem(TOKEN_KEY);
+
+export const setToken = (token) => {
+	if (token) {
+		localStorage.setItem(TOKEN_KEY, token);
+	} else {
+		localStorage.removeItem(TOKEN_KEY);
+	}
+};
+
+// apiFetch calls the API as the logged-in user. A 401 means the session is gone, so the
+// token is dropped and onUnauthorized lets the app show the login form again.
+let onUnauthorized = () => {};
+
+export const setUnauthorizedHandler = (handler) => {
+	onUnauthorized = handler;
+};
+
+export const apiFetch = async (path, options = {}) => {
+	const headers = { ...options.headers };
+	const token = getToken();
+	if (token) {
+		headers.Authorization = `Bearer ${token}`;
+	}
+
+	const response = await fetch(`${ENDPOINT}/${path.replace(/^\//, "")}`, { ...options, headers });
+	if (response.status === 401) {
+		setToken(null);
+		onUnauthorized();
+	}
+	return response;
+};
@@ -1,5 +1,5 @@
 import { useState } from "react";
-import { ENDPOINT } from "../App";
+import { apiFetch } from "../api";
 // import { useForm } from "@mantine/hooks";
 // import { Modal, Group, Button } from "@mantine/core";
 
@@ -20,7 +20,7 @@ function AddTodo({ mutate, data }) {
 	};
 
 	const createTodo = async () => {
-		const newTodo = await fetch(`${ENDPOINT}/api/todos`, {
+		const newTodo = await apiFetch("api/todos", {
 			method: "POST",
 			headers: {
 				"Content-Type": "application/json",
@@ -1,5 +1,4 @@
 import React, { useState } from "react";
-import { ENDPOINT } from "../App";
 
 function EditTodo({ todo, onSave, onCancel }) {
 	const [formValues, setFormValues] = useState({
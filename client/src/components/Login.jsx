@@ -0,0 +1,144 @@
+import { useState } from "react";
+import { ENDPOINT, setToken } from "../api";
+
+const post = (path, body) =>
+	fetch(`${ENDPOINT}/${path}`, {
+		method: "POST",
+		headers: {
+			"Content-Type": "application/json",
+		},
+		body: JSON.stringify(body),
+	});
+
+function Login({ onLogin }) {
+	const [formValues, setFormValues] = useState({ username: "", password: "" });
+	const [challenge, setChallenge] = useState(null);
+	const [code, setCode] = useState("");
+	const [error, setError] = useState("");
+
+	const handleChange = (e) => {
+		setFormValues({
+			...formValues,
+			[e.target.name]: e.target.value,
+		});
+	};
+
+	const finish = async (response) => {
+		if (!response.ok) {
+			setError(await response.text());
+			return;
+		}
+
+		const result = await response.json();
+		if (result.mfa_required) {
+			// Accounts with two-factor authentication need a code before they get a session
+			setChallenge(result);
+			setError("");
+			return;
+		}
+
+		setToken(result.token);
+		onLogin(result.token);
+	};
+
+	const logIn = async (e) => {
+		e.preventDefault();
+		await finish(await post("api/auth/login", formValues));
+	};
+
+	const register = async () => {
+		const response = await post("api/auth/register", formValues);
+		if (!response.ok) {
+			setError(await response.text());
+			return;
+		}
+		await finish(await post("api/auth/login", formValues));
+	};
+
+	const sendCode = async (e) => {
+		e.preventDefault();
+		await finish(await post("api/auth/login/2fa", { mfa_token: challenge.mfa_token, code }));
+	};
+
+	return (
+		<div className="flex justify-center my-8">
+			<div className="bg-white rounded-lg p-6 w-1/3 shadow-md">
+				<h2 className="text-lg font-semibold mb-4">Log in</h2>
+				{challenge ? (
+					<form onSubmit={sendCode}>
+						<div className="mb-4">
+							<label htmlFor="code" className="block text-sm font-medium text-gray-700">
+								Authentication code
+							</label>
+							<input
+								id="code"
+								name="code"
+								type="text"
+								autoComplete="one-time-code"
+								value={code}
+								onChange={(e) => setCode(e.target.value)}
+								required
+								className="mt-1 p-2 block w-full border border-gray-300 rounded-md"
+							/>
+						</div>
+						<div className="flex justify-end">
+							<button type="submit" className="bg-blue-500 hover:bg-blue-600 text-white px-4 py-2 rounded-md">
+								Verify
+							</button>
+						</div>
+					</form>
+				) : (
+					<form onSubmit={logIn}>
+						<div className="mb-4">
+							<label htmlFor="username" className="block text-sm font-medium text-gray-700">
+								Username
+							</label>
+							<input
+								id="username"
+								name="username"
+								type="text"
+								autoComplete="username"
+								value={formValues.username}
+								onChange={handleChange}
+								placeholder="Username"
+								required
+								className="mt-1 p-2 block w-full border border-gray-300 rounded-md"
+							/>
+						</div>
+						<div className="mb-4">
+							<label htmlFor="password" className="block text-sm font-medium text-gray-700">
+								Password
+							</label>
+							<input
+								id="password"
+								name="password"
+								type="password"
+								autoComplete="current-password"
+								value={formValues.password}
+								onChange={handleChange}
+								placeholder="Password"
+								required
+								className="mt-1 p-2 block w-full border border-gray-300 rounded-md"
+							/>
+						</div>
+						<div className="flex justify-end">
+							<button
+								type="button"
+								onClick={register}
+								className="mr-2 bg-gray-300 hover:bg-gray-400 text-gray-700 px-4 py-2 rounded-md"
+							>
+								Create account
+							</button>
+							<button type="submit" className="bg-blue-500 hover:bg-blue-600 text-white px-4 py-2 rounded-md">
+								Log in
+							</button>
+						</div>
+					</form>
+				)}
+				{error && <p className="mt-4 text-red-500">{error}</p>}
+			</div>
+		</div>
+	);
+}
+
+export default Login;
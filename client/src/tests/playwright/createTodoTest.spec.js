@@ -3,6 +3,11 @@ import { test, expect } from "@playwright/test";
 test("running an end-to-end test", async ({ page }) => {
 	await page.goto("http://localhost:5173/");
 
+	// Create an account, which logs in right away
+	await page.getByPlaceholder("Username").fill(`playwright_${Date.now()}`);
+	await page.getByPlaceholder("Password").fill("correct horse battery staple");
+	await page.getByRole("button", { name: "Create account" }).click();
+
 	// Open the 'Add Todo' form
 	await page.getByRole("button", { name: "ADD TODO" }).click();
 
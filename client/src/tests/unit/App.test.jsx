@@ -24,11 +24,14 @@ global.fetch = vi.fn(() =>
 // Clean up
 beforeEach(() => {
 	global.fetch.mockClear();
+	// The todos are only shown to a logged-in user
+	localStorage.setItem("token", "test-token");
 });
 
 afterEach(() => {
 	// Reset any side effects
 	vi.clearAllMocks();
+	localStorage.clear();
 });
 
 // Tests
@@ -46,6 +49,26 @@ test("displays a list of todos correctly", () => {
 	expect(screen.getByText("☑")).toBeInTheDocument(); // Done
 });
 
+test("shows the login form when logged out", () => {
+	localStorage.clear();
+	render(<App />);
+
+	expect(screen.getByPlaceholderText("Username")).toBeInTheDocument();
+	expect(screen.getByPlaceholderText("Password")).toBeInTheDocument();
+	expect(screen.queryByText("Test Todo 1")).not.toBeInTheDocument();
+});
+
+test("sends the session token with requests", () => {
+	render(<App />);
+
+	fireEvent.click(screen.getAllByText("✘")[0]);
+
+	expect(global.fetch).toHaveBeenCalledWith(
+		expect.stringContaining("/api/todos/1"),
+		expect.objectContaining({ headers: expect.objectContaining({ Authorization: "Bearer test-token" }) })
+	);
+});
+
 test("displays a single todo item", () => {
 	render(<App />);
 
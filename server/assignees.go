@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Assignee is someone a todo is assigned to. Todos can only be assigned to people who can
+// see them: members of a shared list, or in lists without an owner the todo's owner.
+type Assignee struct {
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	AssignedBy string    `json:"assigned_by,omitempty"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// reminderInterval is how often runDeadlineReminders looks for deadlines coming up.
+const reminderInterval = 15 * time.Minute
+
+var errNotListMember = errors.New("todos can only be assigned to members of their list")
+
+// reminderLead is how long before a deadline assignees are reminded of it, a day unless
+// ASSIGNEE_REMINDER_LEAD says otherwise.
+func reminderLead() time.Duration {
+	return getEnvDuration("ASSIGNEE_REMINDER_LEAD", 24*time.Hour)
+}
+
+// getAssignees returns who the todo is assigned to, in the order they were assigned.
+func getAssignees(db dbtx, todoID int) ([]Assignee, error) {
+	rows, err := db.Query(`SELECT u.id, u.username, COALESCE(b.username, ''), a.assigned_at
+		FROM todo_assignee a JOIN app_user u ON u.id = a.user_id LEFT JOIN app_user b ON b.id = a.assigned_by
+		WHERE a.todo_id = $1 ORDER BY a.assigned_at, u.id`, todoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignees := []Assignee{}
+	for rows.Next() {
+		var a Assignee
+		if err := rows.Scan(&a.UserID, &a.Username, &a.AssignedBy, &a.AssignedAt); err != nil {
+			return nil, err
+		}
+		assignees = append(assignees, a)
+	}
+	return assignees, rows.Err()
+}
+
+// loadAssignees fills in the assignees of todos with a single query.
+func loadAssignees(db dbtx, todos []Todo) error {
+	if len(todos) == 0 {
+		return nil
+	}
+	ids := make([]int, len(todos))
+	index := map[int]int{}
+	for i, t := range todos {
+		ids[i] = t.ID
+		index[t.ID] = i
+	}
+
+	rows, err := db.Query(`SELECT a.todo_id, u.id, u.username, COALESCE(b.username, ''), a.assigned_at
+		FROM todo_assignee a JOIN app_user u ON u.id = a.user_id LEFT JOIN app_user b ON b.id = a.assigned_by
+		WHERE a.todo_id = ANY($1) ORDER BY a.assigned_at, u.id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var todoID int
+		var a Assignee
+		if err := rows.Scan(&todoID, &a.UserID, &a.Username, &a.AssignedBy, &a.AssignedAt); err != nil {
+			return err
+		}
+		i := index[todoID]
+		todos[i].Assignees = append(todos[i].Assignees, a)
+	}
+	return rows.Err()
+}
+
+// assignTodo assigns a todo to the user with the given username, who has to be able to see
+// it. It reports whether the assignment is new; assigning someone twice changes nothing.
+func assignTodo(db *sql.DB, todoID, assignerID int, username string) (int, bool, error) {
+	var userID int
+	err := db.QueryRow("SELECT id FROM app_user WHERE lower(username) = lower($1)", username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, false, errNoSuchUser
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	role, err := todoRole(db, userID, todoID)
+	if err != nil {
+		return 0, false, err
+	}
+	if role == "" {
+		return 0, false, errNotListMember
+	}
+
+	res, err := db.Exec(`INSERT INTO todo_assignee (todo_id, user_id, assigned_by) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, todoID, userID, assignerID)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	return userID, n > 0, err
+}
+
+// unassignTodo takes a todo away from one of its assignees.
+func unassignTodo(db dbtx, todoID, userID int) error {
+	res, err := db.Exec("DELETE FROM todo_assignee WHERE todo_id = $1 AND user_id = $2", todoID, userID)
+	return requireAffected(res, err)
+}
+
+// notifyAssigned tells a user that a todo was assigned to them, if they have an email
+// address and did not assign it to themselves.
+func notifyAssigned(db *sql.DB, notifier Notifier, todoID, userID int, assigner string) error {
+	var username, title, list string
+	var email sql.NullString
+	err := db.QueryRow(`SELECT u.username, u.email, t.title, l.name FROM app_user u, todo t JOIN todo_list l ON l.id = t.list_id
+		WHERE u.id = $1 AND t.id = $2`, userID, todoID).Scan(&username, &email, &title, &list)
+	if err != nil || !email.Valid || username == assigner {
+		return err
+	}
+
+	return notifier.Notify(Notification{
+		To:      email.String,
+		Subject: "You were assigned: " + title,
+		Text:    fmt.Sprintf("%s assigned \"%s\" in %s to you.", assigner, title, list),
+	})
+}
+
+// sendDeadlineReminders reminds assignees of open todos outside archived lists whose deadline
+// is at most reminderLead after now. Each assignee is reminded once per deadline, so moving the
+// deadline brings another reminder. It returns how many reminders went out.
+func sendDeadlineReminders(db *sql.DB, notifier Notifier, now time.Time) (int, error) {
+	rows, err := db.Query(`UPDATE todo_assignee a SET reminded_for = t.deadline
+		FROM todo t, app_user u
+		WHERE t.id = a.todo_id AND u.id = a.user_id AND t.deleted_at IS NULL AND NOT t.iscompleted AND t.`+inActiveList+`
+		AND t.deadline > $1 AND t.deadline <= $2 AND a.reminded_for IS DISTINCT FROM t.deadline
+		RETURNING u.email, t.title, t.deadline, t.deadline_tz, t.all_day`, now, now.Add(reminderLead()))
+	if err != nil {
+		return 0, err
+	}
+
+	type reminder struct {
+		to   string
+		todo Todo
+	}
+	var reminders []reminder
+	for rows.Next() {
+		var email sql.NullString
+		var deadline time.Time
+		var todo Todo
+		if err := rows.Scan(&email, &todo.Title, &deadline, &todo.DeadlineTZ, &todo.AllDay); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todo.Deadline = &deadline
+		if email.Valid {
+			reminders = append(reminders, reminder{email.String, todo})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// The reminders are marked as sent already; one that fails to go out is only logged
+	sent := 0
+	for _, r := range reminders {
+		due := r.todo.deadlineIn(nil).Format("Mon Jan 2 15:04 MST")
+		if r.todo.AllDay {
+			due = r.todo.deadlineIn(nil).Format("Mon Jan 2")
+		}
+		err := notifier.Notify(Notification{
+			To:      r.to,
+			Subject: "Due soon: " + r.todo.Title,
+			Text:    fmt.Sprintf("\"%s\", which is assigned to you, is due %s.", r.todo.Title, due),
+		})
+		if err != nil {
+			log.Printf("failed to send deadline reminder to %s: %v", r.to, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// runDeadlineReminders sends deadline reminders every reminderInterval. It never returns.
+func runDeadlineReminders(db *sql.DB, notifier Notifier) {
+	for {
+		if _, err := sendDeadlineReminders(db, notifier, time.Now()); err != nil {
+			log.Printf("failed to send deadline reminders: %v", err)
+		}
+
+		time.Sleep(reminderInterval)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignTodo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	const findUser = "SELECT id FROM app_user WHERE lower\\(username\\) = lower\\(\\$1\\)"
+	const findRole = "SELECT CASE WHEN l.owner_id IS NULL (.+) WHERE t.id = \\$1"
+
+	mock.ExpectQuery(findUser).WithArgs("nobody").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	_, _, err = assignTodo(db, 5, 1, "nobody")
+	assert.Equal(t, errNoSuchUser, err)
+
+	mock.ExpectQuery(findUser).WithArgs("Stranger").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectQuery(findRole).WithArgs(5, 9).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(nil))
+	_, _, err = assignTodo(db, 5, 1, "Stranger")
+	assert.Equal(t, errNotListMember, err, "Only people who can see the todo can be assigned")
+
+	mock.ExpectQuery(findUser).WithArgs("bob").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(findRole).WithArgs(5, 2).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleViewer))
+	mock.ExpectExec("INSERT INTO todo_assignee \\(todo_id, user_id, assigned_by\\) VALUES \\(\\$1, \\$2, \\$3\\)\\s+ON CONFLICT DO NOTHING").
+		WithArgs(5, 2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	userID, added, err := assignTodo(db, 5, 1, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, userID)
+	assert.True(t, added)
+
+	mock.ExpectQuery(findUser).WithArgs("bob").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(findRole).WithArgs(5, 2).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleViewer))
+	mock.ExpectExec("INSERT INTO todo_assignee").
+		WithArgs(5, 2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	_, added, err = assignTodo(db, 5, 1, "bob")
+	assert.NoError(t, err)
+	assert.False(t, added, "Assigning someone twice is not a new assignment")
+
+	mock.ExpectExec("DELETE FROM todo_assignee WHERE todo_id = \\$1 AND user_id = \\$2").
+		WithArgs(5, 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, sql.ErrNoRows, unassignTodo(db, 5, 3))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoadAssignees(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	at := time.Now()
+	mock.ExpectQuery("SELECT a.todo_id, (.+) FROM todo_assignee a (.+) WHERE a.todo_id = ANY\\(\\$1\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"todo_id", "id", "username", "assigned_by", "assigned_at"}).
+			AddRow(2, 1, "alice", "bob", at).
+			AddRow(2, 3, "carol", "", at))
+
+	todos := []Todo{{ID: 1}, {ID: 2}}
+	assert.NoError(t, loadAssignees(db, todos))
+	assert.Empty(t, todos[0].Assignees)
+	assert.Equal(t, []Assignee{{1, "alice", "bob", at}, {3, "carol", "", at}}, todos[1].Assignees)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNotifyAssigned(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	const selectTodo = "SELECT u.username, u.email, t.title, l.name FROM app_user u, todo t JOIN todo_list l"
+	columns := []string{"username", "email", "title", "name"}
+	notifier := &recordingNotifier{}
+
+	mock.ExpectQuery(selectTodo).WithArgs(2, 5).WillReturnRows(sqlmock.NewRows(columns).AddRow("bob", nil, "Paint", "House"))
+	assert.NoError(t, notifyAssigned(db, notifier, 5, 2, "alice"))
+	assert.Empty(t, notifier.sent, "Users without an email address are not notified")
+
+	mock.ExpectQuery(selectTodo).WithArgs(1, 5).WillReturnRows(sqlmock.NewRows(columns).AddRow("alice", "alice@example.com", "Paint", "House"))
+	assert.NoError(t, notifyAssigned(db, notifier, 5, 1, "alice"))
+	assert.Empty(t, notifier.sent, "Assigning yourself sends nothing")
+
+	mock.ExpectQuery(selectTodo).WithArgs(2, 5).WillReturnRows(sqlmock.NewRows(columns).AddRow("bob", "bob@example.com", "Paint", "House"))
+	assert.NoError(t, notifyAssigned(db, notifier, 5, 2, "alice"))
+	assert.Equal(t, []Notification{{
+		To:      "bob@example.com",
+		Subject: "You were assigned: Paint",
+		Text:    "alice assigned \"Paint\" in House to you.",
+	}}, notifier.sent)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSendDeadlineReminders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("UPDATE todo_assignee a SET reminded_for = t.deadline (.+) AND t.list_id NOT IN \\(SELECT id FROM todo_list WHERE archived_at IS NOT NULL\\)(.+) a.reminded_for IS DISTINCT FROM t.deadline").
+		WithArgs(now, now.Add(24*time.Hour)).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "title", "deadline", "deadline_tz", "all_day"}).
+			AddRow("bob@example.com", "Paint", now.Add(3*time.Hour), "Europe/Berlin", false).
+			AddRow(nil, "Paint", now.Add(3*time.Hour), "Europe/Berlin", false).
+			AddRow("carol@example.com", "Rent", now.Add(-8*time.Hour+24*time.Hour), "Europe/Berlin", true))
+
+	notifier := &recordingNotifier{}
+	sent, err := sendDeadlineReminders(db, notifier, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, []Notification{{
+		To:      "bob@example.com",
+		Subject: "Due soon: Paint",
+		Text:    "\"Paint\", which is assigned to you, is due Sun Sep 1 13:00 CEST.",
+	}, {
+		To:      "carol@example.com",
+		Subject: "Due soon: Rent",
+		Text:    "\"Rent\", which is assigned to you, is due Mon Sep 2.",
+	}}, notifier.sent)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
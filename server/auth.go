@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// User is an account. Every todo belongs to the user who created it and is only visible to
+// them, unless it is in a list shared with others; see sharing.go.
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Session is handed out on login. The token is only ever shown here; the database keeps its hash.
+type Session struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
+
+// Credentials is the body of register and login requests. The email address is optional
+// and only used for password reset links.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+// Passwords are stored as PBKDF2-HMAC-SHA256 with a per-user salt, in the form
+// pbkdf2-sha256$iterations$salt$key. The iteration count is part of the hash, so it can be
+// raised later without invalidating existing passwords.
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordMinLength  = 8
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// dummyPasswordHash is checked against when there is no real hash to check, so logging in
+// as someone who does not exist takes as long as a wrong password and gives nothing away.
+// No password matches it.
+var dummyPasswordHash = fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+	strings.Repeat("A", 22), strings.Repeat("A", 43))
+
+var (
+	errUsernameTaken      = errors.New("that username is taken")
+	errInvalidCredentials = errors.New("wrong username or password")
+)
+
+// sessionTTL is how long a login lasts, 30 days unless SESSION_TTL says otherwise.
+func sessionTTL() time.Duration {
+	return getEnvDuration("SESSION_TTL", 30*24*time.Hour)
+}
+
+func (cr Credentials) validate() error {
+	if !usernamePattern.MatchString(cr.Username) {
+		return errors.New("username must be 3-32 letters, digits, dots, dashes or underscores")
+	}
+	if err := validatePassword(cr.Password); err != nil {
+		return err
+	}
+	return validateEmail(cr.Email)
+}
+
+// pbkdf2 derives a key of keyLen bytes from password and salt (RFC 8018) with HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, passwordIterations, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash made by hashPassword.
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// newToken returns a random bearer token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how tokens are stored, so a leaked database does not leak working tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// registerUser creates an account. The first account becomes an admin and also takes over
+// the todos that were created before accounts existed, so they do not vanish once
+// authentication is required.
+func registerUser(db *sql.DB, cr Credentials) (User, error) {
+	hash, err := hashPassword(cr.Password)
+	if err != nil {
+		return User{}, err
+	}
+
+	u := User{Username: cr.Username}
+	err = withTx(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow("INSERT INTO app_user (username, password_hash, email) VALUES ($1, $2, NULLIF($3, '')) RETURNING id, created_at",
+			cr.Username, hash, cr.Email).Scan(&u.ID, &u.CreatedAt)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "app_user_email_idx" {
+			return errEmailTaken
+		}
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return errUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		return setUpFirstUser(tx, u.ID)
+	})
+	return u, err
+}
+
+// setUpFirstUser makes the first user an admin and hands them the todos, lists and templates
+// from before accounts existed. It does nothing for later users.
+func setUpFirstUser(tx dbtx, userID int) error {
+	var first bool
+	if err := tx.QueryRow("SELECT $1 = min(id) FROM app_user", userID).Scan(&first); err != nil || !first {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE app_user SET is_admin = true WHERE id = $1", userID); err != nil {
+		return err
+	}
+	for _, table := range []string{"todo", "todo_version", "todo_event", "todo_template"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET owner_id = $1 WHERE owner_id IS NULL", userID); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("UPDATE todo_list SET owner_id = $1 WHERE owner_id IS NULL AND id <> "+defaultList, userID)
+	return err
+}
+
+// login checks the credentials and starts a session. Accounts with two-factor
+// authentication get a challenge instead, to be completed with finishTwoFactorLogin.
+// Wrong passwords count towards a temporary lockout, during which even the right password
+// is refused. Accounts created through single sign-on have no password and cannot log in
+// this way.
+func login(db *sql.DB, cr Credentials, client clientInfo) (Session, *TwoFactorChallenge, error) {
+	var u User
+	var hash sql.NullString
+	var twoFactor bool
+	var failures int
+	var lockedUntil sql.NullTime
+	err := db.QueryRow(`SELECT id, username, created_at, password_hash, totp_enabled_at IS NOT NULL, failed_logins, locked_until
+		FROM app_user WHERE lower(username) = lower($1)`,
+		cr.Username).Scan(&u.ID, &u.Username, &u.CreatedAt, &hash, &twoFactor, &failures, &lockedUntil)
+	if err == sql.ErrNoRows {
+		checkPassword(dummyPasswordHash, cr.Password)
+		return Session{}, nil, errInvalidCredentials
+	}
+	if err != nil {
+		return Session{}, nil, err
+	}
+	if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+		return Session{}, nil, tooManyAttemptsError{until: lockedUntil.Time}
+	}
+	if !hash.Valid {
+		hash.String = dummyPasswordHash
+	}
+	if !checkPassword(hash.String, cr.Password) {
+		if err := recordFailedLogin(db, u.ID, client); err != nil {
+			return Session{}, nil, err
+		}
+		return Session{}, nil, errInvalidCredentials
+	}
+	if failures > 0 {
+		if _, err := db.Exec("UPDATE app_user SET failed_logins = 0 WHERE id = $1", u.ID); err != nil {
+			return Session{}, nil, err
+		}
+	}
+
+	if twoFactor {
+		ch, err := startTwoFactorLogin(db, u)
+		return Session{}, &ch, err
+	}
+	s, err := createSession(db, u)
+	if err != nil {
+		return s, nil, err
+	}
+	return s, nil, recordSecurityEvent(db, u.ID, eventLogin, "", client)
+}
+
+// createSession starts a session for a user who has proven who they are.
+func createSession(db dbtx, u User) (Session, error) {
+	s := Session{User: u}
+	var err error
+	if s.Token, err = newToken(); err != nil {
+		return s, err
+	}
+	err = db.QueryRow("INSERT INTO user_session (token_hash, user_id, expires_at) VALUES ($1, $2, $3) RETURNING expires_at",
+		hashToken(s.Token), u.ID, time.Now().Add(sessionTTL())).Scan(&s.ExpiresAt)
+	return s, err
+}
+
+// logout ends the session the token belongs to.
+func logout(db *sql.DB, token string) error {
+	_, err := db.Exec("DELETE FROM user_session WHERE token_hash = $1", hashToken(token))
+	return err
+}
+
+// userForToken returns the user a live session token belongs to.
+func userForToken(db *sql.DB, token string) (User, error) {
+	var u User
+	err := db.QueryRow(`SELECT u.id, u.username, u.created_at FROM user_session s JOIN app_user u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > now()`, hashToken(token)).Scan(&u.ID, &u.Username, &u.CreatedAt)
+	return u, err
+}
+
+// bearerToken extracts the token from an Authorization: Bearer header.
+func bearerToken(c *fiber.Ctx) string {
+	scheme, token, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// requireAuth rejects requests without a valid session or API token and makes the user
+// available to handlers through userFromRequest. Requests made with an API token are held
+// to the token's scope, which is kept in the "scope" local; sessions leave it empty.
+func requireAuth(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := bearerToken(c)
+		if token == "" {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return c.Status(fiber.StatusUnauthorized).SendString("authentication required")
+		}
+
+		var u User
+		var scope string
+		var err error
+		if isAPIToken(token) {
+			u, scope, err = userForAPIToken(db, token)
+		} else {
+			u, err = userForToken(db, token)
+		}
+		if err == sql.ErrNoRows {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.Status(fiber.StatusUnauthorized).SendString("invalid or expired token")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to authenticate")
+		}
+		if !scopeAllows(scope, c.Method()) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="write"`)
+			return c.Status(fiber.StatusForbidden).SendString("this token is read-only")
+		}
+
+		c.Locals("user", u)
+		c.Locals("scope", scope)
+		return c.Next()
+	}
+}
+
+// userFromRequest returns the id of the authenticated user, or 0 outside requireAuth.
+func userFromRequest(c *fiber.Ctx) int {
+	u, _ := c.Locals("user").(User)
+	return u.ID
+}
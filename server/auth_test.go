@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256
+	key := pbkdf2([]byte("password"), []byte("salt"), 1, 32)
+	assert.Equal(t, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b", hex.EncodeToString(key))
+	key = pbkdf2([]byte("password"), []byte("salt"), 2, 32)
+	assert.Equal(t, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43", hex.EncodeToString(key))
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^pbkdf2-sha256\$600000\$[A-Za-z0-9+/]+\$[A-Za-z0-9+/]+$`, hash)
+	assert.True(t, checkPassword(hash, "correct horse"))
+	assert.False(t, checkPassword(hash, "battery staple"))
+	assert.False(t, checkPassword("plaintext", "plaintext"))
+
+	// The stand-in for missing accounts costs as much to check as a real hash
+	assert.Regexp(t, `^pbkdf2-sha256\$600000\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, dummyPasswordHash)
+	assert.False(t, checkPassword(dummyPasswordHash, ""))
+
+	other, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other, "Every hash should have its own salt")
+}
+
+func TestValidateCredentials(t *testing.T) {
+	assert.NoError(t, Credentials{Username: "alice", Password: "12345678"}.validate())
+	assert.EqualError(t, Credentials{Username: "al", Password: "12345678"}.validate(),
+		"username must be 3-32 letters, digits, dots, dashes or underscores")
+	assert.EqualError(t, Credentials{Username: "alice", Password: "1234567"}.validate(),
+		"password must be at least 8 characters")
+}
+
+func TestRequireAuth(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	app := fiber.New()
+	app.Use("/api", requireAuth(db))
+	app.Get("/api/whoami", func(c *fiber.Ctx) error {
+		return c.SendString(actorFromRequest(c))
+	})
+
+	get := func(authorization string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/whoami", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	resp, _ := get("")
+	assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+
+	mock.ExpectQuery("SELECT u.id, u.username, u.created_at FROM user_session s JOIN app_user u").
+		WithArgs(hashToken("stale")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}))
+	resp, _ = get("Bearer stale")
+	assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	mock.ExpectQuery("SELECT u.id, u.username, u.created_at FROM user_session s JOIN app_user u").
+		WithArgs(hashToken("good")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}).AddRow(1, "alice", time.Now()))
+	resp, body := get("Bearer good")
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, "alice", body)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginRejectsWrongPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+
+	columns := []string{"id", "username", "created_at", "password_hash", "two_factor", "failed_logins", "locked_until"}
+	client := clientInfo{IP: "127.0.0.1", UserAgent: "test"}
+
+	mock.ExpectQuery("SELECT id, username, created_at, password_hash, (.+) FROM app_user WHERE lower\\(username\\) = lower\\(\\$1\\)").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows(columns))
+	_, _, err = login(db, Credentials{Username: "nobody", Password: "correct horse"}, client)
+	assert.Equal(t, errInvalidCredentials, err)
+
+	// A wrong password is counted and logged
+	mock.ExpectQuery("SELECT id, username, created_at, password_hash, (.+) FROM app_user").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "alice", time.Now(), hash, false, 0, nil))
+	mock.ExpectQuery("UPDATE app_user SET failed_logins = failed_logins \\+ 1 WHERE id = \\$1 RETURNING failed_logins").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_logins"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO security_event \\(user_id, event, detail, ip, user_agent\\)").
+		WithArgs(1, eventLoginFailed, "", "127.0.0.1", "test").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, _, err = login(db, Credentials{Username: "alice", Password: "battery staple"}, client)
+	assert.Equal(t, errInvalidCredentials, err)
+
+	// The last wrong password before the limit locks the account
+	mock.ExpectQuery("SELECT id, username, created_at, password_hash, (.+) FROM app_user").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "alice", time.Now(), hash, false, 4, nil))
+	mock.ExpectQuery("UPDATE app_user SET failed_logins = failed_logins \\+ 1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_logins"}).AddRow(5))
+	mock.ExpectExec("UPDATE app_user SET failed_logins = 0, locked_until = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO security_event").
+		WithArgs(1, eventLoginLocked, sqlmock.AnyArg(), "127.0.0.1", "test").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	_, _, err = login(db, Credentials{Username: "alice", Password: "battery staple"}, client)
+	assert.Equal(t, errInvalidCredentials, err)
+
+	// While locked even the right password is refused, without counting
+	lockedUntil := time.Now().Add(10 * time.Minute)
+	mock.ExpectQuery("SELECT id, username, created_at, password_hash, (.+) FROM app_user").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "alice", time.Now(), hash, false, 0, lockedUntil))
+	_, _, err = login(db, Credentials{Username: "alice", Password: "correct horse"}, client)
+	assert.Equal(t, tooManyAttemptsError{until: lockedUntil}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
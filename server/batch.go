@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BatchCreated pairs a created todo with its position in the request.
+type BatchCreated struct {
+	Index int `json:"index"`
+	ID    int `json:"id"`
+}
+
+// BatchError explains why the todo at Index was not created.
+type BatchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type BatchResponse struct {
+	Created []BatchCreated `json:"created"`
+	Errors  []BatchError   `json:"errors"`
+}
+
+// parseBatch decodes and validates each todo of a batch on its own, so one bad item does
+// not spoil the others. It returns the valid todos and the indexes they came from.
+func parseBatch(items []json.RawMessage, loc *time.Location) ([]*Todo, []int, []BatchError) {
+	todos := []*Todo{}
+	indexes := []int{}
+	errs := []BatchError{}
+	for i, item := range items {
+		todo := new(Todo)
+		err := json.Unmarshal(item, todo)
+		if err != nil {
+			err = fmt.Errorf("invalid todo")
+		}
+		if err == nil {
+			err = normalizeDeadline(todo, loc)
+		}
+		if err == nil {
+			err = validateTodoInput(todo)
+		}
+		if err != nil {
+			errs = append(errs, BatchError{Index: i, Error: err.Error()})
+			continue
+		}
+		todos = append(todos, todo)
+		indexes = append(indexes, i)
+	}
+	return todos, indexes, errs
+}
+
+// checkBatchLists drops the todos headed for lists the owner cannot write to, adding an
+// error for each, and returns the rest with their indexes.
+func checkBatchLists(db dbtx, owner int, todos []*Todo, indexes []int, errs []BatchError) ([]*Todo, []int, []BatchError, error) {
+	checked := map[int]error{}
+	var kept []*Todo
+	var keptIndexes []int
+	for i, todo := range todos {
+		err, ok := checked[todo.ListID]
+		if !ok {
+			err = checkListWritable(db, owner, todo.ListID)
+			checked[todo.ListID] = err
+		}
+		switch {
+		case err == sql.ErrNoRows:
+			errs = append(errs, BatchError{Index: indexes[i], Error: "no list with that id"})
+		case err == errListReadOnly:
+			errs = append(errs, BatchError{Index: indexes[i], Error: err.Error()})
+		case err != nil:
+			return nil, nil, nil, err
+		default:
+			kept = append(kept, todo)
+			keptIndexes = append(keptIndexes, indexes[i])
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	return kept, keptIndexes, errs, nil
+}
+
+// createTodos inserts todos in one transaction and records each creation in the history.
+// Unlike single creates they are not pushed onto the undo stack, where a large batch would
+// crowd out everything else. The result is in the order of todos.
+func createTodos(db *sql.DB, actor string, todos []*Todo) ([]Todo, error) {
+	if len(todos) == 0 {
+		return []Todo{}, nil
+	}
+
+	created := make([]Todo, len(todos))
+	err := withTx(db, func(tx *sql.Tx) error {
+		// Each todo goes to the end of its list, in the order the batch was sent
+		ranks, err := nextBatchRanks(tx, todos)
+		if err != nil {
+			return err
+		}
+
+		// One insert per todo, as Postgres makes no promise about the order in which a
+		// multi-row insert returns its rows
+		for i, todo := range todos {
+			created[i], err = scanTodo(tx.QueryRow(`INSERT INTO todo (title, text, iscompleted, category, deadline, deadline_tz, all_day, priority,
+					completed_at, rank, list_id, owner_id)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CASE WHEN $3 THEN now() END, $9, COALESCE(NULLIF($10, 0), `+defaultList+`), NULLIF($11, 0))
+				RETURNING `+todoColumns,
+				todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.DeadlineTZ, todo.AllDay, todo.Priority, ranks[i], todo.ListID, todo.OwnerID))
+			if err != nil {
+				return err
+			}
+			if _, err := recordHistory(tx, created[i].ID, actor, "create", nil, &created[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// nextBatchRanks returns the ranks of a batch of new todos: after everything in their lists,
+// in the order they were sent. The lists are locked in id order, so two batches over the same
+// lists cannot deadlock.
+func nextBatchRanks(tx dbtx, todos []*Todo) ([]string, error) {
+	lists := make([]int, len(todos))
+	defaultID := 0
+	for i, todo := range todos {
+		lists[i] = todo.ListID
+		if lists[i] == 0 {
+			if defaultID == 0 {
+				if err := tx.QueryRow("SELECT " + defaultList).Scan(&defaultID); err != nil {
+					return nil, err
+				}
+			}
+			lists[i] = defaultID
+		}
+	}
+
+	next := map[int]string{}
+	for _, listID := range lists {
+		next[listID] = ""
+	}
+	order := make([]int, 0, len(next))
+	for listID := range next {
+		order = append(order, listID)
+	}
+	sort.Ints(order)
+	for _, listID := range order {
+		rank, err := nextRank(tx, listID)
+		if err != nil {
+			return nil, err
+		}
+		next[listID] = rank
+	}
+
+	ranks := make([]string, len(todos))
+	for i, listID := range lists {
+		ranks[i] = next[listID]
+		rank, err := rankBetween(ranks[i], "")
+		if err != nil {
+			return nil, err
+		}
+		next[listID] = rank
+	}
+	return ranks, nil
+}
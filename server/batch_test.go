@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBatch(t *testing.T) {
+	items := []json.RawMessage{
+		json.RawMessage(`{"title":"Buy milk","body":"Semi-skimmed, two litres"}`),
+		json.RawMessage(`{"title":"","body":"Nobody knows what this is"}`),
+		json.RawMessage(`"not a todo"`),
+		json.RawMessage(`{"title":"Pay rent","body":"Transfer to landlord","deadline":"2024-09-30"}`),
+		json.RawMessage(`{"title":"Call mum","body":"Sunday afternoon","deadline":"someday"}`),
+	}
+
+	todos, indexes, errs := parseBatch(items, time.UTC)
+	assert.Len(t, todos, 2)
+	assert.Equal(t, []int{0, 3}, indexes)
+	assert.True(t, todos[1].AllDay)
+	assert.Len(t, errs, 3)
+	assert.Equal(t, BatchError{Index: 1, Error: "task title must not be empty"}, errs[0])
+	assert.Equal(t, BatchError{Index: 2, Error: "invalid todo"}, errs[1])
+	assert.Equal(t, 4, errs[2].Index)
+	assert.Contains(t, errs[2].Error, "someday")
+}
+
+func TestCreateTodos(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	todos := []*Todo{
+		{Title: "Buy milk", Body: "Semi-skimmed, two litres", OwnerID: 3},
+		{Title: "Call mum", Body: "Sunday afternoon", Done: true, OwnerID: 3},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT \\(SELECT min\\(id\\) FROM todo_list\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(1))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock\\(\\$1, \\$2\\)").
+		WithArgs(rankLockClass, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT max\\(rank\\) FROM todo WHERE list_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow("V"))
+	for _, row := range []struct {
+		id    int
+		title string
+		body  string
+		done  bool
+		rank  string
+	}{{4, "Buy milk", "Semi-skimmed, two litres", false, "k"}, {5, "Call mum", "Sunday afternoon", true, "s"}} {
+		var completedAt any
+		if row.done {
+			completedAt = fixedTime
+		}
+		mock.ExpectQuery("INSERT INTO todo \\((.+)\\)\\s+VALUES \\(\\$1, (.+), CASE WHEN \\$3 THEN now\\(\\) END, \\$9, COALESCE\\(NULLIF\\(\\$10, 0\\), (.+)\\), NULLIF\\(\\$11, 0\\)\\)\\s+RETURNING").
+			WithArgs(row.title, row.body, row.done, nil, nil, nil, false, nil, row.rank, 0, 3).
+			WillReturnRows(todoRows().
+				AddRow(row.id, row.title, row.body, row.done, nil, nil, nil, false, nil, fixedTime, fixedTime, completedAt, nil, row.rank, 1, nil, 3))
+		mock.ExpectQuery("INSERT INTO todo_history").
+			WithArgs(row.id, "create", "alice", nil, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(row.id))
+		mock.ExpectExec("UPDATE todo_version").WithArgs(row.id).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO todo_version").WithArgs(row.id, sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	created, err := createTodos(db, "alice", todos)
+	assert.NoError(t, err)
+	assert.Len(t, created, 2)
+	assert.Equal(t, 5, created[1].ID)
+	assert.Equal(t, fixedTime, *created[1].CompletedAt)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// bulkLimit caps how many operations a single bulk request may list.
+const bulkLimit = 500
+
+// bulkActions maps each bulk action to the action recorded in the todo's history.
+var bulkActions = map[string]string{
+	"complete":     "toggle",
+	"reopen":       "toggle",
+	"toggle":       "toggle",
+	"set_category": "update",
+	"update":       "update",
+	"delete":       "delete",
+	"restore":      "restore",
+	"move_to_list": "move",
+}
+
+// errBulkRolledBack aborts the transaction of an all-or-nothing request that had a failure.
+var errBulkRolledBack = errors.New("bulk request rolled back")
+
+// BulkOperation is a single action on one todo. Category is the new category for
+// set_category (null clears it), ListID the destination of move_to_list and Todo the new
+// state for update.
+type BulkOperation struct {
+	ID       int     `json:"id"`
+	Action   string  `json:"action"`
+	Category *string `json:"category"`
+	ListID   *int    `json:"list_id"`
+	Todo     *Todo   `json:"todo"`
+}
+
+// destination is the list the operation moves the todo to, or 0 if it stays where it is.
+func (op BulkOperation) destination() int {
+	switch {
+	case op.Action == "move_to_list" && op.ListID != nil:
+		return *op.ListID
+	case op.Action == "update" && op.Todo != nil:
+		return op.Todo.ListID
+	}
+	return 0
+}
+
+// BulkFilter selects the todos outside the trash that a filtered bulk request applies to.
+// Every given field must match; an empty filter selects every todo.
+type BulkFilter struct {
+	Done     *bool   `json:"done"`
+	Category *string `json:"category"`
+	ListID   *int    `json:"list_id"`
+	IDs      []int   `json:"ids"`
+}
+
+// BulkRequest lists operations, or applies one action to every todo matching Filter.
+// With Atomic set, nothing is applied unless every operation succeeds.
+type BulkRequest struct {
+	Operations []BulkOperation `json:"operations"`
+	Filter     *BulkFilter     `json:"filter"`
+	Action     string          `json:"action"`
+	Category   *string         `json:"category"`
+	ListID     *int            `json:"list_id"`
+	Atomic     bool            `json:"atomic"`
+}
+
+// BulkResult reports the outcome of one operation, with an HTTP-style status.
+type BulkResult struct {
+	ID     int    `json:"id"`
+	Action string `json:"action"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Todo   *Todo  `json:"todo,omitempty"`
+}
+
+type BulkResponse struct {
+	Applied   bool         `json:"applied"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
+}
+
+func (r BulkRequest) validate() error {
+	if (r.Filter == nil) == (len(r.Operations) == 0) {
+		return errors.New("either operations or a filter must be given")
+	}
+	if len(r.Operations) > bulkLimit {
+		return fmt.Errorf("at most %d operations are allowed", bulkLimit)
+	}
+	if r.Filter != nil {
+		if _, ok := bulkActions[r.Action]; !ok || r.Action == "update" {
+			return fmt.Errorf("unsupported action %q for a filter", r.Action)
+		}
+	}
+	return nil
+}
+
+// match returns the ids of the todos the filter selects, in id order.
+func (f BulkFilter) match(tx dbtx, owner int) ([]int, error) {
+	conds := []string{"deleted_at IS NULL", editableBy(1)}
+	args := []any{owner}
+	if f.Done != nil {
+		args = append(args, *f.Done)
+		conds = append(conds, fmt.Sprintf("iscompleted = $%d", len(args)))
+	}
+	if f.Category != nil {
+		args = append(args, *f.Category)
+		conds = append(conds, fmt.Sprintf("category = $%d", len(args)))
+	}
+	if f.ListID != nil {
+		args = append(args, *f.ListID)
+		conds = append(conds, fmt.Sprintf("list_id = $%d", len(args)))
+	}
+	if f.IDs != nil {
+		args = append(args, pq.Array(f.IDs))
+		conds = append(conds, fmt.Sprintf("id = ANY($%d)", len(args)))
+	}
+
+	rows, err := tx.Query("SELECT id FROM todo WHERE "+strings.Join(conds, " AND ")+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// runBulk applies a bulk request in a single transaction. Each operation runs under its own
+// savepoint, so a failing one is undone on its own and the rest still apply, unless the
+// request is atomic, in which case any failure rolls everything back and Applied is false.
+// Like batch creates, bulk changes are recorded in the history but kept off the undo stack.
+func runBulk(db *sql.DB, actor string, owner int, loc *time.Location, req BulkRequest) (BulkResponse, error) {
+	resp := BulkResponse{Results: []BulkResult{}}
+	err := withTx(db, func(tx *sql.Tx) error {
+		ops := req.Operations
+		if req.Filter != nil {
+			ids, err := req.Filter.match(tx, owner)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				ops = append(ops, BulkOperation{ID: id, Action: req.Action, Category: req.Category, ListID: req.ListID})
+			}
+		}
+
+		for _, op := range ops {
+			result, err := applyBulkOperation(tx, actor, owner, loc, op)
+			if err != nil {
+				return err
+			}
+			if result.Error == "" {
+				resp.Succeeded++
+			} else {
+				resp.Failed++
+			}
+			resp.Results = append(resp.Results, result)
+		}
+
+		if req.Atomic && resp.Failed > 0 {
+			return errBulkRolledBack
+		}
+		return nil
+	})
+	if err == errBulkRolledBack {
+		for i := range resp.Results {
+			resp.Results[i].Todo = nil
+		}
+		return resp, nil
+	}
+	resp.Applied = err == nil
+	return resp, err
+}
+
+// applyBulkOperation runs one operation under a savepoint. Failures of the operation itself
+// end up in the result; the error is only set when the transaction can't go on.
+func applyBulkOperation(tx dbtx, actor string, owner int, loc *time.Location, op BulkOperation) (BulkResult, error) {
+	result := BulkResult{ID: op.ID, Action: op.Action, Status: fiber.StatusOK}
+
+	change, err := bulkChange(op, loc)
+	if err != nil {
+		result.Status, result.Error = fiber.StatusBadRequest, err.Error()
+		return result, nil
+	}
+
+	// A todo the owner cannot see is reported just like a missing one
+	role, err := todoRole(tx, owner, op.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return result, err
+	}
+	if role == "" {
+		result.Status, result.Error = fiber.StatusNotFound, "no todo with that id"
+		return result, nil
+	}
+	if !roleAtLeast(role, roleEditor) {
+		result.Status, result.Error = fiber.StatusForbidden, errListReadOnly.Error()
+		return result, nil
+	}
+	switch err := checkListWritable(tx, owner, op.destination()); {
+	case err == sql.ErrNoRows:
+		result.Status, result.Error = fiber.StatusBadRequest, "no list with that id"
+		return result, nil
+	case err == errListReadOnly:
+		result.Status, result.Error = fiber.StatusForbidden, err.Error()
+		return result, nil
+	case err != nil:
+		return result, err
+	}
+
+	if _, err := tx.Exec("SAVEPOINT bulk_operation"); err != nil {
+		return result, err
+	}
+
+	_, _, err = changeTodoTx(tx, actor, bulkActions[op.Action], op.ID, func(tx dbtx) (int, error) {
+		return op.ID, change(tx)
+	})
+	if err == nil {
+		result.Todo, err = lockTodo(tx, op.ID)
+	}
+	if err != nil {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT bulk_operation"); rbErr != nil {
+			return result, rbErr
+		}
+		result.Status, result.Error = fiber.StatusInternalServerError, "failed to apply operation"
+		if err == sql.ErrNoRows {
+			result.Status, result.Error = fiber.StatusNotFound, "no todo with that id"
+		}
+		if isForeignKeyViolation(err) {
+			result.Status, result.Error = fiber.StatusBadRequest, "no list with that id"
+		}
+		return result, nil
+	}
+
+	_, err = tx.Exec("RELEASE SAVEPOINT bulk_operation")
+	return result, err
+}
+
+// bulkChange validates an operation and returns the change that carries it out.
+func bulkChange(op BulkOperation, loc *time.Location) (func(tx dbtx) error, error) {
+	switch op.Action {
+	case "complete", "reopen":
+		done := op.Action == "complete"
+		return func(tx dbtx) error { return setTodoDone(tx, op.ID, done) }, nil
+	case "toggle":
+		return func(tx dbtx) error { return toggleTodoStatus(tx, op.ID) }, nil
+	case "set_category":
+		return func(tx dbtx) error { return setTodoCategory(tx, op.ID, op.Category) }, nil
+	case "move_to_list":
+		if op.ListID == nil {
+			return nil, errors.New("move_to_list needs a list_id")
+		}
+		return func(tx dbtx) error { return setTodoList(tx, op.ID, *op.ListID) }, nil
+	case "delete":
+		return func(tx dbtx) error { return deleteTodo(tx, op.ID) }, nil
+	case "restore":
+		return func(tx dbtx) error { return restoreTodo(tx, op.ID) }, nil
+	case "update":
+		if op.Todo == nil {
+			return nil, errors.New("update needs a todo")
+		}
+		if err := normalizeDeadline(op.Todo, loc); err != nil {
+			return nil, err
+		}
+		if err := validateTodoInput(op.Todo); err != nil {
+			return nil, err
+		}
+		return func(tx dbtx) error { return updateTodo(tx, op.ID, op.Todo) }, nil
+	}
+	return nil, fmt.Errorf("unsupported action %q", op.Action)
+}
+
+// setTodoDone marks a todo as done or not done, leaving it untouched if it already is.
+func setTodoDone(db dbtx, id int, done bool) error {
+	res, err := db.Exec(`UPDATE todo SET iscompleted=$1,
+			completed_at=CASE WHEN iscompleted = $1 THEN completed_at WHEN $1 THEN now() END,
+			updated_at=CASE WHEN iscompleted = $1 THEN updated_at ELSE now() END
+		WHERE id=$2 AND deleted_at IS NULL`, done, id)
+	return requireAffected(res, err)
+}
+
+func setTodoCategory(db dbtx, id int, category *string) error {
+	res, err := db.Exec("UPDATE todo SET category=$1, updated_at=now() WHERE id=$2 AND deleted_at IS NULL", category, id)
+	return requireAffected(res, err)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkRequestValidate(t *testing.T) {
+	assert.EqualError(t, BulkRequest{}.validate(), "either operations or a filter must be given")
+	assert.EqualError(t, BulkRequest{
+		Operations: []BulkOperation{{ID: 1, Action: "delete"}},
+		Filter:     &BulkFilter{},
+	}.validate(), "either operations or a filter must be given")
+	assert.EqualError(t, BulkRequest{Filter: &BulkFilter{}, Action: "update"}.validate(), `unsupported action "update" for a filter`)
+	assert.NoError(t, BulkRequest{Filter: &BulkFilter{}, Action: "complete"}.validate())
+	assert.EqualError(t, BulkRequest{Operations: make([]BulkOperation, bulkLimit+1)}.validate(), "at most 500 operations are allowed")
+}
+
+func TestRunBulkAtomicRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) FROM todo t JOIN todo_list l ON l.id = t.list_id WHERE t.id = \\$1").
+		WithArgs(6, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(nil))
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+)").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("owner"))
+	mock.ExpectExec("SAVEPOINT bulk_operation").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(7).
+		WillReturnRows(todoRows())
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT bulk_operation").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	resp, err := runBulk(db, "alice", 1, time.UTC, BulkRequest{
+		Operations: []BulkOperation{
+			{ID: 6, Action: "complete"},
+			{ID: 7, Action: "complete"},
+			{ID: 8, Action: "archive"},
+		},
+		Atomic: true,
+	})
+	assert.NoError(t, err)
+	assert.False(t, resp.Applied)
+	assert.Equal(t, 3, resp.Failed)
+	assert.Equal(t, []BulkResult{
+		{ID: 6, Action: "complete", Status: 404, Error: "no todo with that id"},
+		{ID: 7, Action: "complete", Status: 404, Error: "no todo with that id"},
+		{ID: 8, Action: "archive", Status: 400, Error: `unsupported action "archive"`},
+	}, resp.Results)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRunBulkSkipsUndoStack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+)").
+		WithArgs(7, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("owner"))
+	mock.ExpectExec("SAVEPOINT bulk_operation").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(7).
+		WillReturnRows(todoRows().AddRow(7, "Title", "Some description", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 1, nil, 1))
+	mock.ExpectExec("UPDATE todo SET iscompleted=\\$1").
+		WithArgs(true, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+			WithArgs(7).
+			WillReturnRows(todoRows().AddRow(7, "Title", "Some description", true, nil, nil, nil, false, nil, fixedTime, fixedTime, fixedTime, nil, nil, 1, nil, 1))
+		if i == 0 {
+			mock.ExpectQuery("INSERT INTO todo_history").
+				WithArgs(7, "toggle", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+			mock.ExpectExec("UPDATE todo_version SET valid_to = now\\(\\)").
+				WithArgs(7).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("INSERT INTO todo_version").
+				WithArgs(7, sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(43, 1))
+		}
+	}
+	// Nothing is pushed onto the undo stack
+	mock.ExpectExec("RELEASE SAVEPOINT bulk_operation").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	resp, err := runBulk(db, "alice", 1, time.UTC, BulkRequest{Operations: []BulkOperation{{ID: 7, Action: "complete"}}})
+	assert.NoError(t, err)
+	assert.True(t, resp.Applied)
+	assert.Equal(t, 1, resp.Succeeded)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBulkFilterMatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	done := true
+	category := "Work"
+	mock.ExpectQuery("SELECT id FROM todo WHERE deleted_at IS NULL AND \\(\\(owner_id = \\$1 (.+) role <> 'viewer'\\)\\) AND iscompleted = \\$2 AND category = \\$3 ORDER BY id").
+		WithArgs(1, true, "Work").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2).AddRow(5))
+
+	ids, err := BulkFilter{Done: &done, Category: &category}.match(db, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 5}, ids)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnv returns the value of the environment variable key, or fallback if it is unset or empty.
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getEnvDuration parses key as a time.Duration such as "720h", falling back when it is unset or malformed.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+// getEnvInt parses key as an integer, falling back when it is unset or malformed.
+func getEnvInt(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return n
+}
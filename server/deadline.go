@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// deadlineDateLayout is how all-day deadlines are sent and returned.
+const deadlineDateLayout = "2006-01-02"
+
+// deadlineLocalLayouts are accepted besides RFC 3339 and read in the deadline's zone.
+var deadlineLocalLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// allDayDate is the calendar date of an all-day deadline in the zone it was entered in.
+const allDayDate = "(deadline AT TIME ZONE COALESCE(deadline_tz, 'UTC'))::date"
+
+// requestLocation resolves the caller's time zone from the tz query parameter or the
+// X-Timezone header, falling back to the named zone.
+func requestLocation(c *fiber.Ctx, fallback string) (*time.Location, error) {
+	tz := c.Query("tz", c.Get("X-Timezone"))
+	if tz == "" {
+		tz = fallback
+	}
+	return time.LoadLocation(tz)
+}
+
+func defaultTimezone() string {
+	return getEnv("DEFAULT_TIMEZONE", "UTC")
+}
+
+func (t *Todo) UnmarshalJSON(data []byte) error {
+	type plain Todo
+	aux := struct {
+		*plain
+		Deadline *string `json:"deadline"`
+	}{plain: (*plain)(t)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	t.rawDeadline = aux.Deadline
+	if aux.Deadline == nil || *aux.Deadline == "" {
+		t.rawDeadline = nil
+	}
+	return nil
+}
+
+// MarshalJSON renders the deadline in the zone it was entered in, and all-day deadlines as a bare date.
+func (t Todo) MarshalJSON() ([]byte, error) {
+	type plain Todo
+	aux := struct {
+		plain
+		Deadline any `json:"deadline"`
+	}{plain: plain(t)}
+
+	if t.Deadline != nil {
+		deadline := t.deadlineIn(nil)
+		if t.AllDay {
+			aux.Deadline = deadline.Format(deadlineDateLayout)
+		} else {
+			aux.Deadline = deadline
+		}
+	}
+
+	return json.Marshal(aux)
+}
+
+// deadlineIn returns the deadline converted to loc. All-day deadlines, and every deadline when
+// loc is nil, are given in the zone they were entered in so the date does not shift.
+func (t Todo) deadlineIn(loc *time.Location) time.Time {
+	if loc == nil || t.AllDay {
+		loc = time.UTC
+		if t.DeadlineTZ != nil {
+			if zone, err := time.LoadLocation(*t.DeadlineTZ); err == nil {
+				loc = zone
+			}
+		}
+	}
+	return t.Deadline.In(loc)
+}
+
+// normalizeDeadline resolves the deadline sent by the client into a UTC instant plus the zone
+// it was expressed in. Deadlines without an offset are read in deadline_tz, or in loc when the
+// client did not send one. A bare date makes the todo due all day.
+func normalizeDeadline(todo *Todo, loc *time.Location) error {
+	if todo.DeadlineTZ != nil {
+		zone, err := time.LoadLocation(*todo.DeadlineTZ)
+		if err != nil {
+			return fmt.Errorf("unknown deadline time zone %q", *todo.DeadlineTZ)
+		}
+		loc = zone
+	}
+
+	if todo.rawDeadline == nil {
+		todo.Deadline = nil
+		todo.DeadlineTZ = nil
+		todo.AllDay = false
+		return nil
+	}
+
+	deadline, allDay, err := parseDeadline(*todo.rawDeadline, loc)
+	if err != nil {
+		return err
+	}
+
+	utc := deadline.UTC()
+	zone := loc.String()
+	todo.Deadline = &utc
+	todo.DeadlineTZ = &zone
+	todo.AllDay = allDay
+	return nil
+}
+
+func parseDeadline(s string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+
+	for _, layout := range deadlineLocalLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, false, nil
+		}
+	}
+
+	if t, err := time.ParseInLocation(deadlineDateLayout, s, loc); err == nil {
+		return t, true, nil
+	}
+
+	return time.Time{}, false, fmt.Errorf("invalid deadline %q, expected RFC 3339 or YYYY-MM-DD", s)
+}
+
+// getOverdueTodos returns open todos whose deadline has passed. All-day todos are overdue once
+// their date is before today in loc.
+func getOverdueTodos(db *sql.DB, owner int, now time.Time, loc *time.Location) ([]Todo, error) {
+	return queryTodos(db, owner, `NOT isCompleted AND (
+			(NOT all_day AND deadline < $1) OR (all_day AND `+allDayDate+` < $2::date)
+		) ORDER BY deadline`,
+		now.UTC(), now.In(loc).Format(deadlineDateLayout))
+}
+
+// getUpcomingTodos returns open todos due from now until the end of the local day days ahead,
+// so days=0 means the rest of today.
+func getUpcomingTodos(db *sql.DB, owner int, now time.Time, loc *time.Location, days int) ([]Todo, error) {
+	local := now.In(loc)
+	last := time.Date(local.Year(), local.Month(), local.Day()+days, 0, 0, 0, 0, loc)
+	end := last.AddDate(0, 0, 1)
+
+	return queryTodos(db, owner, `NOT isCompleted AND (
+			(NOT all_day AND deadline >= $1 AND deadline < $2) OR
+			(all_day AND `+allDayDate+` BETWEEN $3::date AND $4::date)
+		) ORDER BY deadline`,
+		now.UTC(), end.UTC(), local.Format(deadlineDateLayout), last.Format(deadlineDateLayout))
+}
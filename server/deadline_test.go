@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeDeadline(t *testing.T) {
+	copenhagen, err := time.LoadLocation("Europe/Copenhagen")
+	assert.NoError(t, err)
+
+	// Case 1: A bare date is an all-day deadline in the request's zone
+	var todo Todo
+	assert.NoError(t, json.Unmarshal([]byte(`{"title":"Pay rent","deadline":"2024-10-01"}`), &todo))
+	assert.NoError(t, normalizeDeadline(&todo, copenhagen))
+	assert.True(t, todo.AllDay)
+	assert.Equal(t, "Europe/Copenhagen", *todo.DeadlineTZ)
+	assert.Equal(t, time.Date(2024, time.September, 30, 22, 0, 0, 0, time.UTC), *todo.Deadline)
+
+	// Case 2: A local time is read in deadline_tz rather than the request's zone
+	todo = Todo{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"deadline":"2024-10-01T17:00","deadline_tz":"America/New_York"}`), &todo))
+	assert.NoError(t, normalizeDeadline(&todo, copenhagen))
+	assert.False(t, todo.AllDay)
+	assert.Equal(t, time.Date(2024, time.October, 1, 21, 0, 0, 0, time.UTC), *todo.Deadline)
+
+	// Case 3: An explicit offset wins and is stored in UTC
+	todo = Todo{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"deadline":"2024-10-01T17:00:00+02:00"}`), &todo))
+	assert.NoError(t, normalizeDeadline(&todo, time.UTC))
+	assert.Equal(t, time.Date(2024, time.October, 1, 15, 0, 0, 0, time.UTC), *todo.Deadline)
+	assert.Equal(t, time.UTC, todo.Deadline.Location())
+
+	// Case 4: No deadline clears the zone as well
+	todo = Todo{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"deadline":null,"deadline_tz":"Europe/Copenhagen"}`), &todo))
+	assert.NoError(t, normalizeDeadline(&todo, time.UTC))
+	assert.Nil(t, todo.Deadline)
+	assert.Nil(t, todo.DeadlineTZ)
+
+	// Case 5: Invalid input
+	todo = Todo{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"deadline":"next week"}`), &todo))
+	assert.EqualError(t, normalizeDeadline(&todo, time.UTC), `invalid deadline "next week", expected RFC 3339 or YYYY-MM-DD`)
+
+	todo = Todo{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"deadline":"2024-10-01","deadline_tz":"Mars/Olympus"}`), &todo))
+	assert.EqualError(t, normalizeDeadline(&todo, time.UTC), `unknown deadline time zone "Mars/Olympus"`)
+}
+
+func TestTodoMarshalJSON(t *testing.T) {
+	zone := "Europe/Copenhagen"
+	deadline := time.Date(2024, time.September, 30, 22, 0, 0, 0, time.UTC)
+
+	allDay, err := json.Marshal(Todo{ID: 1, Deadline: &deadline, DeadlineTZ: &zone, AllDay: true})
+	assert.NoError(t, err)
+	assert.Contains(t, string(allDay), `"deadline":"2024-10-01"`)
+
+	timed, err := json.Marshal(Todo{ID: 1, Deadline: &deadline, DeadlineTZ: &zone})
+	assert.NoError(t, err)
+	assert.Contains(t, string(timed), `"deadline":"2024-10-01T00:00:00+02:00"`)
+
+	none, err := json.Marshal(Todo{ID: 1})
+	assert.NoError(t, err)
+	assert.Contains(t, string(none), `"deadline":null`)
+}
+
+func TestGetUpcomingTodos(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	copenhagen, err := time.LoadLocation("Europe/Copenhagen")
+	assert.NoError(t, err)
+
+	// 23:30 UTC is already the next day in Copenhagen
+	now := time.Date(2024, time.September, 18, 23, 30, 0, 0, time.UTC)
+	end := time.Date(2024, time.September, 22, 0, 0, 0, 0, copenhagen).UTC()
+
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE deleted_at IS NULL AND list_id NOT IN (.+) AND \\(\\(owner_id = \\$5 (.+) user_id = \\$5\\)\\) AND NOT isCompleted").
+		WithArgs(now, end, "2024-09-19", "2024-09-21", 3).
+		WillReturnRows(todoRows().AddRow(1, "Dentist", "Check-up at 9", false, nil, now.Add(time.Hour), "Europe/Copenhagen", false, nil, now, now, nil, nil, nil, 1, nil, nil))
+
+	todos, err := getUpcomingTodos(db, 3, now, copenhagen, 2)
+	assert.NoError(t, err)
+	assert.Len(t, todos, 1)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/digest.txt templates/digest.html
+var digestTemplates embed.FS
+
+// digestSection is what the "section" sub-template renders.
+type digestSection struct {
+	Heading string
+	Todos   []Todo
+}
+
+func newDigestSection(heading string, todos []Todo) digestSection {
+	return digestSection{Heading: heading, Todos: todos}
+}
+
+var (
+	digestText = texttemplate.Must(texttemplate.New("digest.txt").
+			Funcs(texttemplate.FuncMap{"section": newDigestSection}).
+			ParseFS(digestTemplates, "templates/digest.txt"))
+	digestHTML = htmltemplate.Must(htmltemplate.New("digest.html").
+			Funcs(htmltemplate.FuncMap{"section": newDigestSection}).
+			ParseFS(digestTemplates, "templates/digest.html"))
+)
+
+type Digest struct {
+	Date               time.Time `json:"date"`
+	Overdue            []Todo    `json:"overdue"`
+	DueToday           []Todo    `json:"due_today"`
+	CompletedYesterday []Todo    `json:"completed_yesterday"`
+}
+
+func (d Digest) Empty() bool {
+	return len(d.Overdue) == 0 && len(d.DueToday) == 0 && len(d.CompletedYesterday) == 0
+}
+
+func (d Digest) Text() (string, error) {
+	var buf bytes.Buffer
+	err := digestText.Execute(&buf, d)
+	return buf.String(), err
+}
+
+func (d Digest) HTML() (string, error) {
+	var buf bytes.Buffer
+	err := digestHTML.Execute(&buf, d)
+	return buf.String(), err
+}
+
+// buildDigest collects the owner's todos that make up the digest for the local day containing now.
+func buildDigest(db *sql.DB, owner int, now time.Time, loc *time.Location) (Digest, error) {
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	tomorrow := today.AddDate(0, 0, 1)
+	yesterday := today.AddDate(0, 0, -1)
+
+	date := today.Format(deadlineDateLayout)
+
+	digest := Digest{Date: today}
+	var err error
+
+	digest.Overdue, err = queryTodos(db, owner, `NOT isCompleted AND (
+			(NOT all_day AND deadline < $1) OR (all_day AND `+allDayDate+` < $2::date)
+		) ORDER BY deadline`,
+		today.UTC(), date)
+	if err != nil {
+		return digest, err
+	}
+
+	digest.DueToday, err = queryTodos(db, owner, `NOT isCompleted AND (
+			(NOT all_day AND deadline >= $1 AND deadline < $2) OR (all_day AND `+allDayDate+` = $3::date)
+		) ORDER BY deadline`,
+		today.UTC(), tomorrow.UTC(), date)
+	if err != nil {
+		return digest, err
+	}
+
+	digest.CompletedYesterday, err = queryTodos(db, owner, "isCompleted AND completed_at >= $1 AND completed_at < $2 ORDER BY completed_at", yesterday, today)
+	if err != nil {
+		return digest, err
+	}
+
+	for _, todos := range [][]Todo{digest.Overdue, digest.DueToday, digest.CompletedYesterday} {
+		for i := range todos {
+			if todos[i].Deadline != nil {
+				d := todos[i].deadlineIn(loc)
+				todos[i].Deadline = &d
+			}
+		}
+	}
+
+	return digest, nil
+}
+
+var errInvalidTimezone = errors.New("unknown time zone, expected a name like Europe/Berlin")
+
+func digestTimezone() string {
+	return getEnv("DIGEST_TIMEZONE", defaultTimezone())
+}
+
+// parseClock parses a "15:04" wall-clock time.
+func parseClock(s string) (hour, minute int, err error) {
+	h, m, ok := strings.Cut(s, ":")
+	if ok {
+		hour, err = strconv.Atoi(h)
+	}
+	if ok && err == nil {
+		minute, err = strconv.Atoi(m)
+	}
+	if !ok || err != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return hour, minute, nil
+}
+
+// nextDigestRun returns the first hour:minute in loc strictly after now.
+func nextDigestRun(now time.Time, hour, minute int, loc *time.Location) time.Time {
+	local := now.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, loc)
+	if !next.After(now) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, hour, minute, 0, 0, loc)
+	}
+	return next
+}
+
+// sendDigest sends the owner's digest to them at the given address, unless there is nothing in it.
+func sendDigest(db *sql.DB, notifier Notifier, owner int, to string, now time.Time, loc *time.Location) error {
+	digest, err := buildDigest(db, owner, now, loc)
+	if err != nil {
+		return err
+	}
+	if digest.Empty() {
+		return nil
+	}
+
+	text, err := digest.Text()
+	if err != nil {
+		return err
+	}
+	html, err := digest.HTML()
+	if err != nil {
+		return err
+	}
+
+	return notifier.Notify(Notification{
+		To:      to,
+		Subject: "Todo digest for " + digest.Date.Format("Mon Jan 2"),
+		Text:    text,
+		HTML:    html,
+	})
+}
+
+// digestSchedule is when digests go out: at hour:minute on each user's own clock, in the time
+// zone they set or in fallback if they have not set one.
+type digestSchedule struct {
+	hour, minute int
+	fallback     *time.Location
+}
+
+// loadDigestSchedule reads DIGEST_TIME and DIGEST_TIMEZONE, so a bad value stops the server
+// from starting rather than the scheduler later on.
+func loadDigestSchedule() (digestSchedule, error) {
+	hour, minute, err := parseClock(getEnv("DIGEST_TIME", "08:00"))
+	if err != nil {
+		return digestSchedule{}, err
+	}
+	loc, err := time.LoadLocation(digestTimezone())
+	if err != nil {
+		return digestSchedule{}, fmt.Errorf("invalid DIGEST_TIMEZONE: %w", err)
+	}
+	return digestSchedule{hour: hour, minute: minute, fallback: loc}, nil
+}
+
+// due reports whether the digest time in loc falls after since and no later than now.
+func (s digestSchedule) due(since, now time.Time, loc *time.Location) bool {
+	return !nextDigestRun(since, s.hour, s.minute, loc).After(now)
+}
+
+// DigestSettings is the body of PUT /api/digest/timezone.
+type DigestSettings struct {
+	Timezone string `json:"timezone"`
+}
+
+// setDigestTimezone sets the time zone the user's digest goes out in, or with an empty name
+// goes back to DIGEST_TIMEZONE.
+func setDigestTimezone(db *sql.DB, userID int, name string) error {
+	if name != "" {
+		if _, err := time.LoadLocation(name); err != nil {
+			return errInvalidTimezone
+		}
+	}
+	return requireAffected(db.Exec("UPDATE app_user SET timezone = NULLIF($1, '') WHERE id = $2", name, userID))
+}
+
+// sendDigests sends every user with an email address whose digest time came after since and
+// no later than now their own digest. A digest that fails is logged and does not hold up the others.
+func sendDigests(db *sql.DB, notifier Notifier, schedule digestSchedule, since, now time.Time) error {
+	rows, err := db.Query("SELECT id, email, timezone FROM app_user WHERE email IS NOT NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	type recipient struct {
+		id       int
+		email    string
+		timezone sql.NullString
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.id, &r.email, &r.timezone); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		loc := schedule.fallback
+		if r.timezone.Valid {
+			if loc, err = time.LoadLocation(r.timezone.String); err != nil {
+				log.Printf("user %d has an unknown time zone %q, sending their digest in %s", r.id, r.timezone.String, schedule.fallback)
+				loc = schedule.fallback
+			}
+		}
+		if !schedule.due(since, now, loc) {
+			continue
+		}
+		if err := sendDigest(db, notifier, r.id, r.email, now, loc); err != nil {
+			log.Printf("failed to send daily digest to user %d: %v", r.id, err)
+		}
+	}
+	return nil
+}
+
+// runDigestScheduler checks every minute whose digest is due and sends it. It never returns;
+// failures are logged and tried again at the next day's digest time.
+func runDigestScheduler(db *sql.DB, notifier Notifier, schedule digestSchedule) {
+	since := time.Now()
+	for {
+		time.Sleep(time.Until(since.Truncate(time.Minute).Add(time.Minute)))
+		now := time.Now()
+
+		if err := sendDigests(db, notifier, schedule, since, now); err != nil {
+			log.Printf("failed to send daily digests: %v", err)
+		}
+		since = now
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClock(t *testing.T) {
+	hour, minute, err := parseClock("07:45")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, hour)
+	assert.Equal(t, 45, minute)
+
+	for _, invalid := range []string{"", "7", "24:00", "12:60", "ab:cd"} {
+		_, _, err := parseClock(invalid)
+		assert.Error(t, err, "Expected an error for %q", invalid)
+	}
+}
+
+func TestLoadDigestSchedule(t *testing.T) {
+	t.Setenv("DIGEST_TIME", "07:30")
+	t.Setenv("DIGEST_TIMEZONE", "Europe/Copenhagen")
+	schedule, err := loadDigestSchedule()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, schedule.hour)
+	assert.Equal(t, "Europe/Copenhagen", schedule.fallback.String())
+
+	t.Setenv("DIGEST_TIMEZONE", "Mars/Olympus_Mons")
+	_, err = loadDigestSchedule()
+	assert.Error(t, err)
+
+	t.Setenv("DIGEST_TIMEZONE", "UTC")
+	t.Setenv("DIGEST_TIME", "25:00")
+	_, err = loadDigestSchedule()
+	assert.Error(t, err)
+}
+
+func TestNextDigestRun(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Copenhagen")
+	assert.NoError(t, err)
+
+	// 06:00 UTC is 08:00 in Copenhagen (summer time), so 08:00 today has just passed
+	now := time.Date(2024, time.September, 18, 6, 0, 0, 0, time.UTC)
+	next := nextDigestRun(now, 8, 0, loc)
+	assert.Equal(t, time.Date(2024, time.September, 19, 8, 0, 0, 0, loc), next)
+
+	now = time.Date(2024, time.September, 18, 5, 0, 0, 0, time.UTC)
+	next = nextDigestRun(now, 8, 0, loc)
+	assert.Equal(t, time.Date(2024, time.September, 18, 8, 0, 0, 0, loc), next)
+}
+
+func TestBuildDigest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2024, time.September, 18, 12, 0, 0, 0, time.UTC)
+	today := time.Date(2024, time.September, 18, 0, 0, 0, 0, time.UTC)
+	lastWeek := today.AddDate(0, 0, -7)
+
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE deleted_at IS NULL AND list_id NOT IN (.+) AND NOT isCompleted AND (.+)deadline < \\$1").
+		WithArgs(today, "2024-09-18", 4).
+		WillReturnRows(todoRows().AddRow(1, "Pay rent", "Transfer the rent", false, "Finance", lastWeek, "UTC", false, "high", lastWeek, lastWeek, nil, nil, nil, 1, nil, nil))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE deleted_at IS NULL AND list_id NOT IN (.+) AND NOT isCompleted AND (.+)deadline >= \\$1 AND deadline < \\$2").
+		WithArgs(today, today.AddDate(0, 0, 1), "2024-09-18", 4).
+		WillReturnRows(todoRows())
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE deleted_at IS NULL AND list_id NOT IN (.+) AND isCompleted AND completed_at >= \\$1 AND completed_at < \\$2").
+		WithArgs(today.AddDate(0, 0, -1), today, 4).
+		WillReturnRows(todoRows().AddRow(2, "Buy milk", "Semi-skimmed", true, nil, nil, nil, false, nil, lastWeek, now, now, nil, nil, 1, nil, nil))
+
+	digest, err := buildDigest(db, 4, now, time.UTC)
+	assert.NoError(t, err)
+	assert.False(t, digest.Empty())
+	assert.Len(t, digest.Overdue, 1)
+	assert.Empty(t, digest.DueToday)
+	assert.Len(t, digest.CompletedYesterday, 1)
+
+	text, err := digest.Text()
+	assert.NoError(t, err)
+	assert.Contains(t, text, "Overdue (1)")
+	assert.Contains(t, text, "- Pay rent [Finance] (due Sep 11 00:00)")
+	assert.Contains(t, text, "Completed yesterday (1)")
+	assert.NotContains(t, text, "Due today")
+
+	html, err := digest.HTML()
+	assert.NoError(t, err)
+	assert.Contains(t, html, "<strong>Buy milk</strong>")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSendDigestSkipsEmptyDigest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT (.+) FROM todo WHERE").WillReturnRows(todoRows())
+	}
+
+	notifier := &recordingNotifier{}
+	err = sendDigest(db, notifier, 4, "someone@example.com", time.Now(), time.UTC)
+	assert.NoError(t, err)
+	assert.Empty(t, notifier.sent, "An empty digest should not be delivered")
+}
+
+func TestSendDigestsPerUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2024, time.September, 18, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT id, email, timezone FROM app_user WHERE email IS NOT NULL").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "timezone"}).
+			AddRow(1, "alice@example.com", nil).
+			AddRow(2, "bob@example.com", "Europe/Copenhagen").
+			AddRow(3, "carol@example.com", "America/Toronto"))
+
+	// Each user's digest only has their own todos in it
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE (.+) AND NOT isCompleted").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+		WillReturnRows(todoRows().AddRow(1, "Pay rent", "", false, nil, now.AddDate(0, 0, -2), "UTC", false, nil, now, now, nil, nil, nil, 1, nil, 1))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE").WillReturnRows(todoRows())
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE").WillReturnRows(todoRows())
+	// Bob's digest went out at 8 in the morning Copenhagen time, hours ago
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT (.+) FROM todo WHERE").WillReturnRows(todoRows())
+	}
+
+	// Digests go out at 8 in the morning, which it now is in New York and Toronto
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	schedule := digestSchedule{hour: 8, minute: 0, fallback: newYork}
+	notifier := &recordingNotifier{}
+	assert.NoError(t, sendDigests(db, notifier, schedule, now.Add(-time.Minute), now))
+	assert.Len(t, notifier.sent, 1, "Carol's digest is empty")
+	assert.Equal(t, "alice@example.com", notifier.sent[0].To)
+	assert.Contains(t, notifier.sent[0].Text, "Pay rent")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+type recordingNotifier struct {
+	sent []Notification
+}
+
+func (r *recordingNotifier) Notify(n Notification) error {
+	r.sent = append(r.sent, n)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// duplicateThreshold is how similar two normalized titles must be, from 0 to 1, to count as duplicates.
+const duplicateThreshold = 0.85
+
+// Duplicate is an open todo whose title closely matches a new one.
+type Duplicate struct {
+	ID         int     `json:"id"`
+	Title      string  `json:"title"`
+	Similarity float64 `json:"similarity"`
+}
+
+// duplicateMode reads the ?duplicates= flag of a create request: warn (the default) creates
+// the todo and points at the duplicate, reject refuses to create it and allow skips the check.
+func duplicateMode(value string) (string, error) {
+	switch value {
+	case "":
+		return "warn", nil
+	case "warn", "reject", "allow":
+		return value, nil
+	}
+	return "", fmt.Errorf("duplicates must be warn, reject or allow")
+}
+
+// findDuplicate returns the open todo the owner can see in the list whose title is most similar to
+// title, if any is similar enough. A listID of 0 means the default list.
+func findDuplicate(db dbtx, owner int, title string, listID int) (*Duplicate, error) {
+	rows, err := db.Query(`SELECT id, title FROM todo WHERE deleted_at IS NULL AND NOT iscompleted
+		AND list_id = COALESCE(NULLIF($1, 0), `+defaultList+`) AND `+visibleTo(2)+` ORDER BY id`, listID, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	normalized := normalizeTitle(title)
+	var best *Duplicate
+	for rows.Next() {
+		var d Duplicate
+		if err := rows.Scan(&d.ID, &d.Title); err != nil {
+			return nil, err
+		}
+		d.Similarity = similarity(normalized, normalizeTitle(d.Title))
+		if d.Similarity >= duplicateThreshold && (best == nil || d.Similarity > best.Similarity) {
+			best = &d
+		}
+	}
+	return best, rows.Err()
+}
+
+// normalizeTitle lowercases a title, drops punctuation and collapses whitespace, so that
+// "Buy milk!" and "buy  milk" compare equal.
+func normalizeTitle(s string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return unicode.ToLower(r)
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return -1
+	}, s)
+	return strings.Join(strings.Fields(cleaned), " ")
+}
+
+// similarity scores two strings from 0 to 1 by their edit distance relative to the longer one.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(longest)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimilarity(t *testing.T) {
+	assert.Equal(t, "buy milk", normalizeTitle("  Buy   MILK! "))
+	assert.Equal(t, 3, editDistance([]rune("kitten"), []rune("sitting")))
+	assert.Equal(t, 1.0, similarity("", ""))
+	assert.Equal(t, 1.0, similarity(normalizeTitle("Buy milk."), normalizeTitle("buy milk")))
+	assert.GreaterOrEqual(t, similarity("buy milk", "buy milks"), duplicateThreshold)
+	assert.Less(t, similarity("buy milk", "call mum"), duplicateThreshold)
+}
+
+func TestFindDuplicate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, title FROM todo WHERE deleted_at IS NULL AND NOT iscompleted\\s+AND list_id = COALESCE\\(NULLIF\\(\\$1, 0\\), (.+)\\) AND \\(\\(owner_id = \\$2 (.+) user_id = \\$2\\)\\)").
+		WithArgs(0, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).
+			AddRow(1, "Call mum").
+			AddRow(2, "Buy milk and eggs").
+			AddRow(3, "buy milk"))
+
+	d, err := findDuplicate(db, 1, "Buy milk!", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, &Duplicate{ID: 3, Title: "buy milk", Similarity: 1}, d)
+
+	mock.ExpectQuery("SELECT id, title FROM todo").
+		WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title"}).AddRow(1, "Call mum"))
+	d, err = findDuplicate(db, 1, "Water plants", 2)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	_, err = duplicateMode("sometimes")
+	assert.EqualError(t, err, "duplicates must be warn, reject or allow")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
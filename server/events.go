@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// With STORAGE_MODE=events every change is appended to todo_event, in the same transaction
+// that updates the todo table. The log is the source of truth: the todo table is only a
+// projection of it, and replayEvents rebuilds the table from the log at any time.
+
+const (
+	TodoCreated = "TodoCreated"
+	TodoUpdated = "TodoUpdated"
+	TodoToggled = "TodoToggled"
+	TodoDeleted = "TodoDeleted"
+)
+
+// Event is one entry in the append-only log.
+type Event struct {
+	Seq        int64           `json:"seq"`
+	TodoID     int             `json:"todo_id"`
+	Type       string          `json:"type"`
+	Actor      string          `json:"actor"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// toggledData is the payload of TodoToggled.
+type toggledData struct {
+	Done        bool       `json:"done"`
+	CompletedAt *time.Time `json:"completed_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	// State is the workflow state the toggle moved the todo to; empty in events from before workflows
+	State string `json:"state,omitempty"`
+}
+
+// deletedData is the payload of TodoDeleted. A purged todo is gone for good; otherwise it
+// was moved to the trash at DeletedAt.
+type deletedData struct {
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Purged    bool       `json:"purged,omitempty"`
+}
+
+// eventSourced reports whether changes are written to the event log.
+func eventSourced() bool {
+	return getEnv("STORAGE_MODE", "table") == "events"
+}
+
+// snapshotInterval is how many events a todo accumulates before its state is snapshotted.
+func snapshotInterval() int {
+	return getEnvInt("EVENT_SNAPSHOT_INTERVAL", 50)
+}
+
+// newEvent describes a change to a todo, given the action and the todo's state afterwards.
+// Actions other than the four basic ones (restore, undo, redo) carry the full state.
+func newEvent(action string, after *Todo) (string, any) {
+	switch {
+	case after == nil:
+		return TodoDeleted, deletedData{Purged: true}
+	case action == "create":
+		return TodoCreated, after
+	case action == "toggle":
+		return TodoToggled, toggledData{Done: after.Done, CompletedAt: after.CompletedAt, UpdatedAt: after.UpdatedAt, State: after.State}
+	case action == "delete":
+		return TodoDeleted, deletedData{DeletedAt: after.DeletedAt}
+	default:
+		return TodoUpdated, after
+	}
+}
+
+// appendEvent logs a change when running in event-sourced mode and snapshots the todo once
+// enough events have piled up since its last snapshot.
+func appendEvent(tx dbtx, todoID int, actor, action string, after *Todo) error {
+	if !eventSourced() {
+		return nil
+	}
+
+	kind, payload := newEvent(action, after)
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// A purged todo is gone by now, so its owner comes from its earlier events
+	owner := 0
+	if after != nil {
+		owner = after.OwnerID
+	}
+	var seq int64
+	err = tx.QueryRow(`INSERT INTO todo_event (todo_id, type, actor, data, owner_id)
+		VALUES ($1, $2, $3, $4, COALESCE(NULLIF($5, 0), (SELECT max(owner_id) FROM todo_event WHERE todo_id = $1)))
+		RETURNING seq`, todoID, kind, actor, string(data), owner).Scan(&seq)
+	if err != nil {
+		return err
+	}
+
+	var pending int
+	err = tx.QueryRow(`SELECT count(*) FROM todo_event WHERE todo_id = $1
+		AND seq > COALESCE((SELECT seq FROM todo_snapshot WHERE todo_id = $1), 0)`, todoID).Scan(&pending)
+	if err != nil || pending < snapshotInterval() {
+		return err
+	}
+
+	state, err := snapshot(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO todo_snapshot (todo_id, seq, data) VALUES ($1, $2, $3)
+		ON CONFLICT (todo_id) DO UPDATE SET seq = EXCLUDED.seq, data = EXCLUDED.data`, todoID, seq, nullJSON(state))
+	return err
+}
+
+// applyEvent folds an event into a todo's state; a nil result means the todo no longer exists.
+func applyEvent(state *Todo, e Event) (*Todo, error) {
+	switch e.Type {
+	case TodoCreated, TodoUpdated:
+		return decodeSnapshot(e.Data)
+	case TodoToggled:
+		if state == nil {
+			return nil, fmt.Errorf("event %d toggles todo %d before it exists", e.Seq, e.TodoID)
+		}
+		var d toggledData
+		if err := json.Unmarshal(e.Data, &d); err != nil {
+			return nil, err
+		}
+		state.Done, state.CompletedAt, state.UpdatedAt, state.State = d.Done, d.CompletedAt, d.UpdatedAt, d.State
+		return state, nil
+	case TodoDeleted:
+		var d deletedData
+		if err := json.Unmarshal(e.Data, &d); err != nil {
+			return nil, err
+		}
+		if d.Purged || state == nil {
+			return nil, nil
+		}
+		state.DeletedAt = d.DeletedAt
+		return state, nil
+	}
+	return nil, fmt.Errorf("event %d has unknown type %q", e.Seq, e.Type)
+}
+
+// seedEventLog gives todos that existed before event sourcing was switched on a TodoCreated
+// event, so the log alone can reproduce the table.
+func seedEventLog(db *sql.DB) error {
+	rows, err := db.Query("SELECT " + todoColumns + ` FROM todo
+		WHERE NOT EXISTS (SELECT 1 FROM todo_event e WHERE e.todo_id = todo.id) ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	todos, err := scanTodos(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, todo := range todos {
+		data, err := snapshot(&todo)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO todo_event (todo_id, type, actor, occurred_at, data, owner_id) VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))",
+			todo.ID, TodoCreated, "system", todo.CreatedAt, string(data), todo.OwnerID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getEvents pages through the owner's part of the log in order, for consumers building
+// their own read models.
+func getEvents(db *sql.DB, owner int, after int64, limit int) ([]Event, error) {
+	rows, err := db.Query(`SELECT seq, todo_id, type, actor, occurred_at, data FROM todo_event
+		WHERE seq > $1 AND owner_id = $3 ORDER BY seq LIMIT $2`, after, limit, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Seq, &e.TodoID, &e.Type, &e.Actor, &e.OccurredAt, &e.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// loadProjection folds the log into the current state of every todo, starting each todo
+// from its latest snapshot rather than its first event.
+func loadProjection(tx dbtx) (map[int]*Todo, error) {
+	rows, err := tx.Query("SELECT todo_id, seq, data FROM todo_snapshot")
+	if err != nil {
+		return nil, err
+	}
+	state := map[int]*Todo{}
+	snapshotSeq := map[int]int64{}
+	for rows.Next() {
+		var id int
+		var seq int64
+		var data []byte
+		if err := rows.Scan(&id, &seq, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if state[id], err = decodeSnapshot(data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snapshotSeq[id] = seq
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query("SELECT seq, todo_id, type, actor, occurred_at, data FROM todo_event ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Seq, &e.TodoID, &e.Type, &e.Actor, &e.OccurredAt, &e.Data); err != nil {
+			return nil, err
+		}
+		if e.Seq <= snapshotSeq[e.TodoID] {
+			continue
+		}
+		if state[e.TodoID], err = applyEvent(state[e.TodoID], e); err != nil {
+			return nil, err
+		}
+	}
+	return state, rows.Err()
+}
+
+// errNotEventSourced is returned by replayEvents outside STORAGE_MODE=events, where the log
+// does not describe every todo.
+var errNotEventSourced = errors.New("replay needs STORAGE_MODE=events")
+
+// replayEvents rebuilds the todo table from the event log and reports how many todos it holds.
+// Todos are rewritten in place and only those the log says were purged are deleted, so share
+// links and assignments, which are not in the log, survive, and todos the log knows nothing
+// about are left alone.
+func replayEvents(db *sql.DB) (int, error) {
+	if !eventSourced() {
+		return 0, errNotEventSourced
+	}
+
+	n := 0
+	err := withTx(db, func(tx *sql.Tx) error {
+		state, err := loadProjection(tx)
+		if err != nil {
+			return err
+		}
+
+		purged := []int{}
+		for id, todo := range state {
+			if todo == nil {
+				purged = append(purged, id)
+				continue
+			}
+			if err := projectTodo(tx, id, todo); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := tx.Exec("DELETE FROM todo WHERE id = ANY($1)", pq.Array(purged)); err != nil {
+			return err
+		}
+
+		// Keep new ids clear of every id the log has ever handed out
+		_, err = tx.Exec(`SELECT setval(pg_get_serial_sequence('todo', 'id'),
+			GREATEST((SELECT max(todo_id) FROM todo_event), 1))`)
+		return err
+	})
+	return n, err
+}
+
+// projectTodo writes a todo row exactly as the log describes it, timestamps included,
+// overwriting the row if it exists.
+func projectTodo(tx dbtx, id int, todo *Todo) error {
+	_, err := tx.Exec(`INSERT INTO todo (id, title, text, iscompleted, category, deadline, deadline_tz, all_day, priority,
+			created_at, updated_at, completed_at, deleted_at, rank, list_id, state, owner_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, COALESCE(NULLIF($15, 0), `+defaultList+`), NULLIF($16, ''),
+			(SELECT max(owner_id) FROM todo_event WHERE todo_id = $1))
+		ON CONFLICT (id) DO UPDATE SET title = EXCLUDED.title, text = EXCLUDED.text, iscompleted = EXCLUDED.iscompleted,
+			category = EXCLUDED.category, deadline = EXCLUDED.deadline, deadline_tz = EXCLUDED.deadline_tz,
+			all_day = EXCLUDED.all_day, priority = EXCLUDED.priority, created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at, completed_at = EXCLUDED.completed_at, deleted_at = EXCLUDED.deleted_at,
+			rank = EXCLUDED.rank, list_id = EXCLUDED.list_id, state = EXCLUDED.state, owner_id = EXCLUDED.owner_id`,
+		id, todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.DeadlineTZ, todo.AllDay, todo.Priority,
+		todo.CreatedAt, todo.UpdatedAt, todo.CompletedAt, todo.DeletedAt, todo.Rank, todo.ListID, todo.State)
+	return err
+}
+
+// purgeTrashLogged is purgeTrash for event-sourced mode, logging each purged todo.
+func purgeTrashLogged(db *sql.DB, owner int, cutoff time.Time) (int64, error) {
+	var n int64
+	err := withTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query("DELETE FROM todo WHERE deleted_at < $1 AND ($2::int = 0 OR "+editableBy(2)+") RETURNING id", cutoff, owner)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := appendEvent(tx, id, "system", "purge", nil); err != nil {
+				return err
+			}
+		}
+		n = int64(len(ids))
+		return nil
+	})
+	return n, err
+}
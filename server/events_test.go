@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyEvents(t *testing.T) {
+	created := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	toggled := created.Add(time.Hour)
+	todo := &Todo{ID: 1, Title: "Buy milk", Body: "Semi-skimmed", CreatedAt: created, UpdatedAt: created}
+
+	var state *Todo
+	seq := int64(0)
+	apply := func(action string, after *Todo) {
+		kind, payload := newEvent(action, after)
+		data, err := json.Marshal(payload)
+		assert.NoError(t, err)
+		seq++
+		state, err = applyEvent(state, Event{Seq: seq, TodoID: 1, Type: kind, Data: data})
+		assert.NoError(t, err)
+	}
+
+	apply("create", todo)
+	assert.Equal(t, "Buy milk", state.Title)
+
+	done := *todo
+	done.Done, done.CompletedAt, done.UpdatedAt = true, &toggled, toggled
+	apply("toggle", &done)
+	assert.True(t, state.Done)
+	assert.Equal(t, toggled, *state.CompletedAt)
+
+	trashed := done
+	trashed.DeletedAt = &toggled
+	apply("delete", &trashed)
+	assert.Equal(t, toggled, *state.DeletedAt)
+
+	// Restoring carries the full state
+	apply("restore", &done)
+	assert.Nil(t, state.DeletedAt)
+	assert.True(t, state.Done)
+
+	apply("purge", nil)
+	assert.Nil(t, state)
+
+	_, err := applyEvent(nil, Event{Seq: 9, TodoID: 1, Type: TodoToggled, Data: []byte(`{"done":true}`)})
+	assert.EqualError(t, err, "event 9 toggles todo 1 before it exists")
+}
+
+func TestAppendEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	todo := &Todo{ID: 1, Title: "Buy milk", OwnerID: 2}
+
+	// Outside event-sourced mode nothing is logged
+	t.Setenv("STORAGE_MODE", "table")
+	assert.NoError(t, appendEvent(db, 1, "alice", "create", todo))
+
+	t.Setenv("STORAGE_MODE", "events")
+	t.Setenv("EVENT_SNAPSHOT_INTERVAL", "2")
+	mock.ExpectQuery("INSERT INTO todo_event \\(todo_id, type, actor, data, owner_id\\)").
+		WithArgs(1, TodoUpdated, "alice", sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(8))
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM todo_event").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec("INSERT INTO todo_snapshot \\(todo_id, seq, data\\)").
+		WithArgs(1, int64(8), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, appendEvent(db, 1, "alice", "update", todo))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoadProjectionStartsFromSnapshot(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT todo_id, seq, data FROM todo_snapshot").
+		WillReturnRows(sqlmock.NewRows([]string{"todo_id", "seq", "data"}).
+			AddRow(1, 2, []byte(`{"id":1,"title":"Snapshotted"}`)))
+	mock.ExpectQuery("SELECT (.+) FROM todo_event ORDER BY seq").
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "todo_id", "type", "actor", "occurred_at", "data"}).
+			AddRow(1, 1, TodoCreated, "alice", now, []byte(`{"id":1,"title":"Before the snapshot"}`)).
+			AddRow(3, 1, TodoToggled, "alice", now, []byte(`{"done":true}`)).
+			AddRow(4, 2, TodoCreated, "bob", now, []byte(`{"id":2,"title":"Call mum"}`)).
+			AddRow(5, 2, TodoDeleted, "bob", now, []byte(`{"purged":true}`)))
+
+	state, err := loadProjection(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "Snapshotted", state[1].Title)
+	assert.True(t, state[1].Done)
+	assert.Nil(t, state[2])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReplayEventsKeepsLinksAndAssignees(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// In table mode the log may not cover every todo, so there is nothing to replay from
+	t.Setenv("STORAGE_MODE", "table")
+	_, err = replayEvents(db)
+	assert.Equal(t, errNotEventSourced, err)
+
+	t.Setenv("STORAGE_MODE", "events")
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT todo_id, seq, data FROM todo_snapshot").
+		WillReturnRows(sqlmock.NewRows([]string{"todo_id", "seq", "data"}))
+	mock.ExpectQuery("SELECT (.+) FROM todo_event ORDER BY seq").
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "todo_id", "type", "actor", "occurred_at", "data"}).
+			AddRow(1, 1, TodoCreated, "alice", now, []byte(`{"id":1,"title":"Shared and assigned"}`)).
+			AddRow(2, 2, TodoCreated, "alice", now, []byte(`{"id":2,"title":"Purged"}`)).
+			AddRow(3, 2, TodoDeleted, "alice", now, []byte(`{"purged":true}`)))
+
+	// The todo is rewritten where it is rather than deleted and inserted again, which would
+	// take its share links and assignments with it
+	mock.ExpectExec("INSERT INTO todo (.+) ON CONFLICT \\(id\\) DO UPDATE SET").
+		WithArgs(1, "Shared and assigned", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Only what the log purged is deleted; todos it has no events for stay
+	mock.ExpectExec("DELETE FROM todo WHERE id = ANY\\(\\$1\\)").
+		WithArgs("{2}").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT setval").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	n, err := replayEvents(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HistoryEntry is one recorded change to a todo. Before is null for a create and After is
+// null for a purge; both are snapshots in the same shape the API returns todos.
+type HistoryEntry struct {
+	ID        int64           `json:"id"`
+	TodoID    int             `json:"todo_id"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	ChangedAt time.Time       `json:"changed_at"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Changes   []FieldChange   `json:"changes"`
+}
+
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+// actorFromRequest names who is making the request, for the audit trail.
+func actorFromRequest(c *fiber.Ctx) string {
+	if u, ok := c.Locals("user").(User); ok {
+		return u.Username
+	}
+	return "anonymous"
+}
+
+// lockTodo reads a todo, trashed or not, and locks its row until the transaction ends.
+func lockTodo(tx dbtx, id int) (*Todo, error) {
+	todo, err := scanTodo(tx.QueryRow("SELECT "+todoColumns+" FROM todo WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &todo, nil
+}
+
+// changeTodo runs change in a transaction and records the todo's state before and after it
+// in todo_history. id is 0 when change creates the todo, in which case change returns the new
+// id; otherwise it returns id. A missing todo is reported as sql.ErrNoRows. The history names
+// the actor; undoable changes are pushed onto the undo stack of the user with id userID.
+func changeTodo(db *sql.DB, actor string, userID int, action string, id int, change func(tx dbtx) (int, error)) (int, error) {
+	err := withTx(db, func(tx *sql.Tx) error {
+		var historyID int64
+		var err error
+		id, historyID, err = changeTodoTx(tx, actor, action, id, change)
+		if err != nil || historyID == 0 || !undoableActions[action] {
+			return err
+		}
+		return pushUndo(tx, userID, historyID)
+	})
+	return id, err
+}
+
+// changeTodoTx is changeTodo inside a transaction the caller already holds, without the undo
+// stack. It also returns the id of the history entry, 0 if the change changed nothing.
+func changeTodoTx(tx dbtx, actor, action string, id int, change func(tx dbtx) (int, error)) (int, int64, error) {
+	var before *Todo
+	if id != 0 {
+		var err error
+		if before, err = lockTodo(tx, id); err != nil {
+			return id, 0, err
+		}
+		if before == nil {
+			return id, 0, sql.ErrNoRows
+		}
+	}
+
+	var err error
+	if id, err = change(tx); err != nil {
+		return id, 0, err
+	}
+
+	after, err := lockTodo(tx, id)
+	if err != nil {
+		return id, 0, err
+	}
+
+	historyID, err := recordHistory(tx, id, actor, action, before, after)
+	return id, historyID, err
+}
+
+// recordHistory stores a change and returns its id, or 0 when before and after are identical.
+func recordHistory(tx dbtx, todoID int, actor, action string, before, after *Todo) (int64, error) {
+	beforeJSON, err := snapshot(before)
+	if err != nil {
+		return 0, err
+	}
+	afterJSON, err := snapshot(after)
+	if err != nil {
+		return 0, err
+	}
+
+	// Nothing changed, e.g. deleting a todo that was already in the trash
+	if bytes.Equal(beforeJSON, afterJSON) {
+		return 0, nil
+	}
+
+	var id int64
+	err = tx.QueryRow(`INSERT INTO todo_history (todo_id, action, actor, before, after) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		todoID, action, actor, nullJSON(beforeJSON), nullJSON(afterJSON)).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := recordVersion(tx, todoID, after, afterJSON); err != nil {
+		return 0, err
+	}
+	return id, appendEvent(tx, todoID, actor, action, after)
+}
+
+func snapshot(todo *Todo) ([]byte, error) {
+	if todo == nil {
+		return nil, nil
+	}
+	return json.Marshal(todo)
+}
+
+// nullJSON stores a missing snapshot as SQL NULL rather than an empty string.
+func nullJSON(b []byte) any {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+func getTodoHistory(db *sql.DB, todoID int) ([]HistoryEntry, error) {
+	rows, err := db.Query(`SELECT id, todo_id, action, actor, changed_at, before, after
+		FROM todo_history WHERE todo_id = $1 ORDER BY id`, todoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.TodoID, &e.Action, &e.Actor, &e.ChangedAt, &before, &after); err != nil {
+			return nil, err
+		}
+
+		if before != nil {
+			e.Before = before
+		}
+		if after != nil {
+			e.After = after
+		}
+		if e.Changes, err = diffSnapshots(before, after); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// ignoredDiffFields change on every write and would only add noise to a diff.
+var ignoredDiffFields = map[string]bool{"updated_at": true}
+
+// diffSnapshots lists the fields that differ between two todo snapshots, sorted by name.
+// A missing snapshot is treated as a todo with no fields.
+func diffSnapshots(before, after []byte) ([]FieldChange, error) {
+	var b, a map[string]any
+	if before != nil {
+		if err := json.Unmarshal(before, &b); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &a); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := map[string]bool{}
+	for f := range b {
+		fields[f] = true
+	}
+	for f := range a {
+		fields[f] = true
+	}
+
+	changes := []FieldChange{}
+	for f := range fields {
+		if ignoredDiffFields[f] {
+			continue
+		}
+		old, oldOK := b[f]
+		cur, curOK := a[f]
+		if oldOK == curOK && jsonEqual(old, cur) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: f, Before: old, After: cur})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+func jsonEqual(a, b any) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
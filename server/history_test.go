@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	before := []byte(`{"id":1,"title":"Old title","done":false,"category":null,"updated_at":"2024-09-01T00:00:00Z"}`)
+	after := []byte(`{"id":1,"title":"New title","done":true,"category":"Work","updated_at":"2024-09-02T00:00:00Z"}`)
+
+	changes, err := diffSnapshots(before, after)
+	assert.NoError(t, err)
+	assert.Equal(t, []FieldChange{
+		{Field: "category", Before: nil, After: "Work"},
+		{Field: "done", Before: false, After: true},
+		{Field: "title", Before: "Old title", After: "New title"},
+	}, changes)
+
+	// A create has no before snapshot, so every field is reported
+	changes, err = diffSnapshots(nil, []byte(`{"id":2,"title":"Created"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []FieldChange{
+		{Field: "id", Before: nil, After: float64(2)},
+		{Field: "title", Before: nil, After: "Created"},
+	}, changes)
+}
+
+func TestChangeTodo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Title", "Some description", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 1, nil, nil))
+	mock.ExpectExec("UPDATE todo SET deleted_at=now\\(\\)").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Title", "Some description", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, fixedTime, nil, 1, nil, nil))
+	mock.ExpectQuery("INSERT INTO todo_history \\(todo_id, action, actor, before, after\\)").
+		WithArgs(1, "delete", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	// The todo is now in the trash, so its version is closed without opening a new one
+	mock.ExpectExec("UPDATE todo_version SET valid_to = now\\(\\) WHERE todo_id = \\$1 AND valid_to IS NULL").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM undo_stack WHERE user_id = \\$1 AND undone_at IS NOT NULL").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO undo_stack \\(user_id, history_id\\)").
+		WithArgs(1, int64(42)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM undo_stack WHERE user_id = \\$1 AND undone_at IS NULL AND id NOT IN").
+		WithArgs(1, undoLimit()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	id, err := changeTodo(db, "alice", 1, "delete", 1, func(tx dbtx) (int, error) {
+		return 1, deleteTodo(tx, 1)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, id)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestChangeTodoMissing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(7).
+		WillReturnRows(todoRows())
+	mock.ExpectRollback()
+
+	_, err = changeTodo(db, "alice", 1, "toggle", 7, func(tx dbtx) (int, error) {
+		t.Fatal("change must not run for a missing todo")
+		return 0, nil
+	})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRecordHistorySkipsNoop(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	todo := &Todo{ID: 1, Title: "Unchanged"}
+	id, err := recordHistory(db, 1, "alice", "delete", todo, todo)
+	assert.NoError(t, err)
+	assert.Zero(t, id)
+
+	// No statement may have been executed
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
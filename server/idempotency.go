@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// idempotencyRetention is how long a key and its response are kept for replay.
+func idempotencyRetention() time.Duration {
+	return getEnvDuration("IDEMPOTENCY_RETENTION", 24*time.Hour)
+}
+
+// idempotent makes a route safe to retry. The first request with a given Idempotency-Key
+// header runs normally and its response is stored; retries with the same key, query and body
+// get that response back instead of running again, and reusing the key for a different
+// request is rejected. Keys are scoped to the actor and route. Server errors and panics are
+// not stored, so a request that failed that way can be retried for real.
+func idempotent(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("Idempotency-Key")
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(fiber.StatusBadRequest).SendString("Idempotency-Key must be at most 255 characters")
+		}
+
+		scope := actorFromRequest(c) + " " + c.Method() + " " + c.Path()
+		hash := requestFingerprint(c)
+
+		if _, err := db.Exec("DELETE FROM idempotency_key WHERE created_at < $1", time.Now().Add(-idempotencyRetention())); err != nil {
+			return c.Status(500).SendString("Failed to check idempotency key")
+		}
+
+		// Claim the key; only the request that inserts the row goes on to run
+		res, err := db.Exec(`INSERT INTO idempotency_key (key, scope, request_hash) VALUES ($1, $2, $3)
+			ON CONFLICT (key, scope) DO NOTHING`, key, scope, hash)
+		if err != nil {
+			return c.Status(500).SendString("Failed to check idempotency key")
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return replayIdempotent(c, db, key, scope, hash)
+		}
+
+		// Unless the response gets stored, release the key, even when the handler panics
+		stored := false
+		defer func() {
+			if !stored {
+				db.Exec("DELETE FROM idempotency_key WHERE key = $1 AND scope = $2", key, scope)
+			}
+		}()
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status >= 500 {
+			return nil
+		}
+		_, err = db.Exec("UPDATE idempotency_key SET status = $1, content_type = $2, body = $3 WHERE key = $4 AND scope = $5",
+			status, string(c.Response().Header.ContentType()), c.Response().Body(), key, scope)
+		stored = err == nil
+		return err
+	}
+}
+
+// requestFingerprint hashes what makes two requests with the same key the same request:
+// the method, path, query and body.
+func requestFingerprint(c *fiber.Ctx) string {
+	h := sha256.New()
+	h.Write([]byte(c.Method() + " " + c.Path() + "?"))
+	h.Write(c.Request().URI().QueryString())
+	h.Write([]byte("\n"))
+	h.Write(c.Body())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayIdempotent answers a retry with the stored response.
+func replayIdempotent(c *fiber.Ctx, db *sql.DB, key, scope, hash string) error {
+	var storedHash string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err := db.QueryRow("SELECT request_hash, status, content_type, body FROM idempotency_key WHERE key = $1 AND scope = $2",
+		key, scope).Scan(&storedHash, &status, &contentType, &body)
+	if err != nil {
+		return c.Status(500).SendString("Failed to check idempotency key")
+	}
+
+	if storedHash != hash {
+		return c.Status(fiber.StatusUnprocessableEntity).SendString("Idempotency-Key has already been used for a different request")
+	}
+	if !status.Valid {
+		return c.Status(fiber.StatusConflict).SendString("a request with this Idempotency-Key is still being processed")
+	}
+
+	c.Set("Idempotent-Replayed", "true")
+	if contentType.String != "" {
+		c.Set(fiber.HeaderContentType, contentType.String)
+	}
+	return c.Status(int(status.Int64)).Send(body)
+}
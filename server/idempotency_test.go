@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	calls := 0
+	app := fiber.New()
+	// Stands in for requireAuth
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", User{ID: 1, Username: "alice"})
+		return c.Next()
+	})
+	app.Post("/api/todos", idempotent(db), func(c *fiber.Ctx) error {
+		calls++
+		return c.Status(201).JSON(fiber.Map{"id": 7})
+	})
+
+	post := func(target, body string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "abc")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	body := `{"title":"Buy milk"}`
+	sum := sha256.Sum256([]byte("POST /api/todos?\n" + body))
+	hash := hex.EncodeToString(sum[:])
+	scope := "alice POST /api/todos"
+
+	// The first request runs and its response is stored
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE created_at < \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_key \\(key, scope, request_hash\\)").
+		WithArgs("abc", scope, hash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE idempotency_key SET status = \\$1").
+		WithArgs(201, "application/json", []byte(`{"id":7}`), "abc", scope).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp, got := post("/api/todos", body)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, `{"id":7}`, got)
+
+	// A retry gets the stored response without running the handler again
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE created_at < \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_key").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT request_hash, status, content_type, body FROM idempotency_key").
+		WithArgs("abc", scope).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "content_type", "body"}).
+			AddRow(hash, 201, "application/json", []byte(`{"id":7}`)))
+
+	resp, got = post("/api/todos", body)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, `{"id":7}`, got)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, calls)
+
+	// Reusing the key for something else is refused
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE created_at < \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_key").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT request_hash, status, content_type, body FROM idempotency_key").
+		WithArgs("abc", scope).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "content_type", "body"}).
+			AddRow(hash, 201, "application/json", []byte(`{"id":7}`)))
+
+	resp, _ = post("/api/todos", `{"title":"Buy bread"}`)
+	assert.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, 1, calls)
+
+	// So is reusing it with other query parameters
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE created_at < \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_key").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT request_hash, status, content_type, body FROM idempotency_key").
+		WithArgs("abc", scope).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "content_type", "body"}).
+			AddRow(hash, 201, "application/json", []byte(`{"id":7}`)))
+
+	resp, _ = post("/api/todos?list=2", body)
+	assert.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, 1, calls)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIdempotentReleasesKeyOnPanic(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	app := fiber.New()
+	app.Use(recover.New())
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", User{ID: 1, Username: "alice"})
+		return c.Next()
+	})
+	app.Post("/api/todos", idempotent(db), func(c *fiber.Ctx) error {
+		panic("handler failed")
+	})
+
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE created_at < \\$1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_key").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM idempotency_key WHERE key = \\$1 AND scope = \\$2").
+		WithArgs("abc", "alice POST /api/todos").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/todos", strings.NewReader(`{"title":"Buy milk"}`))
+	req.Header.Set("Idempotency-Key", "abc")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
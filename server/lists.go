@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TodoList groups todos into a project. The list with the lowest id is the default list:
+// todos created without a list go there, and it can be neither deleted nor archived. Every
+// other list belongs to the user who created it, who can share it with others.
+type TodoList struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	ArchivedAt *time.Time `json:"archived_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	// OwnerID is the user who created the list and can share it; the default list has none
+	OwnerID *int `json:"owner_id"`
+	// Role is what the user asking may do with the list; see sharing.go
+	Role string `json:"role"`
+}
+
+// listColumns selects a list along with the role on it of user $1.
+const listColumns = "id, name, archived_at, created_at, updated_at, owner_id, list_role(id, $1)"
+
+// inActiveList keeps todos of archived lists out of views that span every list.
+const inActiveList = "list_id NOT IN (SELECT id FROM todo_list WHERE archived_at IS NOT NULL)"
+
+// defaultList is the SQL for the default list's id.
+const defaultList = "(SELECT min(id) FROM todo_list)"
+
+var (
+	errDefaultList  = errors.New("the default list cannot be deleted or archived")
+	errListNotEmpty = errors.New("the list still has todos, including any in the trash; move them or archive the list instead")
+)
+
+// isForeignKeyViolation reports whether err is Postgres rejecting a reference to a missing row,
+// such as a todo pointed at a list that does not exist.
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func validateList(l *TodoList) error {
+	if l.Name == "" {
+		return errors.New("list name must not be empty")
+	}
+	return nil
+}
+
+func scanList(row rowScanner) (TodoList, error) {
+	var l TodoList
+	var archivedAt sql.NullTime
+	var owner sql.NullInt64
+	var role sql.NullString
+	err := row.Scan(&l.ID, &l.Name, &archivedAt, &l.CreatedAt, &l.UpdatedAt, &owner, &role)
+	if archivedAt.Valid {
+		l.ArchivedAt = &archivedAt.Time
+	}
+	if owner.Valid {
+		id := int(owner.Int64)
+		l.OwnerID = &id
+	}
+	l.Role = role.String
+	return l, err
+}
+
+// getLists returns the lists the user has access to in id order, leaving out archived ones
+// unless asked for.
+func getLists(db *sql.DB, userID int, includeArchived bool) ([]TodoList, error) {
+	rows, err := db.Query("SELECT "+listColumns+` FROM todo_list
+		WHERE (owner_id IS NULL OR id IN (SELECT list_id FROM list_access WHERE user_id = $1))
+		AND ($2 OR archived_at IS NULL) ORDER BY id`, userID, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []TodoList{}
+	for rows.Next() {
+		l, err := scanList(rows)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, rows.Err()
+}
+
+// getList returns a list with the user's role on it.
+func getList(db dbtx, userID, id int) (TodoList, error) {
+	return scanList(db.QueryRow("SELECT "+listColumns+" FROM todo_list WHERE id = $2", userID, id))
+}
+
+// createList creates a list owned by the user.
+func createList(db dbtx, userID int, l *TodoList) error {
+	l.OwnerID, l.Role = &userID, roleOwner
+	return db.QueryRow("INSERT INTO todo_list (name, owner_id) VALUES ($1, $2) RETURNING id, created_at, updated_at", l.Name, userID).
+		Scan(&l.ID, &l.CreatedAt, &l.UpdatedAt)
+}
+
+func renameList(db dbtx, id int, name string) error {
+	res, err := db.Exec("UPDATE todo_list SET name=$1, updated_at=now() WHERE id=$2", name, id)
+	return requireAffected(res, err)
+}
+
+// deleteList removes an empty list.
+func deleteList(db *sql.DB, id int) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		var isDefault, hasTodos bool
+		err := tx.QueryRow(`SELECT id = `+defaultList+`, EXISTS (SELECT 1 FROM todo WHERE list_id = $1)
+			FROM todo_list WHERE id = $1 FOR UPDATE`, id).Scan(&isDefault, &hasTodos)
+		switch {
+		case err != nil:
+			return err
+		case isDefault:
+			return errDefaultList
+		case hasTodos:
+			return errListNotEmpty
+		}
+
+		_, err = tx.Exec("DELETE FROM todo_list WHERE id = $1", id)
+		return err
+	})
+}
+
+// archiveList hides a list and its todos from everyday views, or brings them back.
+func archiveList(db dbtx, id int, archived bool) error {
+	var isDefault bool
+	if err := db.QueryRow("SELECT id = "+defaultList+" FROM todo_list WHERE id = $1", id).Scan(&isDefault); err != nil {
+		return err
+	}
+	if isDefault && archived {
+		return errDefaultList
+	}
+
+	res, err := db.Exec(`UPDATE todo_list SET archived_at=CASE WHEN $1 THEN COALESCE(archived_at, now()) END, updated_at=now()
+		WHERE id=$2`, archived, id)
+	return requireAffected(res, err)
+}
+
+// setTodoList moves a todo to another list, at its end, as ranks from the old list mean
+// nothing in the new one.
+func setTodoList(db dbtx, id, listID int) error {
+	current, err := todoListID(db, id)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE todo SET list_id=$1, updated_at=now() WHERE id=$2 AND deleted_at IS NULL", listID, id)
+	if err := requireAffected(res, err); err != nil || current == listID {
+		return err
+	}
+	return moveTodoToEnd(db, id)
+}
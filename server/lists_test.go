@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectCheck := func(id int, isDefault, hasTodos bool) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id = \\(SELECT min\\(id\\) FROM todo_list\\), EXISTS (.+) FROM todo_list WHERE id = \\$1 FOR UPDATE").
+			WithArgs(id).
+			WillReturnRows(sqlmock.NewRows([]string{"default", "todos"}).AddRow(isDefault, hasTodos))
+	}
+
+	expectCheck(1, true, false)
+	mock.ExpectRollback()
+	assert.Equal(t, errDefaultList, deleteList(db, 1))
+
+	expectCheck(2, false, true)
+	mock.ExpectRollback()
+	assert.Equal(t, errListNotEmpty, deleteList(db, 2))
+
+	expectCheck(3, false, false)
+	mock.ExpectExec("DELETE FROM todo_list WHERE id = \\$1").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, deleteList(db, 3))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestArchiveList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id = \\(SELECT min\\(id\\) FROM todo_list\\) FROM todo_list WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"default"}).AddRow(true))
+	assert.Equal(t, errDefaultList, archiveList(db, 1, true))
+
+	mock.ExpectQuery("SELECT id = (.+) FROM todo_list WHERE id = \\$1").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"default"}).AddRow(false))
+	mock.ExpectExec("UPDATE todo_list SET archived_at=CASE WHEN \\$1 THEN COALESCE\\(archived_at, now\\(\\)\\) END").
+		WithArgs(true, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, archiveList(db, 2, true))
+
+	mock.ExpectQuery("SELECT id = (.+) FROM todo_list WHERE id = \\$1").
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"default"}))
+	assert.Equal(t, sql.ErrNoRows, archiveList(db, 9, false))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetTodoList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// A todo moved to another list goes to the end of it
+	mock.ExpectQuery("SELECT list_id FROM todo WHERE id=\\$1 AND deleted_at IS NULL").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id"}).AddRow(2))
+	mock.ExpectExec("UPDATE todo SET list_id=\\$1, updated_at=now\\(\\) WHERE id=\\$2").
+		WithArgs(3, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT list_id FROM todo WHERE id=\\$1 AND deleted_at IS NULL").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id"}).AddRow(3))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock\\(\\$1, \\$2\\)").
+		WithArgs(rankLockClass, 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT max\\(rank\\) FROM todo WHERE list_id = \\$1").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow("V"))
+	mock.ExpectExec("UPDATE todo SET rank=\\$1, updated_at=now\\(\\) WHERE id=\\$2").
+		WithArgs("k", 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, setTodoList(db, 5, 3))
+
+	// Staying in the same list keeps its place
+	mock.ExpectQuery("SELECT list_id FROM todo WHERE id=\\$1").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id"}).AddRow(3))
+	mock.ExpectExec("UPDATE todo SET list_id=\\$1").
+		WithArgs(3, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, setTodoList(db, 5, 3))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIsForeignKeyViolation(t *testing.T) {
+	assert.True(t, isForeignKeyViolation(fmt.Errorf("insert: %w", &pq.Error{Code: "23503"})))
+	assert.False(t, isForeignKeyViolation(&pq.Error{Code: "23505"}))
+	assert.False(t, isForeignKeyViolation(errors.New("boom")))
+	assert.False(t, isForeignKeyViolation(nil))
+}
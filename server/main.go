@@ -2,9 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -14,12 +19,127 @@ import (
 )
 
 type Todo struct {
-	ID       int        `json:"id"`
-	Title    string     `json:"title"`
-	Body     string     `json:"body"`
-	Done     bool       `json:"done"`
-	Category *string    `json:"category"`
-	Deadline *time.Time `json:"deadline"`
+	ID         int        `json:"id"`
+	Title      string     `json:"title"`
+	Body       string     `json:"body"`
+	Done       bool       `json:"done"`
+	Category   *string    `json:"category"`
+	Deadline   *time.Time `json:"deadline"`
+	DeadlineTZ *string    `json:"deadline_tz"`
+	AllDay     bool       `json:"all_day"`
+	Priority   *string    `json:"priority"`
+	// ListID is the list the todo belongs to; 0 on create means the default list
+	ListID int `json:"list_id"`
+	// OwnerID is the user the todo belongs to; set by the server
+	OwnerID int `json:"owner_id"`
+	// State is the todo's workflow state, changed through the transition endpoint; Done follows it
+	State string `json:"state"`
+	// Assignees are changed through /api/todos/:id/assignees and only filled in by some views
+	Assignees []Assignee `json:"assignees,omitempty"`
+
+	// Maintained by the server; ignored when sent by clients
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Rank        string     `json:"rank"`
+
+	// rawDeadline is the deadline as sent by the client, resolved by normalizeDeadline
+	rawDeadline *string
+}
+
+// todoColumns is the column list every todo query selects, in the order scanTodo expects.
+const todoColumns = "id, title, text, isCompleted, category, deadline, deadline_tz, all_day, priority, created_at, updated_at, completed_at, deleted_at, rank, list_id, state, owner_id"
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so queries can run inside a transaction.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// withTx runs fn in a transaction, committing if it returns nil and rolling back otherwise.
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// requireAffected turns a statement that matched no rows into sql.ErrNoRows.
+func requireAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTodo(row rowScanner) (Todo, error) {
+	var todo Todo
+	var category sql.NullString
+	var deadline sql.NullTime
+	var deadlineTZ sql.NullString
+	var priority sql.NullString
+	var completedAt sql.NullTime
+	var deletedAt sql.NullTime
+	var rank sql.NullString
+	var state sql.NullString
+	var owner sql.NullInt64
+
+	err := row.Scan(&todo.ID, &todo.Title, &todo.Body, &todo.Done, &category, &deadline, &deadlineTZ, &todo.AllDay, &priority,
+		&todo.CreatedAt, &todo.UpdatedAt, &completedAt, &deletedAt, &rank, &todo.ListID, &state, &owner)
+	if err != nil {
+		return todo, err
+	}
+
+	// Handle nullable fields
+	if category.Valid {
+		todo.Category = &category.String
+	}
+
+	if deadline.Valid {
+		todo.Deadline = &deadline.Time
+	}
+
+	if deadlineTZ.Valid {
+		todo.DeadlineTZ = &deadlineTZ.String
+	}
+
+	if priority.Valid {
+		todo.Priority = &priority.String
+	}
+
+	if completedAt.Valid {
+		todo.CompletedAt = &completedAt.Time
+	}
+
+	if deletedAt.Valid {
+		todo.DeletedAt = &deletedAt.Time
+	}
+
+	todo.Rank = rank.String
+	todo.State = state.String
+	todo.OwnerID = int(owner.Int64)
+
+	return todo, nil
 }
 
 // Validating Business Logic
@@ -30,18 +150,20 @@ func validateTodoInput(todo *Todo) error {
     if len(todo.Body) < 10 {
         return errors.New("task description must have at least 10 characters")
     }
+    if todo.Priority != nil && !validPriority(*todo.Priority) {
+        return errors.New("task priority must be low, medium or high")
+    }
     return nil
 }
 
-func getTodo(db *sql.DB, id int) (Todo, error) {
-	todo := Todo{}
-
-	row := db.QueryRow("SELECT id, title, text, isCompleted, category, deadline FROM todo WHERE id = $1", id)
+func validPriority(p string) bool {
+	return p == "low" || p == "medium" || p == "high"
+}
 
-	var category sql.NullString
-	var deadline sql.NullTime
+func getTodo(db dbtx, id int) (Todo, error) {
+	row := db.QueryRow("SELECT "+todoColumns+" FROM todo WHERE id = $1 AND deleted_at IS NULL", id)
 
-	err := row.Scan(&todo.ID, &todo.Title, &todo.Body, &todo.Done, &category, &deadline)
+	todo, err := scanTodo(row)
 	if err != nil {
 		// If no row is found, handle the error
 		if err == sql.ErrNoRows {
@@ -50,78 +172,101 @@ func getTodo(db *sql.DB, id int) (Todo, error) {
 		return todo, err
 	}
 
-	// Handle nullable fields
-	if category.Valid {
-		todo.Category = &category.String
-	} else {
-		todo.Category = nil
-	}
+	return todo, nil
+}
 
-	if deadline.Valid {
-		todo.Deadline = &deadline.Time
-	} else {
-		todo.Deadline = nil
+func getAllTodos(db *sql.DB, q todoQuery) ([]Todo, error) {
+	where, args := q.where()
+	rows, err := db.Query("SELECT "+todoColumns+" FROM todo"+where+q.orderBy(), args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return todo, nil
+	return scanTodos(rows)
 }
 
-func getAllTodos(db *sql.DB) ([]Todo, error) {
-	todos := []Todo{}
-
-	rows, err := db.Query("SELECT id, title, text, isCompleted, category, deadline FROM todo")
+// queryTodos lists the todos the owner can see outside the trash and archived lists that
+// match the where clause.
+func queryTodos(db *sql.DB, owner int, where string, args ...any) ([]Todo, error) {
+	args = append(args, owner)
+	rows, err := db.Query("SELECT "+todoColumns+" FROM todo WHERE deleted_at IS NULL AND "+inActiveList+" AND "+visibleTo(len(args))+" AND "+where, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	for rows.Next() {
-		var todo Todo
-		var category sql.NullString
-		var deadline sql.NullTime
+	return scanTodos(rows)
+}
+
+// scanTodos reads every row of a query selecting todoColumns.
+func scanTodos(rows *sql.Rows) ([]Todo, error) {
+	todos := []Todo{}
 
-		err := rows.Scan(&todo.ID, &todo.Title, &todo.Body, &todo.Done, &category, &deadline)
+	for rows.Next() {
+		todo, err := scanTodo(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		// Handle nullable fields (category and deadline)
-		if category.Valid {
-			todo.Category = &category.String
-		} else {
-			todo.Category = nil
-		}
-
-		if deadline.Valid {
-			todo.Deadline = &deadline.Time
-		} else {
-			todo.Deadline = nil
-		}
-
 		todos = append(todos, todo)
 	}
 
-	return todos, nil
+	return todos, rows.Err()
 }
 
-func createTodo(db *sql.DB, todo *Todo) (int, error) {
+// createTodo inserts the todo and fills in the timestamps assigned by the database.
+func createTodo(db dbtx, todo *Todo) (int, error) {
 	var lastInsertId int
-	query := `INSERT INTO todo (title, text, iscompleted, category, deadline)
-			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
-	err := db.QueryRow(query, todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline).Scan(&lastInsertId)
+	var completedAt sql.NullTime
+
+	// New todos go to the end of their list
+	rank, err := nextRank(db, todo.ListID)
+	if err != nil {
+		return 0, err
+	}
+	todo.Rank = rank
+
+	query := `INSERT INTO todo (title, text, iscompleted, category, deadline, deadline_tz, all_day, priority, completed_at, rank, list_id, owner_id)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CASE WHEN $3 THEN now() END, $9, COALESCE(NULLIF($10, 0), ` + defaultList + `), NULLIF($11, 0))
+			  RETURNING id, created_at, updated_at, completed_at, list_id, state`
+	err = db.QueryRow(query, todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.DeadlineTZ, todo.AllDay, todo.Priority, todo.Rank, todo.ListID, todo.OwnerID).
+		Scan(&lastInsertId, &todo.CreatedAt, &todo.UpdatedAt, &completedAt, &todo.ListID, &todo.State)
+
+	todo.CompletedAt = nil
+	if completedAt.Valid {
+		todo.CompletedAt = &completedAt.Time
+	}
 	return lastInsertId, err
 }
 
-func updateTodo(db *sql.DB, id int, todo *Todo) error {
-	query := `UPDATE todo SET title=$1, text=$2, iscompleted=$3, category=$4, deadline=$5 WHERE id=$6`
-	_, err := db.Exec(query, todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, id)
-	return err
+// updateTodo overwrites a todo's fields. A todo given another list goes to the end of it,
+// as with setTodoList.
+func updateTodo(db dbtx, id int, todo *Todo) error {
+	moved := false
+	if todo.ListID != 0 {
+		current, err := todoListID(db, id)
+		if err != nil {
+			return err
+		}
+		moved = current != todo.ListID
+	}
+
+	query := `UPDATE todo SET title=$1, text=$2, iscompleted=$3, category=$4, deadline=$5, deadline_tz=$6, all_day=$7,
+			  priority=$8, completed_at=CASE WHEN $3 THEN COALESCE(completed_at, now()) END, updated_at=now(),
+			  list_id=COALESCE(NULLIF($10, 0), list_id)
+			  WHERE id=$9 AND deleted_at IS NULL`
+	res, err := db.Exec(query, todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.DeadlineTZ, todo.AllDay, todo.Priority, id, todo.ListID)
+	if err := requireAffected(res, err); err != nil || !moved {
+		return err
+	}
+	return moveTodoToEnd(db, id)
 }
 
-func toggleTodoStatus(db *sql.DB, id int) error {
+func toggleTodoStatus(db dbtx, id int) error {
 	// Retrieve the current status of the task
 	var currentStatus bool
-	err := db.QueryRow("SELECT iscompleted FROM todo WHERE id=$1", id).Scan(&currentStatus)
+	err := db.QueryRow("SELECT iscompleted FROM todo WHERE id=$1 AND deleted_at IS NULL", id).Scan(&currentStatus)
 	if err != nil {
 		return err
 	}
@@ -129,13 +274,14 @@ func toggleTodoStatus(db *sql.DB, id int) error {
 	// Toggle the status
 	newStatus := !currentStatus
 
-	// Update the status in the database
-	_, err = db.Exec("UPDATE todo SET iscompleted=$1 WHERE id=$2", newStatus, id)
+	// Update the status in the database, remembering when it was completed
+	_, err = db.Exec("UPDATE todo SET iscompleted=$1, completed_at=CASE WHEN $1 THEN now() END, updated_at=now() WHERE id=$2", newStatus, id)
 	return err
 }
 
-func deleteTodo(db *sql.DB, id int) error {
-	_, err := db.Exec("DELETE FROM todo WHERE id=$1", id)
+// deleteTodo moves the todo to the trash, from where it can be restored until it is purged.
+func deleteTodo(db dbtx, id int) error {
+	_, err := db.Exec("UPDATE todo SET deleted_at=now() WHERE id=$1 AND deleted_at IS NULL", id)
 	return err
 }
 
@@ -152,125 +298,1730 @@ func setupAppAndDB() (*fiber.App, *sql.DB, error) {
 		return nil, nil, err
 	}
 
+	err = migrate(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = backfillRanks(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = backfillVersions(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if eventSourced() {
+		err = seedEventLog(db)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Password reset links go out through the same channel as the digest, unless that is the log
+	notifier, err := newNotifier()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	app := fiber.New()
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "http://localhost:5173",
-		AllowHeaders: "Origin, Content-Type, Accept",
+		AllowOrigins:  "http://localhost:5173",
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, X-Timezone, Idempotency-Key",
+		ExposeHeaders: "X-Duplicate-Of, Idempotent-Replayed",
 	}))
 
-	app.Get("/api/todos/:id", func(c *fiber.Ctx) error {
-		id, err := c.ParamsInt("id")
+	app.Post("/api/auth/register", func(c *fiber.Ctx) error {
+		var cr Credentials
+		if err := c.BodyParser(&cr); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := cr.validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		user, err := registerUser(db, cr)
+		if err == errUsernameTaken || err == errEmailTaken {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
 		if err != nil {
-			return c.Status(400).SendString("Invalid ID")
+			return c.Status(500).SendString("Failed to register")
 		}
 
+		return c.Status(fiber.StatusCreated).JSON(user)
+	})
 
-		// todo := Todo{}
-		todo, err := getTodo(db, id) // Fixed by staticcheck - alternative for PMD
+	app.Post("/api/auth/login", func(c *fiber.Ctx) error {
+		var cr Credentials
+		if err := c.BodyParser(&cr); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		session, challenge, err := login(db, cr, clientFromRequest(c))
+		var locked tooManyAttemptsError
+		if errors.As(err, &locked) {
+			c.Set(fiber.HeaderRetryAfter, locked.retryAfter(time.Now()))
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		if err == errInvalidCredentials {
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
 		if err != nil {
-			return c.Status(400).SendString("no todo with that id")
+			return c.Status(500).SendString("Failed to log in")
+		}
+		if challenge != nil {
+			return c.JSON(challenge)
 		}
 
-		return c.Status(200).JSON(todo)
+		return c.JSON(session)
 	})
 
-	app.Get("/api/todos", func(c *fiber.Ctx) error {
-		todos, err := getAllTodos(db)
+	app.Post("/api/auth/login/2fa", func(c *fiber.Ctx) error {
+		var req TwoFactorCode
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if req.MFAToken == "" || req.Code == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("mfa_token and code are required")
+		}
+
+		session, err := finishTwoFactorLogin(db, req, clientFromRequest(c), time.Now())
 		if err != nil {
-			log.Fatal(err)
-			return c.Status(500).SendString("Failed to retrieve todos")
+			return sendSecondFactorError(c, err)
 		}
 
-		return c.JSON(todos)
+		return c.JSON(session)
 	})
 
-	app.Post("/api/todos", func(c *fiber.Ctx) error {
-		todo := new(Todo)
+	app.Post("/api/auth/password-reset", func(c *fiber.Ctx) error {
+		var req PasswordReset
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if req.Login == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("login is required")
+		}
+		if !deliversPrivately(notifier) {
+			return c.Status(fiber.StatusServiceUnavailable).SendString(errResetUnavailable.Error())
+		}
 
-		if err := c.BodyParser(todo); err != nil {
+		// Sent in the background, so the response time does not give away whether the account exists
+		account, client := strings.Clone(req.Login), clientFromRequest(c)
+		go func() {
+			if err := requestPasswordReset(db, notifier, account, client); err != nil {
+				log.Printf("failed to send password reset: %v", err)
+			}
+		}()
+
+		return c.SendStatus(fiber.StatusAccepted)
+	})
+
+	app.Post("/api/auth/password-reset/confirm", func(c *fiber.Ctx) error {
+		var req PasswordReset
+		if err := c.BodyParser(&req); err != nil {
 			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
 		}
+		if err := validatePassword(req.Password); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
 
-		// Validate the todo before inserting it into the database
-		if err := validateTodoInput(todo); err != nil {
+		err := resetPassword(db, req, clientFromRequest(c))
+		if err == errResetTokenInvalid {
 			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to reset password")
+		}
 
+		return c.SendStatus(fiber.StatusNoContent)
+	})
 
-		// Insert the todo into the database
-		lastInsertId, err := createTodo(db, todo)
-		if err != nil {
-			return c.Status(500).SendString("Failed to create todo")
+	oidcProviders := loadOIDCProviders()
+
+	app.Get("/api/auth/oidc", func(c *fiber.Ctx) error {
+		providers := []*OIDCProvider{}
+		for _, p := range oidcProviders {
+			providers = append(providers, p)
 		}
+		sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
 
-		// Return the newly created todo
-		todo.ID = lastInsertId
-		return c.Status(201).JSON(todo)
+		return c.JSON(providers)
 	})
 
-	app.Patch("/api/todos/:id", func(c *fiber.Ctx) error {
-		id, err := c.ParamsInt("id")
+	app.Get("/api/auth/oidc/:provider/login", func(c *fiber.Ctx) error {
+		p, ok := oidcProviders[c.Params("provider")]
+		if !ok {
+			return c.Status(fiber.StatusNotFound).SendString("Unknown identity provider")
+		}
+
+		target, err := startOIDCLogin(db, p)
 		if err != nil {
-			return c.Status(400).SendString("Invalid ID")
+			log.Printf("starting login with %s: %v", p.Name, err)
+			return c.Status(fiber.StatusBadGateway).SendString("Failed to reach the identity provider")
 		}
 
+		return c.Redirect(target, fiber.StatusFound)
+	})
 
-		todo := new(Todo)
-		if err := c.BodyParser(todo); err != nil {
-			return c.Status(400).SendString("Invalid request body")
+	app.Get("/api/auth/oidc/:provider/callback", func(c *fiber.Ctx) error {
+		p, ok := oidcProviders[c.Params("provider")]
+		if !ok {
+			return c.Status(fiber.StatusNotFound).SendString("Unknown identity provider")
+		}
+		if e := c.Query("error"); e != "" {
+			return c.Status(fiber.StatusUnauthorized).SendString(oidcError(strings.TrimSpace(e + " " + c.Query("error_description"))).Error())
+		}
+		if c.Query("state") == "" || c.Query("code") == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("state and code are required")
 		}
 
-			// Validate the todo before inserting it into the database
-			if err := validateTodoInput(todo); err != nil {
-				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
-			}
+		session, challenge, err := finishOIDCLogin(db, p, c.Query("state"), c.Query("code"), time.Now())
+		var oidcErr oidcError
+		var locked tooManyAttemptsError
+		switch {
+		case errors.As(err, &locked):
+			c.Set(fiber.HeaderRetryAfter, locked.retryAfter(time.Now()))
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		case err == errOIDCLoginExpired:
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		case errors.As(err, &oidcErr):
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		case err == errProvisioningDisabled:
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		case err == errUsernameTaken:
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case err != nil:
+			log.Printf("finishing login with %s: %v", p.Name, err)
+			return c.Status(500).SendString("Failed to log in")
+		}
+		// The login is audited once the second factor is checked
+		if challenge != nil {
+			return c.JSON(challenge)
+		}
+		auditRequest(db, c, session.User.ID, eventLogin, "single sign-on with "+p.Name)
+
+		return c.JSON(session)
+	})
 
-		err = updateTodo(db, id, todo)
+	// Share links are public: the token is all it takes to see what they show. Browsers get
+	// a simple page, everyone else JSON.
+	app.Get("/api/shared/:token", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+		c.Set(fiber.HeaderXRobotsTag, "noindex")
+
+		view, err := getSharedView(db, c.Params("token"))
+		if err == errShareLinkInvalid {
+			return c.Status(fiber.StatusNotFound).SendString(err.Error())
+		}
 		if err != nil {
-			return c.Status(500).SendString("Failed to update task")
+			return c.Status(500).SendString("Failed to retrieve shared todos")
 		}
 
-		return c.Status(200).JSON(todo)
+		if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) == fiber.MIMETextHTML {
+			page, err := view.HTML()
+			if err != nil {
+				return c.Status(500).SendString("Failed to retrieve shared todos")
+			}
+			c.Type("html", "utf-8")
+			return c.SendString(page)
+		}
+		return c.JSON(view)
 	})
 
-	app.Patch("/api/todos/:id/done", func(c *fiber.Ctx) error {
-		id, err := c.ParamsInt("id")
+	// Everything under /api registered from here on needs a bearer token
+	app.Use("/api", requireAuth(db))
+
+	app.Post("/api/auth/logout", func(c *fiber.Ctx) error {
+		if err := logout(db, bearerToken(c)); err != nil {
+			return c.Status(500).SendString("Failed to log out")
+		}
+		auditRequest(db, c, userFromRequest(c), eventLogout, "")
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/auth/me", func(c *fiber.Ctx) error {
+		return c.JSON(c.Locals("user"))
+	})
+
+	app.Put("/api/auth/password", sessionOnly, func(c *fiber.Ctx) error {
+		var pc PasswordChange
+		if err := c.BodyParser(&pc); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validatePassword(pc.NewPassword); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		err := changePassword(db, userFromRequest(c), pc, bearerToken(c), clientFromRequest(c))
+		if err == errWrongPassword {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
 		if err != nil {
-			return c.Status(400).SendString("Invalid ID")
+			return c.Status(500).SendString("Failed to change password")
+		}
+		auditRequest(db, c, userFromRequest(c), eventPasswordChanged, "")
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Put("/api/auth/email", sessionOnly, func(c *fiber.Ctx) error {
+		var ec EmailChange
+		if err := c.BodyParser(&ec); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateEmail(ec.Email); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
 
-		err = toggleTodoStatus(db, id)
+		previous, err := setEmail(db, userFromRequest(c), ec)
+		if err == errWrongPassword {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if err == errEmailTaken {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
 		if err != nil {
-			return c.Status(500).SendString("Failed to update task status")
+			return c.Status(500).SendString("Failed to change email")
+		}
+		auditRequest(db, c, userFromRequest(c), eventEmailChanged, "")
+
+		if previous != "" && !strings.EqualFold(previous, ec.Email) {
+			username := strings.Clone(actorFromRequest(c))
+			go func() {
+				if err := notifyEmailChanged(notifier, username, previous); err != nil {
+					log.Printf("failed to notify %s of an email change: %v", username, err)
+				}
+			}()
 		}
 
 		return c.SendStatus(fiber.StatusNoContent)
 	})
 
-	app.Delete("/api/todos/:id", func(c *fiber.Ctx) error {
-		id, err := c.ParamsInt("id")
+	app.Get("/api/auth/security-events", func(c *fiber.Ctx) error {
+		before := c.QueryInt("before", 0)
+		limit := c.QueryInt("limit", 50)
+		if before < 0 || limit < 1 || limit > 500 {
+			return c.Status(fiber.StatusBadRequest).SendString("before must not be negative and limit must be between 1 and 500")
+		}
 
+		events, err := getSecurityEvents(db, userFromRequest(c), c.Query("event"), int64(before), limit)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+			return c.Status(500).SendString("Failed to retrieve security events")
+		}
+
+		return c.JSON(events)
+	})
+
+	app.Get("/api/auth/2fa", func(c *fiber.Ctx) error {
+		status, err := getTwoFactorStatus(db, userFromRequest(c))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve two-factor status")
 		}
 
-		err = deleteTodo(db, id)
+		return c.JSON(status)
+	})
+
+	app.Post("/api/auth/2fa/enroll", sessionOnly, func(c *fiber.Ctx) error {
+		user, _ := c.Locals("user").(User)
+		enrollment, err := enrollTOTP(db, user)
 		if err != nil {
-			return c.Status(500).SendString("Failed to delete todo")
+			return sendSecondFactorError(c, err)
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(enrollment)
+	})
+
+	app.Post("/api/auth/2fa/confirm", sessionOnly, func(c *fiber.Ctx) error {
+		var req TwoFactorCode
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		codes, err := confirmTOTP(db, userFromRequest(c), req.Code, time.Now())
+		if err != nil {
+			return sendSecondFactorError(c, err)
+		}
+		auditRequest(db, c, userFromRequest(c), eventTwoFactorEnabled, "")
+
+		return c.JSON(fiber.Map{"recovery_codes": codes})
+	})
+
+	app.Delete("/api/auth/2fa", sessionOnly, func(c *fiber.Ctx) error {
+		var req TwoFactorCode
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		if err := disableTOTP(db, userFromRequest(c), req.Code, time.Now()); err != nil {
+			return sendSecondFactorError(c, err)
 		}
+		auditRequest(db, c, userFromRequest(c), eventTwoFactorDisabled, "")
 
 		return c.SendStatus(fiber.StatusNoContent)
 	})
 
-	return app, db, nil
-}
+	app.Delete("/api/admin/users/:userId/2fa", sessionOnly, requireAdmin(db), func(c *fiber.Ctx) error {
+		userID, err := c.ParamsInt("userId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+		}
 
-func main() {
-	app, db, err := setupAppAndDB()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+		err = resetTwoFactor(db, userID)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no user with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to reset two-factor authentication")
+		}
+		auditRequest(db, c, userID, eventTwoFactorReset, "by admin "+actorFromRequest(c))
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/tokens", sessionOnly, func(c *fiber.Ctx) error {
+		tokens, err := getAPITokens(db, userFromRequest(c))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve tokens")
+		}
+
+		return c.JSON(tokens)
+	})
+
+	app.Post("/api/tokens", sessionOnly, func(c *fiber.Ctx) error {
+		token := new(APIToken)
+		if err := c.BodyParser(token); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := token.validate(time.Now()); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		if err := createAPIToken(db, userFromRequest(c), token); err != nil {
+			return c.Status(500).SendString("Failed to create token")
+		}
+		auditRequest(db, c, userFromRequest(c), eventTokenCreated, fmt.Sprintf("%s (%s)", token.Name, token.Scope))
+
+		return c.Status(fiber.StatusCreated).JSON(token)
+	})
+
+	app.Delete("/api/tokens/:tokenId", sessionOnly, func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("tokenId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid token ID")
+		}
+
+		err = revokeAPIToken(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no token with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to revoke token")
+		}
+		auditRequest(db, c, userFromRequest(c), eventTokenRevoked, fmt.Sprintf("token %d", id))
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Registered before /api/todos/:id so the names are not taken for an id
+	app.Get("/api/todos/overdue", func(c *fiber.Ctx) error {
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		todos, err := getOverdueTodos(db, userFromRequest(c), time.Now(), loc)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve todos")
+		}
+
+		return c.JSON(todos)
+	})
+
+	app.Get("/api/todos/upcoming", func(c *fiber.Ctx) error {
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		days := c.QueryInt("days", 7)
+		if days < 0 || days > 366 {
+			return c.Status(fiber.StatusBadRequest).SendString("days must be between 0 and 366")
+		}
+
+		todos, err := getUpcomingTodos(db, userFromRequest(c), time.Now(), loc, days)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve todos")
+		}
+
+		return c.JSON(todos)
+	})
+
+	app.Get("/api/todos/:id", todoAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString("Invalid ID")
+		}
+
+
+		asOf, err := parseAsOf(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		// todo := Todo{}
+		todo, err := getTodo(db, id) // Fixed by staticcheck - alternative for PMD
+		if asOf != nil {
+			todo, err = getTodoAsOf(db, id, *asOf)
+		}
+		if err != nil {
+			return c.Status(400).SendString("no todo with that id")
+		}
+		if asOf == nil {
+			if todo.Assignees, err = getAssignees(db, id); err != nil {
+				return c.Status(500).SendString("Failed to retrieve todo")
+			}
+		}
+
+		return c.Status(200).JSON(todo)
+	})
+
+	app.Get("/api/todos", func(c *fiber.Ctx) error {
+		q, err := parseTodoQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		var todos []Todo
+		if q.asOf != nil {
+			todos, err = getTodosAsOf(db, q.owner, *q.asOf)
+		} else if todos, err = getAllTodos(db, q); err == nil {
+			err = loadAssignees(db, todos)
+		}
+		if err != nil {
+			log.Printf("listing todos: %v", err)
+			return c.Status(500).SendString("Failed to retrieve todos")
+		}
+
+		return c.JSON(todos)
+	})
+
+	// createTodoHandler also serves POST /api/lists/:listId/todos, which passes the list in Locals
+	createTodoHandler := func(c *fiber.Ctx) error {
+		todo := new(Todo)
+
+		if err := c.BodyParser(todo); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if listID, ok := c.Locals("listID").(int); ok {
+			todo.ListID = listID
+		}
+		todo.OwnerID = userFromRequest(c)
+
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		if err := normalizeDeadline(todo, loc); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		// Validate the todo before inserting it into the database
+		if err := validateTodoInput(todo); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		if err := checkListWritable(db, todo.OwnerID, todo.ListID); err != nil {
+			return sendListWriteError(c, err, "Failed to create todo")
+		}
+
+		mode, err := duplicateMode(c.Query("duplicates"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if mode != "allow" {
+			duplicate, err := findDuplicate(db, todo.OwnerID, todo.Title, todo.ListID)
+			if err != nil {
+				return c.Status(500).SendString("Failed to create todo")
+			}
+			if duplicate != nil && mode == "reject" {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error":     "a similar todo already exists",
+					"duplicate": duplicate,
+				})
+			}
+			if duplicate != nil {
+				c.Set("X-Duplicate-Of", strconv.Itoa(duplicate.ID))
+			}
+		}
+
+		// Insert the todo into the database
+		lastInsertId, err := changeTodo(db, actorFromRequest(c), userFromRequest(c), "create", 0, func(tx dbtx) (int, error) {
+			return createTodo(tx, todo)
+		})
+		if isForeignKeyViolation(err) {
+			return c.Status(fiber.StatusBadRequest).SendString("no list with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to create todo")
+		}
+
+		// Return the newly created todo
+		todo.ID = lastInsertId
+		return c.Status(201).JSON(todo)
+	}
+	app.Post("/api/todos", idempotent(db), createTodoHandler)
+
+	app.Post("/api/todos/quick", idempotent(db), func(c *fiber.Ctx) error {
+		var input struct {
+			Text string `json:"text"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		// The line itself becomes the body, so the description length rule does not apply here
+		todo, err := parseQuickAdd(input.Text, time.Now(), loc)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		todo.OwnerID = userFromRequest(c)
+
+		lastInsertId, err := changeTodo(db, actorFromRequest(c), userFromRequest(c), "create", 0, func(tx dbtx) (int, error) {
+			return createTodo(tx, &todo)
+		})
+		if err != nil {
+			return c.Status(500).SendString("Failed to create todo")
+		}
+
+		todo.ID = lastInsertId
+		return c.Status(201).JSON(todo)
+	})
+
+	app.Post("/api/todos/batch", idempotent(db), func(c *fiber.Ctx) error {
+		var items []json.RawMessage
+		if err := json.Unmarshal(c.Body(), &items); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if len(items) == 0 || len(items) > bulkLimit {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("a batch must hold between 1 and %d todos", bulkLimit))
+		}
+
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		todos, indexes, errs := parseBatch(items, loc)
+		for _, todo := range todos {
+			todo.OwnerID = userFromRequest(c)
+		}
+		todos, indexes, errs, err = checkBatchLists(db, userFromRequest(c), todos, indexes, errs)
+		if err != nil {
+			return c.Status(500).SendString("Failed to create todos")
+		}
+		created, err := createTodos(db, actorFromRequest(c), todos)
+		if err != nil {
+			return c.Status(500).SendString("Failed to create todos")
+		}
+
+		resp := BatchResponse{Created: []BatchCreated{}, Errors: errs}
+		for i, todo := range created {
+			resp.Created = append(resp.Created, BatchCreated{Index: indexes[i], ID: todo.ID})
+		}
+
+		// 201 when everything was created, 207 when only some of it was, 400 when none was
+		status := fiber.StatusMultiStatus
+		switch {
+		case len(errs) == 0:
+			status = fiber.StatusCreated
+		case len(created) == 0:
+			status = fiber.StatusBadRequest
+		}
+		return c.Status(status).JSON(resp)
+	})
+
+	app.Post("/api/todos/bulk", idempotent(db), func(c *fiber.Ctx) error {
+		var req BulkRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).SendString("Invalid request body")
+		}
+		if err := req.validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		resp, err := runBulk(db, actorFromRequest(c), userFromRequest(c), loc, req)
+		if err != nil {
+			return c.Status(500).SendString("Failed to apply bulk operations")
+		}
+		if !resp.Applied {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(resp)
+		}
+
+		return c.JSON(resp)
+	})
+
+	app.Patch("/api/todos/:id", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString("Invalid ID")
+		}
+
+
+		todo := new(Todo)
+		if err := c.BodyParser(todo); err != nil {
+			return c.Status(400).SendString("Invalid request body")
+		}
+
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		if err := normalizeDeadline(todo, loc); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+			// Validate the todo before inserting it into the database
+			if err := validateTodoInput(todo); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+
+		if err := checkListWritable(db, userFromRequest(c), todo.ListID); err != nil {
+			return sendListWriteError(c, err, "Failed to update task")
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "update", id, func(tx dbtx) (int, error) {
+			return id, updateTodo(tx, id, todo)
+		})
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		}
+		if isForeignKeyViolation(err) {
+			return c.Status(fiber.StatusBadRequest).SendString("no list with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to update task")
+		}
+
+		// Respond with the stored row so the server-managed timestamps are included
+		updated, err := getTodo(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to update task")
+		}
+
+		return c.Status(200).JSON(updated)
+	})
+
+	app.Patch("/api/todos/:id/done", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString("Invalid ID")
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "toggle", id, func(tx dbtx) (int, error) {
+			return id, toggleTodoStatus(tx, id)
+		})
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to update task status")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Delete("/api/todos/:id", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "delete", id, func(tx dbtx) (int, error) {
+			return id, deleteTodo(tx, id)
+		})
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to delete todo")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/todos/:id/history", historyAccess(db), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		// History outlives the todo itself, so a purged todo still has one
+		entries, err := getTodoHistory(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve history")
+		}
+		if len(entries) == 0 {
+			return c.Status(fiber.StatusNotFound).SendString("no history for that id")
+		}
+
+		return c.JSON(entries)
+	})
+
+	app.Post("/api/todos/:id/clone", todoAccess(db, roleEditor), idempotent(db), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		original, err := getTodo(db, id)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		}
+
+		clone := cloneTodo(original)
+		clone.OwnerID = userFromRequest(c)
+		if err := checkListWritable(db, clone.OwnerID, clone.ListID); err != nil {
+			return sendListWriteError(c, err, "Failed to clone todo")
+		}
+		clone.ID, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "create", 0, func(tx dbtx) (int, error) {
+			return createTodo(tx, clone)
+		})
+		if err != nil {
+			return c.Status(500).SendString("Failed to clone todo")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(clone)
+	})
+
+	app.Post("/api/todos/:id/move", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		// list_id moves the todo to another list, at the end unless before or after says otherwise
+		var input struct {
+			Before *int `json:"before"`
+			After  *int `json:"after"`
+			ListID *int `json:"list_id"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if input.ListID != nil {
+			if err := checkListWritable(db, userFromRequest(c), *input.ListID); err != nil {
+				return sendListWriteError(c, err, "Failed to move todo")
+			}
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "move", id, func(tx dbtx) (int, error) {
+			if input.ListID == nil {
+				return id, moveTodo(tx, actorFromRequest(c), userFromRequest(c), id, input.Before, input.After)
+			}
+			// setTodoList puts the todo at the end of the new list
+			if err := setTodoList(tx, id, *input.ListID); err != nil || (input.Before == nil && input.After == nil) {
+				return id, err
+			}
+			return id, moveTodo(tx, actorFromRequest(c), userFromRequest(c), id, input.Before, input.After)
+		})
+		var neighbour moveNeighbourError
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		case isForeignKeyViolation(err):
+			return c.Status(fiber.StatusBadRequest).SendString("no list with that id")
+		case err == errMoveNoNeighbours || err == errMoveSelf || errors.As(err, &neighbour):
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		case err == errRankOrder:
+			return c.Status(fiber.StatusBadRequest).SendString("the after todo must come before the before todo")
+		case err != nil:
+			return c.Status(500).SendString("Failed to move todo")
+		}
+
+		moved, err := getTodo(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to move todo")
+		}
+
+		return c.JSON(moved)
+	})
+
+	app.Post("/api/todos/:id/transition", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		var input struct {
+			State string `json:"state"`
+		}
+		if err := c.BodyParser(&input); err != nil || input.State == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "transition", id, func(tx dbtx) (int, error) {
+			return id, transitionTodo(tx, id, input.State)
+		})
+		var transition transitionError
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		case err == errUnknownState:
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		case errors.As(err, &transition):
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case err != nil:
+			return c.Status(500).SendString("Failed to transition todo")
+		}
+
+		moved, err := getTodo(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to transition todo")
+		}
+
+		return c.JSON(moved)
+	})
+
+	app.Post("/api/todos/:id/restore", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "restore", id, func(tx dbtx) (int, error) {
+			return id, restoreTodo(tx, id)
+		})
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id in the trash")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to restore todo")
+		}
+
+		todo, err := getTodo(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to restore todo")
+		}
+
+		return c.JSON(todo)
+	})
+
+	app.Post("/api/todos/:id/shares", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		link := new(ShareLink)
+		if err := c.BodyParser(link); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := link.validate(time.Now()); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		link.ListID, link.TodoID = nil, &id
+
+		if err := createShareLink(db, userFromRequest(c), link); err != nil {
+			return c.Status(500).SendString("Failed to create share link")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(link)
+	})
+
+	app.Get("/api/todos/:id/assignees", todoAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		assignees, err := getAssignees(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve assignees")
+		}
+
+		return c.JSON(assignees)
+	})
+
+	// Assigns the todo to a member of its list, who is notified unless it was already theirs
+	app.Post("/api/todos/:id/assignees", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		var input struct {
+			Username string `json:"username"`
+		}
+		if err := c.BodyParser(&input); err != nil || input.Username == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		userID, added, err := assignTodo(db, id, userFromRequest(c), input.Username)
+		switch {
+		case err == errNoSuchUser:
+			return c.Status(fiber.StatusNotFound).SendString(err.Error())
+		case err == errNotListMember:
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case err != nil:
+			return c.Status(500).SendString("Failed to assign todo")
+		}
+
+		status := fiber.StatusOK
+		if added {
+			status = fiber.StatusCreated
+			assigner := strings.Clone(actorFromRequest(c))
+			go func() {
+				if err := notifyAssigned(db, notifier, id, userID, assigner); err != nil {
+					log.Printf("failed to notify assignee of todo %d: %v", id, err)
+				}
+			}()
+		}
+
+		assignees, err := getAssignees(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to assign todo")
+		}
+
+		return c.Status(status).JSON(assignees)
+	})
+
+	app.Delete("/api/todos/:id/assignees/:userId", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+		userID, err := c.ParamsInt("userId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+		}
+
+		err = unassignTodo(db, id, userID)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("the todo is not assigned to that user")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to unassign todo")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/shares", func(c *fiber.Ctx) error {
+		links, err := getShareLinks(db, userFromRequest(c))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve share links")
+		}
+
+		return c.JSON(links)
+	})
+
+	app.Delete("/api/shares/:shareId", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("shareId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid share link ID")
+		}
+
+		err = revokeShareLink(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no share link with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to revoke share link")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/trash", func(c *fiber.Ctx) error {
+		todos, err := getTrashedTodos(db, userFromRequest(c))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve trash")
+		}
+
+		return c.JSON(todos)
+	})
+
+	app.Delete("/api/trash/:id", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		_, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "purge", id, func(tx dbtx) (int, error) {
+			return id, purgeTodo(tx, id)
+		})
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id in the trash")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to purge todo")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Empties the whole trash
+	app.Delete("/api/trash", func(c *fiber.Ctx) error {
+		_, err := purgeTrash(db, userFromRequest(c), time.Now())
+		if err != nil {
+			return c.Status(500).SendString("Failed to empty trash")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Post("/api/undo", func(c *fiber.Ctx) error {
+		result, err := undo(db, actorFromRequest(c), userFromRequest(c))
+		return respondUndo(c, result, err)
+	})
+
+	app.Post("/api/redo", func(c *fiber.Ctx) error {
+		result, err := redo(db, actorFromRequest(c), userFromRequest(c))
+		return respondUndo(c, result, err)
+	})
+
+	app.Get("/api/lists", func(c *fiber.Ctx) error {
+		lists, err := getLists(db, userFromRequest(c), c.QueryBool("archived"))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve lists")
+		}
+
+		return c.JSON(lists)
+	})
+
+	app.Post("/api/lists", func(c *fiber.Ctx) error {
+		list := new(TodoList)
+		if err := c.BodyParser(list); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateList(list); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		if err := createList(db, userFromRequest(c), list); err != nil {
+			return c.Status(500).SendString("Failed to create list")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(list)
+	})
+
+	app.Get("/api/lists/:listId", listAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		list, err := getList(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no list with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve list")
+		}
+
+		return c.JSON(list)
+	})
+
+	app.Patch("/api/lists/:listId", listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		list := new(TodoList)
+		if err := c.BodyParser(list); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateList(list); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		err = renameList(db, id, list.Name)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no list with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to update list")
+		}
+
+		updated, err := getList(db, userFromRequest(c), id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to update list")
+		}
+
+		return c.JSON(updated)
+	})
+
+	app.Delete("/api/lists/:listId", listAccess(db, roleOwner), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		err = deleteList(db, id)
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(fiber.StatusNotFound).SendString("no list with that id")
+		case err == errDefaultList || err == errListNotEmpty:
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case err != nil:
+			return c.Status(500).SendString("Failed to delete list")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	for path, archived := range map[string]bool{"archive": true, "unarchive": false} {
+		archived := archived
+		app.Post("/api/lists/:listId/"+path, listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+			id, err := c.ParamsInt("listId")
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+			}
+
+			err = archiveList(db, id, archived)
+			switch {
+			case err == sql.ErrNoRows:
+				return c.Status(fiber.StatusNotFound).SendString("no list with that id")
+			case err == errDefaultList:
+				return c.Status(fiber.StatusConflict).SendString(err.Error())
+			case err != nil:
+				return c.Status(500).SendString("Failed to archive list")
+			}
+
+			list, err := getList(db, userFromRequest(c), id)
+			if err != nil {
+				return c.Status(500).SendString("Failed to archive list")
+			}
+
+			return c.JSON(list)
+		})
+	}
+
+	app.Get("/api/lists/:listId/todos", listAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		q, err := parseTodoQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if q.asOf != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("as_of is only supported on /api/todos")
+		}
+		q.listID = id
+
+		todos, err := getAllTodos(db, q)
+		if err == nil {
+			err = loadAssignees(db, todos)
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve todos")
+		}
+
+		return c.JSON(todos)
+	})
+
+	app.Post("/api/lists/:listId/todos", listAccess(db, roleEditor), idempotent(db), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		c.Locals("listID", id)
+		return createTodoHandler(c)
+	})
+
+	app.Post("/api/lists/:listId/shares", listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		link := new(ShareLink)
+		if err := c.BodyParser(link); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := link.validate(time.Now()); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		link.ListID, link.TodoID = &id, nil
+
+		err = createShareLink(db, userFromRequest(c), link)
+		if err == errListNotShareable {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to create share link")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(link)
+	})
+
+	app.Get("/api/lists/:listId/members", listAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		members, err := getListMembers(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve members")
+		}
+
+		return c.JSON(members)
+	})
+
+	app.Post("/api/lists/:listId/members", listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		var inv MemberInvite
+		if err := c.BodyParser(&inv); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateMemberRole(inv.Role); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		role, _ := c.Locals("listRole").(string)
+		member, err := inviteMember(db, id, userFromRequest(c), role, inv)
+		switch {
+		case err == errOwnerOnly:
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		case err == errNoSuchUser:
+			return c.Status(fiber.StatusNotFound).SendString(err.Error())
+		case err == errListNotShareable || err == errAlreadyMember:
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case err == sql.ErrNoRows:
+			return c.Status(fiber.StatusNotFound).SendString("no list with that id")
+		case err != nil:
+			return c.Status(500).SendString("Failed to invite member")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(member)
+	})
+
+	app.Patch("/api/lists/:listId/members/:userId", listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+		userID, err := c.ParamsInt("userId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+		}
+
+		var input MemberInvite
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateMemberRole(input.Role); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		role, _ := c.Locals("listRole").(string)
+		err = setMemberRole(db, id, role, userID, input.Role)
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(fiber.StatusNotFound).SendString("no member with that id")
+		case err == errOwnerOnly:
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		case err != nil:
+			return c.Status(500).SendString("Failed to change role")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Members can remove themselves, which is how a list is left
+	app.Delete("/api/lists/:listId/members/:userId", listAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+		userID, err := c.ParamsInt("userId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid user ID")
+		}
+
+		role, _ := c.Locals("listRole").(string)
+		err = removeMember(db, id, userFromRequest(c), role, userID)
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(fiber.StatusNotFound).SendString("no member with that id")
+		case err == errOwnerOnly || err == errNotListAdmin:
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		case err != nil:
+			return c.Status(500).SendString("Failed to remove member")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/invitations", func(c *fiber.Ctx) error {
+		invitations, err := getInvitations(db, userFromRequest(c))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve invitations")
+		}
+
+		return c.JSON(invitations)
+	})
+
+	for path, accept := range map[string]bool{"accept": true, "decline": false} {
+		accept := accept
+		app.Post("/api/invitations/:listId/"+path, func(c *fiber.Ctx) error {
+			id, err := c.ParamsInt("listId")
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+			}
+
+			err = answerInvitation(db, userFromRequest(c), id, accept)
+			if err == errNoInvitation {
+				return c.Status(fiber.StatusNotFound).SendString(err.Error())
+			}
+			if err != nil {
+				return c.Status(500).SendString("Failed to answer invitation")
+			}
+			if !accept {
+				return c.SendStatus(fiber.StatusNoContent)
+			}
+
+			list, err := getList(db, userFromRequest(c), id)
+			if err != nil {
+				return c.Status(500).SendString("Failed to answer invitation")
+			}
+
+			return c.JSON(list)
+		})
+	}
+
+	app.Get("/api/lists/:listId/workflow", listAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		w, err := getWorkflow(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve workflow")
+		}
+
+		return c.JSON(w)
+	})
+
+	app.Put("/api/lists/:listId/workflow", listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		var w Workflow
+		if err := c.BodyParser(&w); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := w.validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		if err := setWorkflow(db, id, w); err != nil {
+			return c.Status(500).SendString("Failed to update workflow")
+		}
+
+		updated, err := getWorkflow(db, id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to update workflow")
+		}
+
+		return c.JSON(updated)
+	})
+
+	// Deleting a list's workflow puts it back on the default one
+	app.Delete("/api/lists/:listId/workflow", listAccess(db, roleAdmin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		if err := setWorkflow(db, id, Workflow{}); err != nil {
+			return c.Status(500).SendString("Failed to reset workflow")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/lists/:listId/board", listAccess(db, roleViewer), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		columns, err := getBoard(db, userFromRequest(c), id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve board")
+		}
+
+		return c.JSON(columns)
+	})
+
+	app.Get("/api/templates", func(c *fiber.Ctx) error {
+		templates, err := getTemplates(db, userFromRequest(c))
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve templates")
+		}
+
+		return c.JSON(templates)
+	})
+
+	app.Get("/api/templates/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid template ID")
+		}
+
+		template, err := getTemplate(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no template with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve template")
+		}
+
+		return c.JSON(template)
+	})
+
+	app.Post("/api/templates", func(c *fiber.Ctx) error {
+		template := new(Template)
+		if err := c.BodyParser(template); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateTemplate(template); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		if err := createTemplate(db, userFromRequest(c), template); err != nil {
+			return c.Status(500).SendString("Failed to create template")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(template)
+	})
+
+	app.Patch("/api/templates/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid template ID")
+		}
+
+		template := new(Template)
+		if err := c.BodyParser(template); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+		if err := validateTemplate(template); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+
+		err = updateTemplate(db, userFromRequest(c), id, template)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no template with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to update template")
+		}
+
+		updated, err := getTemplate(db, userFromRequest(c), id)
+		if err != nil {
+			return c.Status(500).SendString("Failed to update template")
+		}
+
+		return c.JSON(updated)
+	})
+
+	app.Delete("/api/templates/:id", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid template ID")
+		}
+
+		err = deleteTemplate(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no template with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to delete template")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Post("/api/templates/:id/instantiate", idempotent(db), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid template ID")
+		}
+
+		var req InstantiateRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+			}
+		}
+
+		loc, err := requestLocation(c, defaultTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		template, err := getTemplate(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).SendString("no template with that id")
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve template")
+		}
+
+		todo, err := instantiateTemplate(template, placeholderValues(time.Now(), loc, req.Vars))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		todo.rawDeadline = req.Deadline
+		todo.OwnerID = userFromRequest(c)
+		todo.ListID = req.ListID
+		if err := normalizeDeadline(todo, loc); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err := validateTodoInput(todo); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err := checkListWritable(db, todo.OwnerID, todo.ListID); err != nil {
+			return sendListWriteError(c, err, "Failed to create todo")
+		}
+
+		todo.ID, err = changeTodo(db, actorFromRequest(c), userFromRequest(c), "create", 0, func(tx dbtx) (int, error) {
+			return createTodo(tx, todo)
+		})
+		if err != nil {
+			return c.Status(500).SendString("Failed to create todo")
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(todo)
+	})
+
+	app.Get("/api/events", func(c *fiber.Ctx) error {
+		after := c.QueryInt("after", 0)
+		limit := c.QueryInt("limit", 100)
+		if after < 0 || limit < 1 || limit > 1000 {
+			return c.Status(fiber.StatusBadRequest).SendString("after must not be negative and limit must be between 1 and 1000")
+		}
+
+		events, err := getEvents(db, userFromRequest(c), int64(after), limit)
+		if err != nil {
+			return c.Status(500).SendString("Failed to retrieve events")
+		}
+
+		return c.JSON(events)
+	})
+
+	app.Put("/api/digest/timezone", func(c *fiber.Ctx) error {
+		var req DigestSettings
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		err := setDigestTimezone(db, userFromRequest(c), req.Timezone)
+		if err == errInvalidTimezone {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString("Failed to set time zone")
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/api/digest/preview", func(c *fiber.Ctx) error {
+		loc, err := requestLocation(c, digestTimezone())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+
+		digest, err := buildDigest(db, userFromRequest(c), time.Now(), loc)
+		if err != nil {
+			return c.Status(500).SendString("Failed to build digest")
+		}
+
+		switch c.Query("format", "text") {
+		case "json":
+			return c.JSON(digest)
+		case "html":
+			html, err := digest.HTML()
+			if err != nil {
+				return c.Status(500).SendString("Failed to render digest")
+			}
+			c.Type("html")
+			return c.SendString(html)
+		case "text":
+			text, err := digest.Text()
+			if err != nil {
+				return c.Status(500).SendString("Failed to render digest")
+			}
+			return c.SendString(text)
+		default:
+			return c.Status(fiber.StatusBadRequest).SendString("Unknown format")
+		}
+	})
+
+	return app, db, nil
+}
+
+func main() {
+	app, db, err := setupAppAndDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// "replay" rebuilds the todo table from the event log and exits
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		n, err := replayEvents(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("replayed the event log into %d todos", n)
+		return
+	}
+
+	notifier, err := newNotifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+	digests, err := loadDigestSchedule()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go runDigestScheduler(db, notifier, digests)
+	go runTrashPurger(db)
+	go runDeadlineReminders(db, notifier)
 
 	log.Fatal(app.Listen("localhost:4000"))
 }
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,9 +18,44 @@ import (
 	"net/http/httptest"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 )
 
+// newTestUser returns the credentials of a user that does not exist yet.
+func newTestUser() Credentials {
+	return Credentials{Username: fmt.Sprintf("test_%d", time.Now().UnixNano()), Password: "correct horse battery staple"}
+}
+
+// logIn registers a new user and logs them in, for integration tests going through requireAuth.
+func logIn(t *testing.T, app *fiber.App) Session {
+	body, err := json.Marshal(newTestUser())
+	assert.NoError(t, err)
+	post := func(path string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		return resp
+	}
+
+	assert.Equal(t, http.StatusCreated, post("/api/auth/register").StatusCode, "Expected the test user to be registered")
+	resp := post("/api/auth/login")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected the test user to log in")
+
+	var session Session
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	return session
+}
+
+// withToken authenticates req as the session's user.
+func withToken(req *http.Request, session Session) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	return req
+}
+
 func TestAppStartup(t *testing.T) {
 	app, db, err := setupAppAndDB()
 	assert.NoError(t, err)
@@ -27,6 +64,12 @@ func TestAppStartup(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/api/todos", nil)
 	resp, err := app.Test(req)
 	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Expected todos to need a login")
+
+	session := logIn(t, app)
+	req = withToken(httptest.NewRequest(http.MethodGet, "/api/todos", nil), session)
+	resp, err = app.Test(req, -1)
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected the app to start and respond with 200")
 }
 
@@ -42,6 +85,19 @@ func TestSetupAppAndDB_Success(t *testing.T) {
 	}
 }
 
+func TestMigrateTwiceIntegration(t *testing.T) {
+	// setupAppAndDB has migrated once already; a restart migrates again
+	_, db, err := setupAppAndDB()
+	assert.NoError(t, err)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+
+	assert.NoError(t, migrate(db), "Expected the migrations to apply again on a restart")
+	assert.NoError(t, migrate(db))
+}
+
 // Validation Business Logic
 // func validateTodoInput(todo *Todo) error {
 //     if todo.Title == "" {
@@ -77,6 +133,21 @@ func TestValidateTodoInput(t *testing.T) {
     }
     err = validateTodoInput(todo)
     assert.NoError(t, err, "Expected no error for valid title and description")
+
+    // Case 4: Priority outside the known levels
+    priority := "urgent"
+    todo = &Todo{
+        Title:    "Valid Title",
+        Body:     "This is a valid description",
+        Priority: &priority,
+    }
+    err = validateTodoInput(todo)
+    assert.EqualError(t, err, "task priority must be low, medium or high", "Expected an error for unknown priority")
+}
+
+// todoRows returns empty mock rows with the columns of todoColumns.
+func todoRows() *sqlmock.Rows {
+	return sqlmock.NewRows(strings.Split(todoColumns, ", "))
 }
 
 func TestGetTodo(t *testing.T) {
@@ -88,11 +159,11 @@ func TestGetTodo(t *testing.T) {
 
 	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
 
-	rows := sqlmock.NewRows([]string{"id", "title", "text", "isCompleted", "category", "deadline"}).
-		AddRow(1, "Test Todo1", "This is a test todo", true, nil, nil).
-		AddRow(2, "Test Todo2", "This is another test todo", false, "Work", fixedTime)
+	rows := todoRows().
+		AddRow(1, "Test Todo1", "This is a test todo", true, nil, nil, nil, false, nil, fixedTime, fixedTime, fixedTime, nil, nil, 1, nil, nil).
+		AddRow(2, "Test Todo2", "This is another test todo", false, "Work", fixedTime, "UTC", false, "low", fixedTime, fixedTime, nil, nil, nil, 1, nil, nil)
 
-	mock.ExpectQuery("SELECT id, title, text, isCompleted, category, deadline FROM todo").WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + todoColumns + " FROM todo")).WillReturnRows(rows)
 
 	todo, err := getTodo(db, 1)
 	if err != nil {
@@ -101,6 +172,7 @@ func TestGetTodo(t *testing.T) {
 
 	expectedTodo := Todo{
 		ID: 1, Title: "Test Todo1", Body: "This is a test todo", Done: true, Category: nil, Deadline: nil,
+		ListID: 1, CreatedAt: fixedTime, UpdatedAt: fixedTime, CompletedAt: &fixedTime,
 	}
 
 	assert.Equal(t, expectedTodo, todo)
@@ -119,20 +191,20 @@ func TestGetAllTodos(t *testing.T) {
 
 	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
 
-	rows := sqlmock.NewRows([]string{"id", "title", "text", "isCompleted", "category", "deadline"}).
-		AddRow(1, "Test Todo1", "This is a test todo", true, nil, nil).
-		AddRow(2, "Test Todo2", "This is another test todo", false, "Work", fixedTime)
+	rows := todoRows().
+		AddRow(1, "Test Todo1", "This is a test todo", true, nil, nil, nil, false, nil, fixedTime, fixedTime, fixedTime, nil, nil, 1, nil, nil).
+		AddRow(2, "Test Todo2", "This is another test todo", false, "Work", fixedTime, "UTC", false, "low", fixedTime, fixedTime, nil, nil, nil, 1, nil, nil)
 
-	mock.ExpectQuery("SELECT id, title, text, isCompleted, category, deadline FROM todo").WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + todoColumns + " FROM todo")).WillReturnRows(rows)
 
-	todos, err := getAllTodos(db)
+	todos, err := getAllTodos(db, todoQuery{})
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when calling getAllTodos", err)
 	}
 
 	expectedTodos := []Todo{
-		{ID: 1, Title: "Test Todo1", Body: "This is a test todo", Done: true, Category: nil, Deadline: nil},
-		{ID: 2, Title: "Test Todo2", Body: "This is another test todo", Done: false, Category: func() *string { s := "Work"; return &s }(), Deadline: &fixedTime},
+		{ID: 1, Title: "Test Todo1", Body: "This is a test todo", Done: true, Category: nil, Deadline: nil, ListID: 1, CreatedAt: fixedTime, UpdatedAt: fixedTime, CompletedAt: &fixedTime},
+		{ID: 2, Title: "Test Todo2", Body: "This is another test todo", Done: false, Category: func() *string { s := "Work"; return &s }(), Deadline: &fixedTime, DeadlineTZ: func() *string { s := "UTC"; return &s }(), Priority: func() *string { s := "low"; return &s }(), ListID: 1, CreatedAt: fixedTime, UpdatedAt: fixedTime},
 	}
 
 	assert.Equal(t, expectedTodos, todos)
@@ -152,7 +224,7 @@ func TestToggleTodoStatus(t *testing.T) {
 		WithArgs(1).
 		WillReturnRows(sqlmock.NewRows([]string{"iscompleted"}).AddRow(false))
 
-	mock.ExpectExec("UPDATE todo SET iscompleted=\\$1 WHERE id=\\$2").
+	mock.ExpectExec("UPDATE todo SET iscompleted=\\$1, completed_at=CASE WHEN \\$1 THEN now\\(\\) END, updated_at=now\\(\\) WHERE id=\\$2").
 		WithArgs(true, 1).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
@@ -189,8 +261,8 @@ func TestUpdateTodo(t *testing.T) {
 	}
 
 	// Expect the update query to be executed with the correct parameters
-	mock.ExpectExec("UPDATE todo SET title=\\$1, text=\\$2, iscompleted=\\$3, category=\\$4, deadline=\\$5 WHERE id=\\$6").
-		WithArgs(todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.ID).
+	mock.ExpectExec("UPDATE todo SET title=\\$1, text=\\$2, iscompleted=\\$3, category=\\$4, deadline=\\$5,").
+		WithArgs(todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.DeadlineTZ, todo.AllDay, todo.Priority, todo.ID, todo.ListID).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	err = updateTodo(db, todo.ID, &todo)
@@ -212,7 +284,7 @@ func TestDeleteTodo(t *testing.T) {
 
 	todoID := 1
 
-	mock.ExpectExec("DELETE FROM todo WHERE id=\\$1").
+	mock.ExpectExec("UPDATE todo SET deleted_at=now\\(\\) WHERE id=\\$1 AND deleted_at IS NULL").
 		WithArgs(todoID).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
@@ -235,13 +307,14 @@ func TestGetAllTodosIntegration(t *testing.T) {
 		log.Fatalf("Failed to connect to test database: %v", err)
 	}
 	defer db.Close()
+	session := logIn(t, app)
 
 	// Seed test data into the test database
-	_, err = db.Exec("INSERT INTO todo (title, text, iscompleted) VALUES ('Todo1', 'Body1', false), ('Todo2', 'Body2', true)")
+	_, err = db.Exec("INSERT INTO todo (title, text, iscompleted, owner_id) VALUES ('Todo1', 'Body1', false, $1), ('Todo2', 'Body2', true, $1)", session.User.ID)
 	assert.NoError(t, err)
 
 	// Create a test HTTP request to the /api/todos endpoint
-	req := httptest.NewRequest(http.MethodGet, "/api/todos", nil)
+	req := withToken(httptest.NewRequest(http.MethodGet, "/api/todos", nil), session)
 	resp, err := app.Test(req, -1) // -1 disables the timeout
 	assert.NoError(t, err)
 
@@ -257,6 +330,7 @@ func TestCreateTodoIntegration(t *testing.T) {
 		log.Fatalf("Failed to connect to test database: %v", err)
 	}
 	defer db.Close()
+	session := logIn(t, app)
 
 	// Define the new todo to be created
 	newTodo := Todo{
@@ -272,7 +346,7 @@ func TestCreateTodoIntegration(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Create a test HTTP request to the /api/todos endpoint
-	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(newTodoJSON))
+	req := withToken(httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(newTodoJSON)), session)
 	req.Header.Set("Content-Type", "application/json")
 
 	// Perform the request
@@ -310,6 +384,7 @@ func TestGetTodoIntegration(t *testing.T) {
 		log.Fatalf("Failed to connect to test database: %v", err)
 	}
 	defer db.Close()
+	session := logIn(t, app)
 
 	// Define the new todo to be created
 	newTodo := Todo{
@@ -319,17 +394,17 @@ func TestGetTodoIntegration(t *testing.T) {
 	}
 
 	// Insert the todo into the database
-	_, err = db.Exec("INSERT INTO todo (title, text, iscompleted) VALUES ($1, $2, $3)", newTodo.Title, newTodo.Body, newTodo.Done)
+	_, err = db.Exec("INSERT INTO todo (title, text, iscompleted, owner_id) VALUES ($1, $2, $3, $4)", newTodo.Title, newTodo.Body, newTodo.Done, session.User.ID)
 	assert.NoError(t, err)
 
 	// Retrieve ID
-	row := db.QueryRow("SELECT id FROM todo WHERE title = $1 AND text = $2", newTodo.Title, newTodo.Body)
+	row := db.QueryRow("SELECT id FROM todo WHERE title = $1 AND text = $2 AND owner_id = $3", newTodo.Title, newTodo.Body, session.User.ID)
 	var todoID int
 	err = row.Scan(&todoID)
 	assert.NoError(t, err)
 
 	// Create a test HTTP request
-	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/todos/%d", todoID), nil)
+	req := withToken(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/todos/%d", todoID), nil), session)
 
 	resp, err := app.Test(req, -1) // -1 disables the timeout
 	assert.NoError(t, err)
@@ -355,6 +430,7 @@ func TestUpdateTodoIntegration(t *testing.T) {
 		log.Fatalf("Failed to connect to test database: %v", err)
 	}
 	defer db.Close()
+	session := logIn(t, app)
 
 	initialTodo := Todo{
 		Title:    "Initial Title",
@@ -366,7 +442,7 @@ func TestUpdateTodoIntegration(t *testing.T) {
 	initialTodoJSON, err := json.Marshal(initialTodo)
 	assert.NoError(t, err)
 
-	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(initialTodoJSON))
+	req := withToken(httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(initialTodoJSON)), session)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := app.Test(req, -1)
@@ -393,7 +469,7 @@ func TestUpdateTodoIntegration(t *testing.T) {
 	updatedTodoJSON, err := json.Marshal(updatedTodo)
 	assert.NoError(t, err)
 
-	req = httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/todos/%d", createdTodoID), bytes.NewBuffer(updatedTodoJSON))
+	req = withToken(httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/todos/%d", createdTodoID), bytes.NewBuffer(updatedTodoJSON)), session)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err = app.Test(req, -1)
@@ -426,6 +502,7 @@ func TestToggleTodoStatusIntegration(t *testing.T) {
 		log.Fatalf("Failed to connect to test database: %v", err)
 	}
 	defer db.Close()
+	session := logIn(t, app)
 
 	initialTodo := Todo{
 		Title:    "Toggle Test Title",
@@ -437,7 +514,7 @@ func TestToggleTodoStatusIntegration(t *testing.T) {
 	initialTodoJSON, err := json.Marshal(initialTodo)
 	assert.NoError(t, err)
 
-	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(initialTodoJSON))
+	req := withToken(httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(initialTodoJSON)), session)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := app.Test(req, -1)
@@ -454,7 +531,7 @@ func TestToggleTodoStatusIntegration(t *testing.T) {
 	assert.NoError(t, err)
 	createdTodoID := createdTodo.ID
 
-	req = httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/todos/%d/done", createdTodoID), nil)
+	req = withToken(httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/todos/%d/done", createdTodoID), nil), session)
 	resp, err = app.Test(req, -1)
 	assert.NoError(t, err)
 
@@ -474,7 +551,7 @@ func TestToggleTodoStatusIntegration(t *testing.T) {
 	assert.True(t, todo.IsCompleted, "Todo status should be toggled to true")
 
 	// Toggle again to test reverting
-	req = httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/todos/%d/done", createdTodoID), nil)
+	req = withToken(httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/todos/%d/done", createdTodoID), nil), session)
 	resp, err = app.Test(req, -1)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Expected a 204 No Content status code")
@@ -492,6 +569,7 @@ func TestDeleteTodoIntegration(t *testing.T) {
 		log.Fatalf("Failed to connect to test database: %v", err)
 	}
 	defer db.Close()
+	session := logIn(t, app)
 
 	initialTodo := Todo{
 		Title:    "Delete Test Title",
@@ -503,7 +581,7 @@ func TestDeleteTodoIntegration(t *testing.T) {
 	initialTodoJSON, err := json.Marshal(initialTodo)
 	assert.NoError(t, err)
 
-	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(initialTodoJSON))
+	req := withToken(httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBuffer(initialTodoJSON)), session)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := app.Test(req, -1)
@@ -520,20 +598,32 @@ func TestDeleteTodoIntegration(t *testing.T) {
 	assert.NoError(t, err)
 	createdTodoID := createdTodo.ID
 
-	req = httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/todos/%d", createdTodoID), nil)
+	req = withToken(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/todos/%d", createdTodoID), nil), session)
 	resp, err = app.Test(req, -1)
 	assert.NoError(t, err)
 
 	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Expected a 204 No Content status code")
 
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM todo WHERE id=$1)", createdTodoID).Scan(&exists)
+	var trashed bool
+	err = db.QueryRow("SELECT deleted_at IS NOT NULL FROM todo WHERE id=$1", createdTodoID).Scan(&trashed)
 	if err != nil {
-		t.Errorf("Failed to query todo existence from database: %v", err)
+		t.Errorf("Failed to query todo from database: %v", err)
 	}
 
 	assert.NoError(t, err)
-	assert.False(t, exists, "Todo should have been deleted from the database")
+	assert.True(t, trashed, "Todo should have been moved to the trash")
+
+	// A trashed todo is no longer served
+	req = withToken(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/todos/%d", createdTodoID), nil), session)
+	resp, err = app.Test(req, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected a trashed todo not to be found")
+
+	// Restoring brings it back
+	req = withToken(httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/todos/%d/restore", createdTodoID), nil), session)
+	resp, err = app.Test(req, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected a 200 OK status code")
 }
 
 func TestMainFunction(t *testing.T) {
@@ -547,6 +637,23 @@ func TestMainFunction(t *testing.T) {
 	// Make a request to ensure the server started
 	resp, err := http.Get("http://localhost:4000/api/todos")
 	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// And that it lets users in
+	body, err := json.Marshal(newTestUser())
+	assert.NoError(t, err)
+	resp, err = http.Post("http://localhost:4000/api/auth/register", "application/json", bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, err = http.Post("http://localhost:4000/api/auth/login", "application/json", bytes.NewReader(body))
+	assert.NoError(t, err)
+	var session Session
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:4000/api/todos", nil)
+	assert.NoError(t, err)
+	resp, err = http.DefaultClient.Do(withToken(req, session))
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
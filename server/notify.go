@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notification is a message delivered to a single recipient. HTML is optional.
+type Notification struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// logNotifier writes notifications to the server log; it is the default channel.
+type logNotifier struct{}
+
+func (logNotifier) Notify(n Notification) error {
+	log.Printf("notification to %s: %s\n%s", n.To, n.Subject, n.Text)
+	return nil
+}
+
+// deliversPrivately reports whether notifications only reach their recipient, which is not
+// the case for the log channel: anyone who can read the server log sees them too.
+func deliversPrivately(notifier Notifier) bool {
+	_, ok := notifier.(logNotifier)
+	return !ok
+}
+
+// webhookNotifier POSTs the notification as JSON to a fixed URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w webhookNotifier) Notify(n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// smtpNotifier sends the notification as a multipart text/HTML email.
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (s smtpNotifier) Notify(n Notification) error {
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{n.To}, buildEmail(s.from, n))
+}
+
+// buildEmail formats the notification as a message. Subjects often contain todo titles, so
+// they are encoded as an RFC 2047 word whenever they hold anything but printable ASCII; a
+// line break in a title can then not start a header of its own.
+func buildEmail(from string, n Notification) []byte {
+	const boundary = "todo-notification-boundary"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n", from, n.To, mime.QEncoding.Encode("utf-8", n.Subject))
+
+	if n.HTML == "" {
+		fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s", n.Text)
+		return []byte(b.String())
+	}
+
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, n.Text)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, n.HTML)
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return []byte(b.String())
+}
+
+// newNotifier picks the channel from NOTIFY_CHANNEL (log, webhook or smtp).
+func newNotifier() (Notifier, error) {
+	switch channel := getEnv("NOTIFY_CHANNEL", "log"); channel {
+	case "log":
+		return logNotifier{}, nil
+	case "webhook":
+		url := getEnv("NOTIFY_WEBHOOK_URL", "")
+		if url == "" {
+			return nil, fmt.Errorf("NOTIFY_WEBHOOK_URL must be set for the webhook channel")
+		}
+		return webhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "smtp":
+		host := getEnv("SMTP_HOST", "localhost")
+		var auth smtp.Auth
+		if user := getEnv("SMTP_USER", ""); user != "" {
+			auth = smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)
+		}
+		return smtpNotifier{
+			addr: host + ":" + getEnv("SMTP_PORT", "25"),
+			from: getEnv("SMTP_FROM", "todo@localhost"),
+			auth: auth,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown notification channel %q", channel)
+	}
+}
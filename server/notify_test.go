@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier := webhookNotifier{url: server.URL, client: server.Client()}
+	sent := Notification{To: "someone@example.com", Subject: "Hello", Text: "Plain body"}
+
+	assert.NoError(t, notifier.Notify(sent))
+	assert.Equal(t, sent, received)
+}
+
+func TestWebhookNotifierRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	notifier := webhookNotifier{url: server.URL, client: server.Client()}
+	assert.EqualError(t, notifier.Notify(Notification{}), "webhook responded with status 500")
+}
+
+func TestBuildEmail(t *testing.T) {
+	plain := string(buildEmail("todo@localhost", Notification{To: "a@b.c", Subject: "Hi", Text: "Body"}))
+	assert.Contains(t, plain, "Subject: Hi\r\n")
+	assert.Contains(t, plain, "Content-Type: text/plain; charset=utf-8\r\n\r\nBody")
+
+	multipart := string(buildEmail("todo@localhost", Notification{To: "a@b.c", Subject: "Hi", Text: "Body", HTML: "<p>Body</p>"}))
+	assert.Contains(t, multipart, "Content-Type: multipart/alternative")
+	assert.Contains(t, multipart, "<p>Body</p>")
+
+	injected := string(buildEmail("todo@localhost", Notification{To: "a@b.c", Subject: "Due soon: x\r\nBcc: victim@example.com", Text: "Body"}))
+	assert.NotContains(t, injected, "\r\nBcc:", "A line break in the subject must not start a new header")
+	assert.Contains(t, injected, "Subject: =?utf-8?q?Due_soon:_x=0D=0ABcc:_victim@example.com?=\r\n")
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// OIDCProvider is an OpenID Connect identity provider users can log in with. Providers are
+// configured through the environment:
+//
+//	OIDC_PROVIDERS=corp
+//	OIDC_CORP_ISSUER=https://login.example.com
+//	OIDC_CORP_CLIENT_ID=todo
+//	OIDC_CORP_CLIENT_SECRET=...           (optional for public clients; PKCE is always used)
+//	OIDC_CORP_USERNAME_CLAIM=email        (default preferred_username)
+//	OIDC_CORP_AUTO_PROVISION=false        (default true)
+//
+// The redirect URI registered with the provider is OIDC_REDIRECT_BASE (default
+// http://localhost:4000) followed by /api/auth/oidc/<name>/callback.
+type OIDCProvider struct {
+	Name   string `json:"name"`
+	Issuer string `json:"issuer"`
+
+	clientID      string
+	clientSecret  string
+	usernameClaim string
+	autoProvision bool
+	redirectURL   string
+	client        *http.Client
+}
+
+// oidcMetadata is the part of the provider's discovery document the login flow needs.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is an RSA signing key from the provider's JWKS.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// idClaims are the claims of a verified ID token.
+type idClaims map[string]any
+
+// A login has to come back from the provider within oidcLoginTTL.
+const oidcLoginTTL = 10 * time.Minute
+
+// ID tokens are accepted this long past their expiry to allow for clock skew.
+const oidcClockSkew = time.Minute
+
+var (
+	errOIDCLoginExpired     = errors.New("the login has expired or was already used; start again")
+	errProvisioningDisabled = errors.New("no account is linked to this identity and automatic provisioning is disabled")
+)
+
+// oidcError is a login the provider or its ID token did not vouch for.
+type oidcError string
+
+func (e oidcError) Error() string {
+	return "single sign-on failed: " + string(e)
+}
+
+// loadOIDCProviders reads the configured providers, keyed by name. Providers without an
+// issuer or client ID are skipped with a warning.
+func loadOIDCProviders() map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	redirectBase := strings.TrimSuffix(getEnv("OIDC_REDIRECT_BASE", "http://localhost:4000"), "/")
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p := &OIDCProvider{
+			Name:          name,
+			Issuer:        os.Getenv(prefix + "ISSUER"),
+			clientID:      os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret:  os.Getenv(prefix + "CLIENT_SECRET"),
+			usernameClaim: getEnv(prefix+"USERNAME_CLAIM", "preferred_username"),
+			autoProvision: getEnv(prefix+"AUTO_PROVISION", "true") != "false",
+			redirectURL:   redirectBase + "/api/auth/oidc/" + url.PathEscape(name) + "/callback",
+			client:        &http.Client{Timeout: 10 * time.Second},
+		}
+		if p.Issuer == "" || p.clientID == "" {
+			log.Printf("skipping OIDC provider %s: %sISSUER and %sCLIENT_ID are required", name, prefix, prefix)
+			continue
+		}
+		providers[name] = p
+	}
+	return providers
+}
+
+// getJSON fetches url and decodes the JSON response into v.
+func (p *OIDCProvider) getJSON(url string, v any) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// metadata fetches the provider's discovery document. It is fetched on every login rather
+// than cached, so endpoint changes at the provider need no restart; logins are rare enough.
+func (p *OIDCProvider) metadata() (oidcMetadata, error) {
+	var m oidcMetadata
+	if err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &m); err != nil {
+		return m, err
+	}
+	if m.Issuer != p.Issuer {
+		return m, fmt.Errorf("discovery document is for issuer %q, not %q", m.Issuer, p.Issuer)
+	}
+	return m, nil
+}
+
+// codeChallenge is the PKCE S256 challenge for a code verifier (RFC 7636).
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// startOIDCLogin remembers a new login attempt and returns the provider URL to send the
+// browser to. The state ties the callback to this attempt, the nonce ties the ID token to
+// it, and the code verifier proves to the provider that the code is redeemed by whoever
+// asked for it.
+func startOIDCLogin(db dbtx, p *OIDCProvider) (string, error) {
+	m, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	var secrets [3]string
+	for i := range secrets {
+		if secrets[i], err = newToken(); err != nil {
+			return "", err
+		}
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+	// Abandoned logins are cleared out whenever a new one starts
+	if _, err := db.Exec("DELETE FROM oidc_login WHERE created_at <= $1", time.Now().Add(-oidcLoginTTL)); err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("INSERT INTO oidc_login (state, provider, nonce, code_verifier) VALUES ($1, $2, $3, $4)",
+		state, p.Name, nonce, verifier); err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// finishOIDCLogin handles the provider's callback: it redeems the code, verifies the ID
+// token, maps the identity to a local user, provisioning one if allowed, and starts a session.
+// As with login, locked accounts are refused and accounts with two-factor authentication
+// get a challenge instead of a session.
+func finishOIDCLogin(db *sql.DB, p *OIDCProvider, state, code string, now time.Time) (Session, *TwoFactorChallenge, error) {
+	var nonce, verifier string
+	err := db.QueryRow(`DELETE FROM oidc_login WHERE state = $1 AND provider = $2 AND created_at > $3
+		RETURNING nonce, code_verifier`, state, p.Name, now.Add(-oidcLoginTTL)).Scan(&nonce, &verifier)
+	if err == sql.ErrNoRows {
+		return Session{}, nil, errOIDCLoginExpired
+	}
+	if err != nil {
+		return Session{}, nil, err
+	}
+
+	m, err := p.metadata()
+	if err != nil {
+		return Session{}, nil, err
+	}
+	rawIDToken, err := p.exchangeCode(m, code, verifier)
+	if err != nil {
+		return Session{}, nil, err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(m.JWKSURI, &jwks); err != nil {
+		return Session{}, nil, err
+	}
+	claims, err := verifyIDToken(rawIDToken, jwks.Keys, p.Issuer, p.clientID, nonce, now)
+	if err != nil {
+		return Session{}, nil, err
+	}
+
+	u, err := userForIdentity(db, p, claims)
+	if err != nil {
+		return Session{}, nil, err
+	}
+
+	var twoFactor bool
+	var lockedUntil sql.NullTime
+	err = db.QueryRow("SELECT totp_enabled_at IS NOT NULL, locked_until FROM app_user WHERE id = $1", u.ID).Scan(&twoFactor, &lockedUntil)
+	if err != nil {
+		return Session{}, nil, err
+	}
+	if lockedUntil.Valid && lockedUntil.Time.After(now) {
+		return Session{}, nil, tooManyAttemptsError{until: lockedUntil.Time}
+	}
+	if twoFactor {
+		ch, err := startTwoFactorLogin(db, u)
+		return Session{}, &ch, err
+	}
+	s, err := createSession(db, u)
+	return s, nil, err
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the raw ID token.
+func (p *OIDCProvider) exchangeCode(m oidcMetadata, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint responded with status %d: %w", resp.StatusCode, err)
+	}
+	if body.Error != "" {
+		return "", oidcError(strings.TrimSpace(body.Error + " " + body.ErrorDescription))
+	}
+	if body.IDToken == "" {
+		return "", oidcError("the provider returned no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature of an RS256 ID token against the provider's keys and
+// that it was issued by issuer, for clientID, for this login's nonce and has not expired.
+func verifyIDToken(raw string, keys []jsonWebKey, issuer, clientID, nonce string, now time.Time) (idClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, oidcError("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, oidcError("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, oidcError("unsupported ID token algorithm " + header.Alg)
+	}
+
+	key, err := signingKey(keys, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, oidcError("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+		return nil, oidcError("invalid ID token signature")
+	}
+
+	var claims idClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, oidcError("malformed ID token claims")
+	}
+	if claims.string("iss") != issuer {
+		return nil, oidcError("ID token was issued by " + claims.string("iss"))
+	}
+	if !claims.hasAudience(clientID) {
+		return nil, oidcError("ID token is not meant for this application")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, oidcError("ID token has expired")
+	}
+	if claims.string("nonce") != nonce {
+		return nil, oidcError("ID token does not belong to this login")
+	}
+	if claims.string("sub") == "" {
+		return nil, oidcError("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT into v.
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// signingKey finds the RSA key with the given key ID. A token without a key ID may be
+// verified with the provider's only key.
+func signingKey(keys []jsonWebKey, kid string) (*rsa.PublicKey, error) {
+	var found *jsonWebKey
+	for i, k := range keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		if k.Kid == kid || (kid == "" && len(keys) == 1) {
+			found = &keys[i]
+			break
+		}
+	}
+	if found == nil {
+		return nil, oidcError("no signing key " + kid)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(found.N)
+	if err != nil {
+		return nil, oidcError("malformed signing key " + kid)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(found.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, oidcError("malformed signing key " + kid)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (c idClaims) string(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// hasAudience reports whether the token is meant for clientID; aud may be a string or a list.
+func (c idClaims) hasAudience(clientID string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oidcUsername turns a claim value such as an email address into a valid local username by
+// replacing the characters usernames may not contain.
+func oidcUsername(claim string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-", r)) {
+			return r
+		}
+		return '_'
+	}, claim)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// userForIdentity maps the provider's subject to the local user it is linked to. An
+// identity seen for the first time gets a new account, named after the provider's username
+// claim, when the provider allows automatic provisioning. Existing local accounts are never
+// linked by name, since anyone able to pick that name at the provider could take them over.
+func userForIdentity(db *sql.DB, p *OIDCProvider, claims idClaims) (User, error) {
+	var u User
+	err := db.QueryRow(`SELECT u.id, u.username, u.created_at FROM user_identity i JOIN app_user u ON u.id = i.user_id
+		WHERE i.issuer = $1 AND i.subject = $2`, p.Issuer, claims.string("sub")).Scan(&u.ID, &u.Username, &u.CreatedAt)
+	if err != sql.ErrNoRows {
+		return u, err
+	}
+	if !p.autoProvision {
+		return u, errProvisioningDisabled
+	}
+
+	u.Username = oidcUsername(claims.string(p.usernameClaim))
+	if !usernamePattern.MatchString(u.Username) {
+		return u, oidcError(fmt.Sprintf("the %s claim %q cannot be used as a username", p.usernameClaim, claims.string(p.usernameClaim)))
+	}
+	err = withTx(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow("INSERT INTO app_user (username) VALUES ($1) RETURNING id, created_at",
+			u.Username).Scan(&u.ID, &u.CreatedAt)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return errUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("INSERT INTO user_identity (issuer, subject, user_id) VALUES ($1, $2, $3)",
+			p.Issuer, claims.string("sub"), u.ID); err != nil {
+			return err
+		}
+		return setUpFirstUser(tx, u.ID)
+	})
+	return u, err
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint that checks
+// the PKCE verifier and hands out an ID token with the configured claims.
+type mockIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	code      string
+	challenge string
+	claims    map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	idp := &mockIdP{key: key, code: "the-code"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kid: "k1", Kty: "RSA", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("code") != idp.code || codeChallenge(r.FormValue("code_verifier")) != idp.challenge ||
+			id != "todo" || secret != "s3cret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, "k1", idp.claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) sign(t *testing.T, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *mockIdP) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name: "corp", Issuer: idp.server.URL, clientID: "todo", clientSecret: "s3cret",
+		usernameClaim: "email", autoProvision: true,
+		redirectURL: "http://localhost:4000/api/auth/oidc/corp/callback", client: idp.server.Client(),
+	}
+}
+
+// capture is a sqlmock argument that matches anything and remembers it.
+type capture struct{ value *string }
+
+func (c capture) Match(v driver.Value) bool {
+	*c.value, _ = v.(string)
+	return true
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	var verifier string
+	mock.ExpectExec("DELETE FROM oidc_login WHERE created_at <= \\$1").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO oidc_login \\(state, provider, nonce, code_verifier\\)").
+		WithArgs(sqlmock.AnyArg(), "corp", sqlmock.AnyArg(), capture{&verifier}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	target, err := startOIDCLogin(db, p)
+	assert.NoError(t, err)
+
+	u, err := url.Parse(target)
+	assert.NoError(t, err)
+	assert.Equal(t, idp.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	q := u.Query()
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, "todo", q.Get("client_id"))
+	assert.Equal(t, p.redirectURL, q.Get("redirect_uri"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Equal(t, codeChallenge(verifier), q.Get("code_challenge"))
+	assert.NotContains(t, target, verifier, "The verifier must never leave the server")
+	state, nonce := q.Get("state"), q.Get("nonce")
+
+	// The provider sees the challenge and later checks the verifier against it
+	idp.challenge = q.Get("code_challenge")
+	now := time.Now()
+	idp.claims = map[string]any{"iss": idp.server.URL, "aud": []string{"todo"}, "sub": "u-42",
+		"email": "alice@example.com", "nonce": nonce, "exp": now.Add(time.Hour).Unix()}
+
+	mock.ExpectQuery("DELETE FROM oidc_login WHERE state = \\$1 AND provider = \\$2 AND created_at > \\$3\\s+RETURNING nonce, code_verifier").
+		WithArgs(state, "corp", now.Add(-oidcLoginTTL)).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}).AddRow(nonce, verifier))
+	mock.ExpectQuery("SELECT u.id, u.username, u.created_at FROM user_identity i JOIN app_user u").
+		WithArgs(idp.server.URL, "u-42").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO app_user \\(username\\) VALUES \\(\\$1\\)").
+		WithArgs("alice_example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+	mock.ExpectExec("INSERT INTO user_identity \\(issuer, subject, user_id\\)").
+		WithArgs(idp.server.URL, "u-42", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT \\$1 = min\\(id\\) FROM app_user").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(false))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL, locked_until FROM app_user WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"two_factor", "locked_until"}).AddRow(false, nil))
+	mock.ExpectQuery("INSERT INTO user_session \\(token_hash, user_id, expires_at\\)").
+		WithArgs(sqlmock.AnyArg(), 7, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"expires_at"}).AddRow(now.Add(sessionTTL())))
+
+	session, challenge, err := finishOIDCLogin(db, p, state, idp.code, now)
+	assert.NoError(t, err)
+	assert.Nil(t, challenge)
+	assert.Equal(t, "alice_example.com", session.User.Username)
+	assert.NotEmpty(t, session.Token)
+
+	// The state is single use
+	mock.ExpectQuery("DELETE FROM oidc_login WHERE state = \\$1").
+		WithArgs(state, "corp", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}))
+	_, _, err = finishOIDCLogin(db, p, state, idp.code, now)
+	assert.Equal(t, errOIDCLoginExpired, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCLoginRequiresSecondFactor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	idp := newMockIdP(t)
+	idp.challenge = codeChallenge("verifier")
+	now := time.Now()
+	idp.claims = map[string]any{"iss": idp.server.URL, "aud": []string{"todo"}, "sub": "u-42",
+		"nonce": "n", "exp": now.Add(time.Hour).Unix()}
+	login := func() {
+		mock.ExpectQuery("DELETE FROM oidc_login WHERE state = \\$1").
+			WithArgs("st", "corp", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}).AddRow("n", "verifier"))
+		mock.ExpectQuery("SELECT u.id, u.username, u.created_at FROM user_identity i JOIN app_user u").
+			WithArgs(idp.server.URL, "u-42").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}).AddRow(7, "alice", now))
+	}
+
+	login()
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL, locked_until FROM app_user WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"two_factor", "locked_until"}).AddRow(true, nil))
+	mock.ExpectQuery("INSERT INTO login_challenge \\(token_hash, user_id, expires_at\\)").
+		WithArgs(sqlmock.AnyArg(), 7, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"expires_at"}).AddRow(now.Add(loginChallengeTTL)))
+
+	session, challenge, err := finishOIDCLogin(db, idp.provider(), "st", idp.code, now)
+	assert.NoError(t, err)
+	assert.Empty(t, session.Token, "No session before the second factor")
+	assert.True(t, challenge.MFARequired)
+	assert.NotEmpty(t, challenge.MFAToken)
+
+	// Locked accounts are refused outright
+	login()
+	mock.ExpectQuery("SELECT totp_enabled_at IS NOT NULL, locked_until FROM app_user WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"two_factor", "locked_until"}).AddRow(false, now.Add(time.Minute)))
+	_, _, err = finishOIDCLogin(db, idp.provider(), "st", idp.code, now)
+	assert.Equal(t, tooManyAttemptsError{until: now.Add(time.Minute)}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCLoginRejectsWrongVerifier(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	idp := newMockIdP(t)
+	idp.challenge = codeChallenge("the-real-verifier")
+
+	mock.ExpectQuery("DELETE FROM oidc_login WHERE state = \\$1").
+		WithArgs("st", "corp", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}).AddRow("n", "a-guessed-verifier"))
+
+	_, _, err = finishOIDCLogin(db, idp.provider(), "st", idp.code, time.Now())
+	assert.EqualError(t, err, "single sign-on failed: invalid_grant")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserForIdentity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	p := &OIDCProvider{Name: "corp", Issuer: "https://login.example.com", usernameClaim: "preferred_username"}
+	claims := idClaims{"sub": "u-1", "preferred_username": "bob"}
+
+	// A linked identity logs in as its user
+	mock.ExpectQuery("FROM user_identity i JOIN app_user u").
+		WithArgs("https://login.example.com", "u-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}).AddRow(3, "robert", time.Now()))
+	u, err := userForIdentity(db, p, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "robert", u.Username)
+
+	// Without automatic provisioning unknown identities are turned away
+	mock.ExpectQuery("FROM user_identity i JOIN app_user u").
+		WithArgs("https://login.example.com", "u-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}))
+	_, err = userForIdentity(db, p, claims)
+	assert.Equal(t, errProvisioningDisabled, err)
+
+	// A claim that cannot be made into a username is refused
+	p.autoProvision = true
+	mock.ExpectQuery("FROM user_identity i JOIN app_user u").
+		WithArgs("https://login.example.com", "u-2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}))
+	_, err = userForIdentity(db, p, idClaims{"sub": "u-2"})
+	assert.IsType(t, oidcError(""), err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	keys := []jsonWebKey{{
+		Kid: "k1", Kty: "RSA",
+		N: base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}
+	now := time.Date(2024, time.September, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://login.example.com", "aud": "todo", "sub": "u-1",
+			"nonce": "n", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+	verify := func(token string) error {
+		_, err := verifyIDToken(token, keys, "https://login.example.com", "todo", "n", now)
+		return err
+	}
+
+	got, err := verifyIDToken(idp.sign(t, "k1", claims(nil)), keys, "https://login.example.com", "todo", "n", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "u-1", got.string("sub"))
+
+	assert.EqualError(t, verify("not.a-token"), "single sign-on failed: malformed ID token")
+	assert.EqualError(t, verify(idp.sign(t, "k2", claims(nil))), "single sign-on failed: no signing key k2")
+	assert.EqualError(t, verify(idp.sign(t, "k1", claims(map[string]any{"iss": "https://evil.example.com"}))),
+		"single sign-on failed: ID token was issued by https://evil.example.com")
+	assert.EqualError(t, verify(idp.sign(t, "k1", claims(map[string]any{"aud": []string{"other"}}))),
+		"single sign-on failed: ID token is not meant for this application")
+	assert.EqualError(t, verify(idp.sign(t, "k1", claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()}))),
+		"single sign-on failed: ID token has expired")
+	assert.EqualError(t, verify(idp.sign(t, "k1", claims(map[string]any{"nonce": "replayed"}))),
+		"single sign-on failed: ID token does not belong to this login")
+
+	// A valid signature over different claims does not verify
+	token := idp.sign(t, "k1", claims(nil))
+	forged, _ := json.Marshal(claims(map[string]any{"sub": "admin"}))
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	assert.EqualError(t, verify(strings.Join(parts, ".")), "single sign-on failed: invalid ID token signature")
+}
+
+func TestOIDCUsername(t *testing.T) {
+	assert.Equal(t, "alice", oidcUsername("alice"))
+	assert.Equal(t, "alice_example.com", oidcUsername("alice@example.com"))
+	assert.Equal(t, "J_rgen", oidcUsername("Jürgen"))
+	assert.Len(t, oidcUsername("a-very-long-name-from-the-directory@example.com"), 32)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sortableColumns maps the sort keys accepted by GET /api/todos to columns.
+var sortableColumns = map[string]string{
+	"rank":         "rank",
+	"id":           "id",
+	"title":        "title",
+	"deadline":     "deadline",
+	"created_at":   "created_at",
+	"updated_at":   "updated_at",
+	"completed_at": "completed_at",
+}
+
+// timeFilters maps the range parameters accepted by GET /api/todos to a column and comparison.
+var timeFilters = []struct {
+	param  string
+	column string
+	op     string
+}{
+	{"created_after", "created_at", ">="},
+	{"created_before", "created_at", "<"},
+	{"updated_after", "updated_at", ">="},
+	{"updated_before", "updated_at", "<"},
+	{"completed_after", "completed_at", ">="},
+	{"completed_before", "completed_at", "<"},
+}
+
+// todoQuery holds the filters and ordering for listing todos.
+type todoQuery struct {
+	// after/before bounds keyed by timeFilters param
+	bounds map[string]time.Time
+	sort   string
+	desc   bool
+	// asOf lists the todos as they were at that moment instead of now
+	asOf *time.Time
+	// listID limits the todos to one list; without it todos of archived lists are left out
+	listID int
+	// owner is the user whose todos, and todos of lists shared with them, are listed
+	owner int
+	// assignee limits the todos to those assigned to that user
+	assignee int
+}
+
+func parseTodoQuery(c *fiber.Ctx) (todoQuery, error) {
+	q := todoQuery{bounds: map[string]time.Time{}, sort: "rank", owner: userFromRequest(c)}
+
+	loc, err := requestLocation(c, defaultTimezone())
+	if err != nil {
+		return q, fmt.Errorf("invalid time zone")
+	}
+
+	for _, f := range timeFilters {
+		value := c.Query(f.param)
+		if value == "" {
+			continue
+		}
+		// A bare date is midnight in the caller's zone
+		t, _, err := parseDeadline(value, loc)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s %q", f.param, value)
+		}
+		q.bounds[f.param] = t
+	}
+
+	if sort := c.Query("sort"); sort != "" {
+		// "-created_at" is shorthand for sort=created_at&order=desc
+		q.desc = strings.HasPrefix(sort, "-")
+		q.sort = strings.TrimPrefix(sort, "-")
+		if _, ok := sortableColumns[q.sort]; !ok {
+			return q, fmt.Errorf("cannot sort by %q", q.sort)
+		}
+	}
+
+	// assignee=me lists the todos assigned to the user asking
+	switch assignee := c.Query("assignee"); assignee {
+	case "":
+	case "me":
+		q.assignee = q.owner
+	default:
+		if q.assignee, err = strconv.Atoi(assignee); err != nil {
+			return q, fmt.Errorf("assignee must be me or a user id")
+		}
+	}
+
+	if q.asOf, err = parseAsOf(c); err != nil {
+		return q, err
+	}
+	if q.asOf != nil && (len(q.bounds) > 0 || c.Query("sort") != "" || c.Query("order") != "" || q.assignee != 0) {
+		return q, fmt.Errorf("as_of cannot be combined with filters or sorting")
+	}
+
+	switch c.Query("order") {
+	case "":
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	default:
+		return q, fmt.Errorf("order must be asc or desc")
+	}
+
+	return q, nil
+}
+
+// where returns the WHERE clause, with a leading space, and its arguments. Trashed todos are never listed.
+func (q todoQuery) where() (string, []any) {
+	conds := []string{"deleted_at IS NULL"}
+	var args []any
+
+	if q.owner != 0 {
+		args = append(args, q.owner)
+		conds = append(conds, visibleTo(len(args)))
+	}
+
+	if q.assignee != 0 {
+		args = append(args, q.assignee)
+		conds = append(conds, fmt.Sprintf("id IN (SELECT todo_id FROM todo_assignee WHERE user_id = $%d)", len(args)))
+	}
+
+	if q.listID != 0 {
+		args = append(args, q.listID)
+		conds = append(conds, fmt.Sprintf("list_id = $%d", len(args)))
+	} else {
+		conds = append(conds, inActiveList)
+	}
+
+	for _, f := range timeFilters {
+		if t, ok := q.bounds[f.param]; ok {
+			args = append(args, t)
+			conds = append(conds, fmt.Sprintf("%s %s $%d", f.column, f.op, len(args)))
+		}
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (q todoQuery) orderBy() string {
+	// Without a sort key todos come in the order the user arranged them
+	column, ok := sortableColumns[q.sort]
+	if !ok {
+		column = "rank"
+	}
+
+	dir := "ASC"
+	if q.desc {
+		dir = "DESC"
+	}
+	// Ties and missing values are broken by id so pages are stable
+	return fmt.Sprintf(" ORDER BY %s %s NULLS LAST, id", column, dir)
+}
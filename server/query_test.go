@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTodoQuerySQL(t *testing.T) {
+	after := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2024, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+	q := todoQuery{
+		bounds: map[string]time.Time{"created_after": after, "completed_before": before},
+		sort:   "completed_at",
+		desc:   true,
+	}
+
+	where, args := q.where()
+	assert.Equal(t, " WHERE deleted_at IS NULL AND list_id NOT IN (SELECT id FROM todo_list WHERE archived_at IS NOT NULL) AND created_at >= $1 AND completed_at < $2", where)
+	assert.Equal(t, []any{after, before}, args)
+	assert.Equal(t, " ORDER BY completed_at DESC NULLS LAST, id", q.orderBy())
+
+	where, args = todoQuery{listID: 3, bounds: map[string]time.Time{"created_after": after}}.where()
+	assert.Equal(t, " WHERE deleted_at IS NULL AND list_id = $1 AND created_at >= $2", where)
+	assert.Equal(t, []any{3, after}, args)
+
+	where, args = todoQuery{listID: 3, assignee: 2}.where()
+	assert.Equal(t, " WHERE deleted_at IS NULL AND id IN (SELECT todo_id FROM todo_assignee WHERE user_id = $1) AND list_id = $2", where)
+	assert.Equal(t, []any{2, 3}, args)
+
+	where, args = todoQuery{}.where()
+	assert.Equal(t, " WHERE deleted_at IS NULL AND list_id NOT IN (SELECT id FROM todo_list WHERE archived_at IS NOT NULL)", where)
+	assert.Empty(t, args)
+	assert.Equal(t, " ORDER BY rank ASC NULLS LAST, id", todoQuery{}.orderBy())
+}
+
+func TestParseTodoQuery(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		q, err := parseTodoQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		where, _ := q.where()
+		return c.SendString(where + q.orderBy())
+	})
+
+	get := func(query string) (int, string) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("sort=-updated_at&updated_after=2024-09-01&tz=Europe/Copenhagen")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, " WHERE deleted_at IS NULL AND list_id NOT IN (SELECT id FROM todo_list WHERE archived_at IS NOT NULL) AND updated_at >= $1 ORDER BY updated_at DESC NULLS LAST, id", body)
+
+	status, body = get("sort=created_at&order=desc")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, " WHERE deleted_at IS NULL AND list_id NOT IN (SELECT id FROM todo_list WHERE archived_at IS NOT NULL) ORDER BY created_at DESC NULLS LAST, id", body)
+
+	status, body = get("sort=text")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `cannot sort by "text"`, body)
+
+	status, body = get("created_before=yesterday")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `invalid created_before "yesterday"`, body)
+
+	status, body = get("assignee=bob")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "assignee must be me or a user id", body)
+
+	status, _ = get("order=sideways")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestParseTodoQueryAsOf(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		q, err := parseTodoQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return c.SendString(q.asOf.Format(time.RFC3339))
+	})
+
+	get := func(query string) (int, string) {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("as_of=2024-09-01T00:00:00Z")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2024-09-01T00:00:00Z", body)
+
+	// A bare date is midnight in the caller's zone
+	status, body = get("as_of=2024-09-01&tz=Europe/Copenhagen")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2024-09-01T00:00:00+02:00", body)
+
+	status, body = get("as_of=2024-09-01T00:00:00Z&sort=created_at")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "as_of cannot be combined with filters or sorting", body)
+
+	status, body = get("as_of=last+week")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `invalid as_of "last week"`, body)
+}
+
+func TestParseTodoQueryDefaultsToRank(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		q, err := parseTodoQuery(c)
+		if err != nil {
+			return err
+		}
+		return c.SendString(q.orderBy())
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, " ORDER BY rank ASC NULLS LAST, id", string(body))
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A quick-add line is free text with a few markers mixed in:
+//
+//	Pay rent #finance !high due friday 5pm
+//
+// "#word" sets the category, "!level" the priority and "due <when>" the deadline.
+// Every other word becomes part of the title.
+
+type quickTokenKind int
+
+const (
+	quickWord quickTokenKind = iota
+	quickCategory
+	quickPriority
+)
+
+type quickToken struct {
+	kind  quickTokenKind
+	value string
+}
+
+var priorityAliases = map[string]string{
+	"low": "low", "l": "low",
+	"medium": "medium", "med": "medium", "m": "medium",
+	"high": "high", "h": "high",
+}
+
+func tokenizeQuickAdd(line string) []quickToken {
+	var tokens []quickToken
+	for _, field := range strings.Fields(line) {
+		switch {
+		case len(field) > 1 && field[0] == '#':
+			tokens = append(tokens, quickToken{quickCategory, field[1:]})
+		case len(field) > 1 && field[0] == '!':
+			tokens = append(tokens, quickToken{quickPriority, field[1:]})
+		default:
+			tokens = append(tokens, quickToken{quickWord, field})
+		}
+	}
+	return tokens
+}
+
+// parseQuickAdd turns a quick-add line into a todo. Relative dates are resolved against now in loc.
+func parseQuickAdd(line string, now time.Time, loc *time.Location) (Todo, error) {
+	todo := Todo{Body: strings.TrimSpace(line)}
+	tokens := tokenizeQuickAdd(line)
+	var title []string
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch tok.kind {
+		case quickCategory:
+			category := tok.value
+			todo.Category = &category
+
+		case quickPriority:
+			priority, ok := priorityAliases[strings.ToLower(tok.value)]
+			if !ok {
+				return todo, fmt.Errorf("unknown priority %q", tok.value)
+			}
+			todo.Priority = &priority
+
+		case quickWord:
+			if strings.EqualFold(tok.value, "due") && todo.Deadline == nil {
+				words := leadingWords(tokens[i+1:])
+				if deadline, allDay, n := parseRelativeDate(words, now, loc); n > 0 {
+					utc := deadline.UTC()
+					zone := loc.String()
+					todo.Deadline, todo.DeadlineTZ, todo.AllDay = &utc, &zone, allDay
+					i += n
+					continue
+				}
+			}
+			title = append(title, tok.value)
+		}
+	}
+
+	todo.Title = strings.Join(title, " ")
+	if todo.Title == "" {
+		return todo, errors.New("task title must not be empty")
+	}
+	return todo, nil
+}
+
+// leadingWords returns the plain words at the start of tokens, up to the first marker.
+func leadingWords(tokens []quickToken) []string {
+	var words []string
+	for _, tok := range tokens {
+		if tok.kind != quickWord {
+			break
+		}
+		words = append(words, strings.ToLower(tok.value))
+	}
+	return words
+}
+
+// parseRelativeDate reads a date phrase such as "tomorrow", "next monday 9am", "in 3 days"
+// or "2024-10-01 17:30" from the start of words. It returns how many words were consumed,
+// or 0 when words do not start with a date. Without a time of day the deadline is all-day.
+func parseRelativeDate(words []string, now time.Time, loc *time.Location) (time.Time, bool, int) {
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	day, n := parseDay(words, today)
+	hour, minute, m := parseTimeOfDay(words[n:])
+	if n == 0 && m == 0 {
+		return time.Time{}, false, 0
+	}
+	if m == 0 {
+		return day, true, n
+	}
+	if n == 0 {
+		day = today
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc), false, n + m
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday, "tues": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday, "thurs": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+var months = map[string]time.Month{
+	"jan": time.January, "january": time.January,
+	"feb": time.February, "february": time.February,
+	"mar": time.March, "march": time.March,
+	"apr": time.April, "april": time.April,
+	"may": time.May,
+	"jun": time.June, "june": time.June,
+	"jul": time.July, "july": time.July,
+	"aug": time.August, "august": time.August,
+	"sep": time.September, "sept": time.September, "september": time.September,
+	"oct": time.October, "october": time.October,
+	"nov": time.November, "november": time.November,
+	"dec": time.December, "december": time.December,
+}
+
+// parseDay reads the calendar-day part of a date phrase.
+func parseDay(words []string, today time.Time) (time.Time, int) {
+	if len(words) == 0 {
+		return today, 0
+	}
+
+	switch w := words[0]; w {
+	case "today", "tonight":
+		return today, 1
+	case "tomorrow", "tmr":
+		return today.AddDate(0, 0, 1), 1
+	case "next":
+		if len(words) < 2 {
+			return today, 0
+		}
+		if words[1] == "week" {
+			return startOfWeek(today).AddDate(0, 0, 7), 2
+		}
+		if wd, ok := weekdays[words[1]]; ok {
+			// "next friday" is the friday of next week
+			return startOfWeek(today).AddDate(0, 0, 7+(int(wd)+6)%7), 2
+		}
+	case "in":
+		if len(words) < 3 {
+			return today, 0
+		}
+		count, err := strconv.Atoi(words[1])
+		if err != nil || count < 0 {
+			return today, 0
+		}
+		switch strings.TrimSuffix(words[2], "s") {
+		case "day":
+			return today.AddDate(0, 0, count), 3
+		case "week":
+			return today.AddDate(0, 0, 7*count), 3
+		case "month":
+			return today.AddDate(0, count, 0), 3
+		}
+	default:
+		if wd, ok := weekdays[w]; ok {
+			// A bare weekday is the next one to come, today included
+			return today.AddDate(0, 0, (int(wd)-int(today.Weekday())+7)%7), 1
+		}
+		if t, err := time.ParseInLocation(deadlineDateLayout, w, today.Location()); err == nil {
+			return t, 1
+		}
+		if month, ok := months[w]; ok && len(words) > 1 {
+			if d, err := strconv.Atoi(strings.TrimRight(words[1], "stndrh,")); err == nil && d >= 1 && d <= 31 {
+				date := time.Date(today.Year(), month, d, 0, 0, 0, 0, today.Location())
+				if date.Before(today) {
+					date = date.AddDate(1, 0, 0)
+				}
+				return date, 2
+			}
+		}
+	}
+
+	return today, 0
+}
+
+// startOfWeek returns the monday on or before day.
+func startOfWeek(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// parseTimeOfDay reads an optional "at" followed by "5pm", "5 pm", "5:30pm", "17:00", "noon" or "midnight".
+func parseTimeOfDay(words []string) (hour, minute, n int) {
+	if len(words) > 0 && words[0] == "at" {
+		hour, minute, n = parseTimeOfDay(words[1:])
+		if n == 0 {
+			return 0, 0, 0
+		}
+		return hour, minute, n + 1
+	}
+	if len(words) == 0 {
+		return 0, 0, 0
+	}
+
+	switch words[0] {
+	case "noon":
+		return 12, 0, 1
+	case "midnight":
+		return 0, 0, 1
+	}
+
+	clock, n := words[0], 1
+	suffix := ""
+	switch {
+	case strings.HasSuffix(clock, "am"), strings.HasSuffix(clock, "pm"):
+		clock, suffix = clock[:len(clock)-2], clock[len(clock)-2:]
+	case len(words) > 1 && (words[1] == "am" || words[1] == "pm"):
+		suffix, n = words[1], 2
+	}
+
+	h, m, hasMinutes := strings.Cut(clock, ":")
+	hour, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, 0, 0
+	}
+	if hasMinutes {
+		if minute, err = strconv.Atoi(m); err != nil || minute < 0 || minute > 59 {
+			return 0, 0, 0
+		}
+	} else if suffix == "" {
+		// A bare number is not a time, e.g. the "3" in "due in 3 days"
+		return 0, 0, 0
+	}
+
+	switch suffix {
+	case "am", "pm":
+		if hour < 1 || hour > 12 {
+			return 0, 0, 0
+		}
+		hour %= 12
+		if suffix == "pm" {
+			hour += 12
+		}
+	default:
+		if hour < 0 || hour > 23 {
+			return 0, 0, 0
+		}
+	}
+	return hour, minute, n
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenizeQuickAdd(t *testing.T) {
+	tokens := tokenizeQuickAdd("Pay rent  #finance !high due friday")
+
+	assert.Equal(t, []quickToken{
+		{quickWord, "Pay"},
+		{quickWord, "rent"},
+		{quickCategory, "finance"},
+		{quickPriority, "high"},
+		{quickWord, "due"},
+		{quickWord, "friday"},
+	}, tokens)
+}
+
+func TestParseQuickAdd(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Copenhagen")
+	assert.NoError(t, err)
+	// Wednesday
+	now := time.Date(2024, time.September, 18, 10, 0, 0, 0, loc)
+
+	todo, err := parseQuickAdd("Pay rent #finance !high due friday 5pm", now, loc)
+	assert.NoError(t, err)
+	assert.Equal(t, "Pay rent", todo.Title)
+	assert.Equal(t, "Pay rent #finance !high due friday 5pm", todo.Body)
+	assert.Equal(t, "finance", *todo.Category)
+	assert.Equal(t, "high", *todo.Priority)
+	assert.Equal(t, time.Date(2024, time.September, 20, 17, 0, 0, 0, loc).UTC(), *todo.Deadline)
+	assert.Equal(t, "Europe/Copenhagen", *todo.DeadlineTZ)
+	assert.False(t, todo.AllDay)
+
+	// Markers may appear anywhere, and "due" without a date stays in the title
+	todo, err = parseQuickAdd("!l Pay what is due #home", now, loc)
+	assert.NoError(t, err)
+	assert.Equal(t, "Pay what is due", todo.Title)
+	assert.Equal(t, "low", *todo.Priority)
+	assert.Nil(t, todo.Deadline)
+
+	_, err = parseQuickAdd("#finance !high", now, loc)
+	assert.EqualError(t, err, "task title must not be empty")
+
+	_, err = parseQuickAdd("Pay rent !urgent", now, loc)
+	assert.EqualError(t, err, `unknown priority "urgent"`)
+}
+
+func TestParseRelativeDate(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Copenhagen")
+	assert.NoError(t, err)
+	// Wednesday, late evening in UTC but already Thursday in Copenhagen
+	now := time.Date(2024, time.September, 18, 22, 30, 0, 0, time.UTC)
+	thursday := time.Date(2024, time.September, 19, 0, 0, 0, 0, loc)
+
+	cases := []struct {
+		phrase string
+		want   time.Time
+		allDay bool
+		n      int
+	}{
+		{"today", thursday, true, 1},
+		{"tomorrow", thursday.AddDate(0, 0, 1), true, 1},
+		{"thursday", thursday, true, 1},
+		{"monday", thursday.AddDate(0, 0, 4), true, 1},
+		{"next monday", thursday.AddDate(0, 0, 4), true, 2},
+		{"next thursday", thursday.AddDate(0, 0, 7), true, 2},
+		{"next week", thursday.AddDate(0, 0, 4), true, 2},
+		{"in 3 days", thursday.AddDate(0, 0, 3), true, 3},
+		{"in 2 weeks", thursday.AddDate(0, 0, 14), true, 3},
+		{"2024-12-24", time.Date(2024, time.December, 24, 0, 0, 0, 0, loc), true, 1},
+		{"jan 5th", time.Date(2025, time.January, 5, 0, 0, 0, 0, loc), true, 2},
+		{"tomorrow at 9:30am", time.Date(2024, time.September, 20, 9, 30, 0, 0, loc), false, 3},
+		{"friday 5 pm", time.Date(2024, time.September, 20, 17, 0, 0, 0, loc), false, 3},
+		{"17:45", time.Date(2024, time.September, 19, 17, 45, 0, 0, loc), false, 1},
+		{"noon", time.Date(2024, time.September, 19, 12, 0, 0, 0, loc), false, 1},
+		{"tomorrow and more words", thursday.AddDate(0, 0, 1), true, 1},
+	}
+
+	for _, c := range cases {
+		got, allDay, n := parseRelativeDate(splitWords(c.phrase), now, loc)
+		assert.Equal(t, c.want, got, c.phrase)
+		assert.Equal(t, c.allDay, allDay, c.phrase)
+		assert.Equal(t, c.n, n, c.phrase)
+	}
+
+	for _, phrase := range []string{"", "soon", "in 3", "next", "25:00", "13pm", "5"} {
+		_, _, n := parseRelativeDate(splitWords(phrase), now, loc)
+		assert.Zero(t, n, "Expected %q not to parse as a date", phrase)
+	}
+}
+
+func splitWords(s string) []string {
+	return leadingWords(tokenizeQuickAdd(s))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Todos are ordered by rank within their list, a fractional index: a string that sorts
+// between its neighbours byte by byte, so moving a todo only rewrites that todo's rank. The
+// rank column uses the "C" collation so Postgres compares the same way Go does.
+
+const rankDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// rankLockClass is the first key of the advisory locks that serialize rank assignment, one
+// per list; the second key is the list id.
+const rankLockClass = 1
+
+var (
+	errRankOrder        = errors.New("ranks are not in order")
+	errMoveNoNeighbours = errors.New("before or after must be given")
+	errMoveSelf         = errors.New("a todo cannot be moved next to itself")
+)
+
+// moveNeighbourError means the before or after todo of a move does not exist.
+type moveNeighbourError struct {
+	id int
+}
+
+func (e moveNeighbourError) Error() string {
+	return fmt.Sprintf("no todo with id %d to move next to", e.id)
+}
+
+// rankBetween returns a rank that sorts strictly between lo and hi. An empty lo or hi is
+// unbounded. Ranks never end in the lowest digit, so there is always room below them.
+func rankBetween(lo, hi string) (string, error) {
+	if hi != "" && lo >= hi {
+		return "", errRankOrder
+	}
+	return midpoint(lo, hi), nil
+}
+
+func midpoint(lo, hi string) string {
+	// Keep the common prefix and find a key between the remainders
+	n := 0
+	for n < len(hi) && rankDigitAt(lo, n) == hi[n] {
+		n++
+	}
+	if n > 0 {
+		rest := ""
+		if n < len(lo) {
+			rest = lo[n:]
+		}
+		return hi[:n] + midpoint(rest, hi[n:])
+	}
+
+	a := 0
+	if lo != "" {
+		a = strings.IndexByte(rankDigits, lo[0])
+	}
+	b := len(rankDigits)
+	if hi != "" {
+		b = strings.IndexByte(rankDigits, hi[0])
+	}
+
+	if b-a > 1 {
+		return string(rankDigits[(a+b)/2])
+	}
+	// The first digits are adjacent: a shorter prefix of hi is already between them,
+	// otherwise keep lo's first digit and look further along
+	if len(hi) > 1 {
+		return hi[:1]
+	}
+	rest := ""
+	if len(lo) > 1 {
+		rest = lo[1:]
+	}
+	return string(rankDigits[a]) + midpoint(rest, "")
+}
+
+// rankDigitAt treats lo as padded with the lowest digit.
+func rankDigitAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return rankDigits[0]
+}
+
+// lockListRanks keeps other transactions from assigning ranks in a list until this one ends,
+// so two todos added or moved at the same time don't get the same rank. It returns the id of
+// the list, which for a listID of 0 is the default list.
+func lockListRanks(db dbtx, listID int) (int, error) {
+	if listID == 0 {
+		if err := db.QueryRow("SELECT " + defaultList).Scan(&listID); err != nil {
+			return 0, err
+		}
+	}
+	_, err := db.Exec("SELECT pg_advisory_xact_lock($1, $2)", rankLockClass, listID)
+	return listID, err
+}
+
+// nextRank returns a rank after every todo in the list, for a new todo added at its end.
+// Ranks stay locked until the transaction ends.
+func nextRank(db dbtx, listID int) (string, error) {
+	listID, err := lockListRanks(db, listID)
+	if err != nil {
+		return "", err
+	}
+	var last sql.NullString
+	if err := db.QueryRow("SELECT max(rank) FROM todo WHERE list_id = $1", listID).Scan(&last); err != nil {
+		return "", err
+	}
+	return rankBetween(last.String, "")
+}
+
+// rebalanceRanks gives the todos ranked from hi to lo, which are tied or out of order, ranks
+// of their own between the todos around them, keeping the order they are shown in. Only the
+// todos the owner can edit are touched, and each is changed like any other move, so the
+// history, versions and event log follow. The todo being moved, id, is left to the caller.
+func rebalanceRanks(tx dbtx, actor string, owner, listID, id int, lo, hi string) error {
+	rows, err := tx.Query("SELECT id FROM todo WHERE list_id = $1 AND rank >= $3 AND rank <= $4 AND id <> $5 AND "+
+		editableBy(2)+" ORDER BY rank, id", listID, owner, hi, lo, id)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var tied int
+		if err := rows.Scan(&tied); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, tied)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var below, above sql.NullString
+	err = tx.QueryRow(`SELECT (SELECT max(rank) FROM todo WHERE list_id = $1 AND rank < $3 AND `+editableBy(2)+`),
+		(SELECT min(rank) FROM todo WHERE list_id = $1 AND rank > $4 AND `+editableBy(2)+`)`,
+		listID, owner, hi, lo).Scan(&below, &above)
+	if err != nil {
+		return err
+	}
+
+	rank := below.String
+	for _, tied := range ids {
+		if rank, err = rankBetween(rank, above.String); err != nil {
+			return err
+		}
+		next := rank
+		_, _, err := changeTodoTx(tx, actor, "move", tied, func(tx dbtx) (int, error) {
+			res, err := tx.Exec("UPDATE todo SET rank=$1, updated_at=now() WHERE id=$2", next, tied)
+			return tied, requireAffected(res, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillRanks ranks todos written before ranks existed after all ranked ones in their
+// list, in id order.
+func backfillRanks(db *sql.DB) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT id, list_id FROM todo WHERE rank IS NULL ORDER BY list_id, id")
+		if err != nil {
+			return err
+		}
+		var ids, lists []int
+		for rows.Next() {
+			var id, listID int
+			if err := rows.Scan(&id, &listID); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, lists = append(ids, id), append(lists, listID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var rank string
+		for i, id := range ids {
+			if i == 0 || lists[i] != lists[i-1] {
+				rank, err = nextRank(tx, lists[i])
+			} else {
+				rank, err = rankBetween(rank, "")
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE todo SET rank=$1 WHERE id=$2", rank, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// moveTodo places a todo right after the todo with id after and/or right before the todo
+// with id before, both in the todo's list. With only one of them the todo goes directly next
+// to it. Should the neighbours share a rank, the todos between them are rebalanced first,
+// recorded as moves by actor.
+func moveTodo(db dbtx, actor string, owner, id int, before, after *int) error {
+	if before == nil && after == nil {
+		return errMoveNoNeighbours
+	}
+	if (before != nil && *before == id) || (after != nil && *after == id) {
+		return errMoveSelf
+	}
+
+	listID, err := todoListID(db, id)
+	if err != nil {
+		return err
+	}
+	if _, err := lockListRanks(db, listID); err != nil {
+		return err
+	}
+
+	lo, hi, err := moveBounds(db, owner, listID, id, before, after)
+	if err != nil {
+		return err
+	}
+	rank, err := rankBetween(lo, hi)
+	if err == errRankOrder {
+		if err := rebalanceRanks(db, actor, owner, listID, id, lo, hi); err != nil {
+			return err
+		}
+		if lo, hi, err = moveBounds(db, owner, listID, id, before, after); err != nil {
+			return err
+		}
+		// Still out of order after rebalancing means after really comes after before
+		rank, err = rankBetween(lo, hi)
+	}
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE todo SET rank=$1, updated_at=now() WHERE id=$2 AND deleted_at IS NULL", rank, id)
+	return requireAffected(res, err)
+}
+
+// moveBounds returns the ranks a moved todo has to go between.
+func moveBounds(db dbtx, owner, listID, id int, before, after *int) (string, string, error) {
+	var lo, hi string
+	var err error
+	if after != nil {
+		if lo, err = neighbourRank(db, owner, listID, *after); err != nil {
+			return "", "", err
+		}
+	}
+	if before != nil {
+		if hi, err = neighbourRank(db, owner, listID, *before); err != nil {
+			return "", "", err
+		}
+	}
+
+	// Fill in the other side from whatever todo is currently adjacent
+	var other sql.NullString
+	switch {
+	case before == nil:
+		err = db.QueryRow("SELECT min(rank) FROM todo WHERE list_id = $1 AND rank > $2 AND id <> $3 AND deleted_at IS NULL",
+			listID, lo, id).Scan(&other)
+		hi = other.String
+	case after == nil:
+		err = db.QueryRow("SELECT max(rank) FROM todo WHERE list_id = $1 AND rank < $2 AND id <> $3 AND deleted_at IS NULL",
+			listID, hi, id).Scan(&other)
+		lo = other.String
+	}
+	return lo, hi, err
+}
+
+// moveTodoToEnd puts a todo after every other todo in its list.
+func moveTodoToEnd(db dbtx, id int) error {
+	listID, err := todoListID(db, id)
+	if err != nil {
+		return err
+	}
+	rank, err := nextRank(db, listID)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE todo SET rank=$1, updated_at=now() WHERE id=$2 AND deleted_at IS NULL", rank, id)
+	return requireAffected(res, err)
+}
+
+// todoListID returns the list a todo outside the trash is in.
+func todoListID(db dbtx, id int) (int, error) {
+	var listID int
+	err := db.QueryRow("SELECT list_id FROM todo WHERE id=$1 AND deleted_at IS NULL", id).Scan(&listID)
+	return listID, err
+}
+
+// neighbourRank returns the rank of a todo to move next to, which has to be one in the list
+// that the owner can see.
+func neighbourRank(db dbtx, owner, listID, id int) (string, error) {
+	var rank sql.NullString
+	err := db.QueryRow("SELECT rank FROM todo WHERE id=$1 AND list_id=$3 AND "+visibleTo(2)+" AND deleted_at IS NULL",
+		id, owner, listID).Scan(&rank)
+	if err == sql.ErrNoRows {
+		return "", moveNeighbourError{id}
+	}
+	return rank.String, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRankBetween(t *testing.T) {
+	cases := []struct{ lo, hi string }{
+		{"", ""},
+		{"V", ""},
+		{"", "V"},
+		{"1", "2"},
+		{"1", "1V"},
+		{"z", ""},
+		{"zzz", ""},
+		{"", "01"},
+		{"a0V", "a1"},
+	}
+	for _, c := range cases {
+		got, err := rankBetween(c.lo, c.hi)
+		assert.NoError(t, err)
+		assert.Less(t, c.lo, got, "between %q and %q", c.lo, c.hi)
+		if c.hi != "" {
+			assert.Less(t, got, c.hi, "between %q and %q", c.lo, c.hi)
+		}
+		assert.NotEqual(t, byte('0'), got[len(got)-1])
+	}
+
+	// Repeatedly inserting at the front keeps working
+	hi := "V"
+	for i := 0; i < 100; i++ {
+		got, err := rankBetween("", hi)
+		assert.NoError(t, err)
+		assert.Less(t, got, hi)
+		hi = got
+	}
+
+	_, err := rankBetween("b", "a")
+	assert.Equal(t, errRankOrder, err)
+	_, err = rankBetween("a", "a")
+	assert.Equal(t, errRankOrder, err)
+}
+
+func TestMoveTodo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectList := func() {
+		mock.ExpectQuery("SELECT list_id FROM todo WHERE id=\\$1 AND deleted_at IS NULL").
+			WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"list_id"}).AddRow(4))
+		mock.ExpectExec("SELECT pg_advisory_xact_lock\\(\\$1, \\$2\\)").
+			WithArgs(rankLockClass, 4).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	after := 2
+	expectList()
+	mock.ExpectQuery("SELECT rank FROM todo WHERE id=\\$1 AND list_id=\\$3 AND \\(\\(owner_id = \\$2 (.+)\\) AND deleted_at IS NULL").
+		WithArgs(2, 1, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"rank"}).AddRow("a"))
+	mock.ExpectQuery("SELECT min\\(rank\\) FROM todo WHERE list_id = \\$1 AND rank > \\$2 AND id <> \\$3").
+		WithArgs(4, "a", 5).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow("c"))
+	mock.ExpectExec("UPDATE todo SET rank=\\$1, updated_at=now\\(\\) WHERE id=\\$2").
+		WithArgs("b", 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, moveTodo(db, "alice", 1, 5, nil, &after))
+
+	// Neighbours sharing a rank are rebalanced first, each recorded like any other move
+	before := 3
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	expectList()
+	mock.ExpectQuery("SELECT rank FROM todo WHERE id=\\$1 AND list_id=\\$3").
+		WithArgs(2, 1, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"rank"}).AddRow("a"))
+	mock.ExpectQuery("SELECT rank FROM todo WHERE id=\\$1 AND list_id=\\$3").
+		WithArgs(3, 1, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"rank"}).AddRow("a"))
+	mock.ExpectQuery("SELECT id FROM todo WHERE list_id = \\$1 AND rank >= \\$3 AND rank <= \\$4 AND id <> \\$5 AND (.+) ORDER BY rank, id").
+		WithArgs(4, 1, "a", "a", 5).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2).AddRow(3))
+	mock.ExpectQuery("SELECT \\(SELECT max\\(rank\\) FROM todo WHERE list_id = \\$1 AND rank < \\$3 (.+)\\),\\s+\\(SELECT min\\(rank\\)").
+		WithArgs(4, 1, "a", "a").
+		WillReturnRows(sqlmock.NewRows([]string{"below", "above"}).AddRow(nil, "c"))
+	for _, tied := range []struct {
+		id   int
+		rank string
+	}{{2, "J"}, {3, "S"}} {
+		mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+			WithArgs(tied.id).
+			WillReturnRows(todoRows().AddRow(tied.id, "Tied", "", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, "a", 4, nil, 1))
+		mock.ExpectExec("UPDATE todo SET rank=\\$1, updated_at=now\\(\\) WHERE id=\\$2").
+			WithArgs(tied.rank, tied.id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+			WithArgs(tied.id).
+			WillReturnRows(todoRows().AddRow(tied.id, "Tied", "", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, tied.rank, 4, nil, 1))
+		mock.ExpectQuery("INSERT INTO todo_history").
+			WithArgs(tied.id, "move", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(40 + tied.id))
+		mock.ExpectExec("UPDATE todo_version SET valid_to = now\\(\\)").
+			WithArgs(tied.id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO todo_version").
+			WithArgs(tied.id, sqlmock.AnyArg(), 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery("SELECT rank FROM todo WHERE id=\\$1 AND list_id=\\$3").
+		WithArgs(2, 1, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"rank"}).AddRow("J"))
+	mock.ExpectQuery("SELECT rank FROM todo WHERE id=\\$1 AND list_id=\\$3").
+		WithArgs(3, 1, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"rank"}).AddRow("S"))
+	mock.ExpectExec("UPDATE todo SET rank=\\$1, updated_at=now\\(\\) WHERE id=\\$2").
+		WithArgs("N", 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, moveTodo(db, "alice", 1, 5, &before, &after))
+
+	missing := 9
+	expectList()
+	mock.ExpectQuery("SELECT rank FROM todo WHERE id=\\$1").
+		WithArgs(9, 1, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"rank"}))
+	assert.EqualError(t, moveTodo(db, "alice", 1, 5, &missing, nil), "no todo with id 9 to move next to")
+
+	assert.Equal(t, errMoveNoNeighbours, moveTodo(db, "alice", 1, 5, nil, nil))
+	self := 5
+	assert.Equal(t, errMoveSelf, moveTodo(db, "alice", 1, 5, &self, nil))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import "database/sql"
+
+// Schema changes are applied in order on every startup, so each statement
+// has to be idempotent.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS todo (
+		id SERIAL PRIMARY KEY,
+		title TEXT NOT NULL,
+		text TEXT NOT NULL,
+		isCompleted BOOLEAN NOT NULL DEFAULT false,
+		category TEXT,
+		deadline TIMESTAMP
+	)`,
+	// Needed by the daily digest to list what was finished yesterday
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ`,
+	// Deadlines are instants stored in UTC, together with the zone they were entered in
+	`DO $$ BEGIN
+		IF (SELECT data_type FROM information_schema.columns
+			WHERE table_name = 'todo' AND column_name = 'deadline') = 'timestamp without time zone' THEN
+			ALTER TABLE todo ALTER COLUMN deadline TYPE TIMESTAMPTZ USING deadline AT TIME ZONE 'UTC';
+		END IF;
+	END $$`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS deadline_tz TEXT`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS all_day BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS priority TEXT CHECK (priority IN ('low', 'medium', 'high'))`,
+	// Deleting moves a todo to the trash; it is purged after TRASH_RETENTION
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	// Audit trail; deliberately without a foreign key so history outlives a purge
+	`CREATE TABLE IF NOT EXISTS todo_history (
+		id BIGSERIAL PRIMARY KEY,
+		todo_id INT NOT NULL,
+		action TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		before JSONB,
+		after JSONB
+	)`,
+	`CREATE INDEX IF NOT EXISTS todo_history_todo_id_idx ON todo_history (todo_id, id)`,
+	// Per-actor undo stack; entries with undone_at set form the redo stack
+	`CREATE TABLE IF NOT EXISTS undo_stack (
+		id BIGSERIAL PRIMARY KEY,
+		actor TEXT NOT NULL,
+		history_id BIGINT NOT NULL REFERENCES todo_history (id),
+		undone_at TIMESTAMPTZ
+	)`,
+	// Every state of a todo outside the trash, for as_of queries
+	`CREATE TABLE IF NOT EXISTS todo_version (
+		id BIGSERIAL PRIMARY KEY,
+		todo_id INT NOT NULL,
+		valid_from TIMESTAMPTZ NOT NULL,
+		valid_to TIMESTAMPTZ,
+		data JSONB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS todo_version_validity_idx ON todo_version (valid_from, valid_to)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS todo_version_current_idx ON todo_version (todo_id) WHERE valid_to IS NULL`,
+	// Append-only event log for STORAGE_MODE=events, with a snapshot per todo to shorten replays
+	`CREATE TABLE IF NOT EXISTS todo_event (
+		seq BIGSERIAL PRIMARY KEY,
+		todo_id INT NOT NULL,
+		type TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		occurred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		data JSONB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS todo_event_todo_idx ON todo_event (todo_id, seq)`,
+	`CREATE TABLE IF NOT EXISTS todo_snapshot (
+		todo_id INT PRIMARY KEY,
+		seq BIGINT NOT NULL,
+		data JSONB
+	)`,
+	// Responses stored for replay under an Idempotency-Key; status is NULL while the request runs
+	`CREATE TABLE IF NOT EXISTS idempotency_key (
+		key TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status INT,
+		content_type TEXT,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (key, scope)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idempotency_key_created_idx ON idempotency_key (created_at)`,
+	// Manual order as a fractional index, compared bytewise; see rank.go
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS rank TEXT COLLATE "C"`,
+	`CREATE INDEX IF NOT EXISTS todo_rank_idx ON todo (rank)`,
+	// Lists; the first one is the default list that every todo without a list belongs to
+	`CREATE TABLE IF NOT EXISTS todo_list (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		archived_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`INSERT INTO todo_list (name) SELECT 'Inbox' WHERE NOT EXISTS (SELECT 1 FROM todo_list)`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS list_id INT REFERENCES todo_list (id)`,
+	`UPDATE todo SET list_id = (SELECT min(id) FROM todo_list) WHERE list_id IS NULL`,
+	`DO $$
+	BEGIN
+		EXECUTE format('ALTER TABLE todo ALTER COLUMN list_id SET DEFAULT %s', (SELECT min(id) FROM todo_list));
+	END
+	$$`,
+	`ALTER TABLE todo ALTER COLUMN list_id SET NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS todo_list_id_idx ON todo (list_id)`,
+	`CREATE TABLE IF NOT EXISTS todo_template (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		category TEXT,
+		priority TEXT CHECK (priority IN ('low', 'medium', 'high')),
+		checklist TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// Workflow states; a list without rows here uses the default workflow in workflow.go
+	`CREATE TABLE IF NOT EXISTS workflow_state (
+		list_id INT NOT NULL REFERENCES todo_list (id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		name TEXT NOT NULL,
+		is_done BOOLEAN NOT NULL,
+		position INT NOT NULL,
+		PRIMARY KEY (list_id, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS workflow_transition (
+		list_id INT NOT NULL,
+		from_key TEXT NOT NULL,
+		to_key TEXT NOT NULL,
+		PRIMARY KEY (list_id, from_key, to_key),
+		FOREIGN KEY (list_id, from_key) REFERENCES workflow_state (list_id, key) ON DELETE CASCADE,
+		FOREIGN KEY (list_id, to_key) REFERENCES workflow_state (list_id, key) ON DELETE CASCADE
+	)`,
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS state TEXT`,
+	`UPDATE todo SET state = CASE WHEN iscompleted THEN 'done' ELSE 'backlog' END WHERE state IS NULL`,
+	// Keeps iscompleted derived from the state. A change that only touches iscompleted, like a
+	// toggle, and a state the todo's list does not know both put the todo in the first state
+	// of its list that matches iscompleted.
+	`CREATE OR REPLACE FUNCTION todo_sync_state() RETURNS trigger AS $$
+	DECLARE
+		state_done BOOLEAN;
+	BEGIN
+		IF TG_OP = 'UPDATE' AND NEW.state IS NOT DISTINCT FROM OLD.state AND NEW.iscompleted IS DISTINCT FROM OLD.iscompleted THEN
+			NEW.state := NULL;
+		END IF;
+
+		IF NEW.state IS NOT NULL THEN
+			IF EXISTS (SELECT 1 FROM workflow_state WHERE list_id = NEW.list_id) THEN
+				SELECT is_done INTO state_done FROM workflow_state WHERE list_id = NEW.list_id AND key = NEW.state;
+			ELSIF NEW.state IN ('backlog', 'in_progress', 'review', 'done') THEN
+				state_done := NEW.state = 'done';
+			END IF;
+			IF state_done IS NULL THEN
+				NEW.state := NULL;
+			END IF;
+		END IF;
+
+		IF NEW.state IS NULL THEN
+			SELECT key INTO NEW.state FROM workflow_state WHERE list_id = NEW.list_id AND is_done = NEW.iscompleted
+				ORDER BY position LIMIT 1;
+			IF NEW.state IS NULL THEN
+				NEW.state := CASE WHEN NEW.iscompleted THEN 'done' ELSE 'backlog' END;
+			END IF;
+		ELSIF NEW.iscompleted IS DISTINCT FROM state_done THEN
+			NEW.iscompleted := state_done;
+			NEW.completed_at := CASE WHEN state_done THEN now() END;
+		END IF;
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS todo_sync_state ON todo`,
+	`CREATE TRIGGER todo_sync_state BEFORE INSERT OR UPDATE ON todo FOR EACH ROW EXECUTE FUNCTION todo_sync_state()`,
+	`ALTER TABLE todo ALTER COLUMN state SET NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS app_user (
+		id SERIAL PRIMARY KEY,
+		username TEXT NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS app_user_username_idx ON app_user (lower(username))`,
+	// Only a hash of each session token is stored
+	`CREATE TABLE IF NOT EXISTS user_session (
+		token_hash TEXT PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_session_expires_idx ON user_session (expires_at)`,
+	// Todos from before accounts existed have no owner until the first user registers; see registerUser
+	`ALTER TABLE todo ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES app_user (id)`,
+	`CREATE INDEX IF NOT EXISTS todo_owner_idx ON todo (owner_id)`,
+	`ALTER TABLE todo_version ADD COLUMN IF NOT EXISTS owner_id INT`,
+	`ALTER TABLE todo_event ADD COLUMN IF NOT EXISTS owner_id INT`,
+	`CREATE INDEX IF NOT EXISTS todo_event_owner_idx ON todo_event (owner_id, seq)`,
+	// Templates are private to their owner; older ones go to the first user, or to whoever registers first
+	`ALTER TABLE todo_template ADD COLUMN IF NOT EXISTS owner_id INT REFERENCES app_user (id) ON DELETE CASCADE`,
+	`UPDATE todo_template SET owner_id = (SELECT min(id) FROM app_user) WHERE owner_id IS NULL`,
+	`CREATE INDEX IF NOT EXISTS todo_template_owner_idx ON todo_template (owner_id)`,
+	// Personal API tokens; like sessions, only their hash is stored
+	`CREATE TABLE IF NOT EXISTS api_token (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		scope TEXT NOT NULL CHECK (scope IN ('read', 'write')),
+		token_hash TEXT NOT NULL UNIQUE,
+		expires_at TIMESTAMPTZ,
+		last_used_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_token_user_idx ON api_token (user_id, id)`,
+	// Accounts provisioned through single sign-on have no password
+	`ALTER TABLE app_user ALTER COLUMN password_hash DROP NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS user_identity (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (issuer, subject)
+	)`,
+	// OIDC logins in progress, between the redirect to the provider and its callback
+	`CREATE TABLE IF NOT EXISTS oidc_login (
+		state TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT false`,
+	// Installations from before admins existed make their first user one
+	`UPDATE app_user SET is_admin = true WHERE id = (SELECT min(id) FROM app_user)
+		AND NOT EXISTS (SELECT 1 FROM app_user WHERE is_admin)`,
+	// Two-factor authentication: the secret is pending until totp_enabled_at is set
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS totp_secret TEXT`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS totp_failures INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS totp_locked_until TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS totp_recovery_code (
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		code_hash TEXT NOT NULL,
+		PRIMARY KEY (user_id, code_hash)
+	)`,
+	// Logins whose password was right but whose second factor is still to come
+	`CREATE TABLE IF NOT EXISTS login_challenge (
+		token_hash TEXT PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS email TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS app_user_email_idx ON app_user (lower(email))`,
+	// The zone the user's digest goes out in; NULL means DIGEST_TIMEZONE
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS timezone TEXT`,
+	// Consecutive wrong passwords; reaching the limit sets locked_until and starts over
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS failed_logins INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE app_user ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS password_reset (
+		token_hash TEXT PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS security_event (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		detail TEXT,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS security_event_user_idx ON security_event (user_id, id)`,
+	// Shared lists: a pending invitation is a member row not yet accepted, declining deletes it
+	`CREATE TABLE IF NOT EXISTS list_member (
+		list_id INT NOT NULL REFERENCES todo_list (id) ON DELETE CASCADE,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		role TEXT NOT NULL CHECK (role IN ('viewer', 'editor', 'admin')),
+		invited_by INT REFERENCES app_user (id) ON DELETE SET NULL,
+		invited_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		accepted_at TIMESTAMPTZ,
+		PRIMARY KEY (list_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS list_member_user_idx ON list_member (user_id)`,
+	// Lists get an owner, except the default list, which stays everyone's. Lists from before
+	// go to the first user with todos in them, and everyone else with todos there becomes an
+	// admin, so nobody loses access to their todos.
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'todo_list' AND column_name = 'owner_id') THEN
+			ALTER TABLE todo_list ADD COLUMN owner_id INT REFERENCES app_user (id);
+			UPDATE todo_list l SET owner_id = COALESCE((SELECT min(owner_id) FROM todo WHERE list_id = l.id), (SELECT min(id) FROM app_user))
+				WHERE l.id <> (SELECT min(id) FROM todo_list);
+			INSERT INTO list_member (list_id, user_id, role, accepted_at)
+				SELECT DISTINCT t.list_id, t.owner_id, 'admin', now() FROM todo t JOIN todo_list l ON l.id = t.list_id
+				WHERE t.owner_id <> l.owner_id;
+		END IF;
+	END
+	$$`,
+	// Who has a role on which list: owners and members who accepted their invitation
+	`CREATE OR REPLACE VIEW list_access (list_id, user_id, role) AS
+		SELECT id, owner_id, 'owner' FROM todo_list WHERE owner_id IS NOT NULL
+		UNION ALL
+		SELECT list_id, user_id, role FROM list_member WHERE accepted_at IS NOT NULL`,
+	// A user's role on a list. Lists without an owner are open to everyone as editors and to
+	// admins of the installation as admins.
+	`CREATE OR REPLACE FUNCTION list_role(INT, INT) RETURNS TEXT AS $$
+		SELECT CASE WHEN l.owner_id IS NULL
+			THEN CASE WHEN (SELECT is_admin FROM app_user WHERE id = $2) THEN 'admin' ELSE 'editor' END
+			ELSE (SELECT role FROM list_access a WHERE a.list_id = l.id AND a.user_id = $2)
+		END FROM todo_list l WHERE l.id = $1
+	$$ LANGUAGE sql STABLE`,
+	// Public read-only links to a list or a single todo; like API tokens, only the hash is stored
+	`CREATE TABLE IF NOT EXISTS share_link (
+		id SERIAL PRIMARY KEY,
+		token_hash TEXT NOT NULL UNIQUE,
+		list_id INT REFERENCES todo_list (id) ON DELETE CASCADE,
+		todo_id INT REFERENCES todo (id) ON DELETE CASCADE,
+		created_by INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		expires_at TIMESTAMPTZ,
+		last_viewed_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CHECK ((list_id IS NULL) <> (todo_id IS NULL))
+	)`,
+	`CREATE INDEX IF NOT EXISTS share_link_created_by_idx ON share_link (created_by, id)`,
+	// reminded_for is the deadline the assignee was last reminded of
+	`CREATE TABLE IF NOT EXISTS todo_assignee (
+		todo_id INT NOT NULL REFERENCES todo (id) ON DELETE CASCADE,
+		user_id INT NOT NULL REFERENCES app_user (id) ON DELETE CASCADE,
+		assigned_by INT REFERENCES app_user (id) ON DELETE SET NULL,
+		assigned_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		reminded_for TIMESTAMPTZ,
+		PRIMARY KEY (todo_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS todo_assignee_user_idx ON todo_assignee (user_id)`,
+	// Undo stacks belong to users rather than usernames. Entries of actors that are no
+	// user, such as "anonymous", are dropped, and the index on actor goes with the column.
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'undo_stack' AND column_name = 'user_id') THEN
+			ALTER TABLE undo_stack ADD COLUMN user_id INT REFERENCES app_user (id) ON DELETE CASCADE;
+			UPDATE undo_stack s SET user_id = u.id FROM app_user u WHERE lower(u.username) = lower(s.actor);
+			DELETE FROM undo_stack WHERE user_id IS NULL;
+			ALTER TABLE undo_stack ALTER COLUMN user_id SET NOT NULL;
+			ALTER TABLE undo_stack DROP COLUMN actor;
+		END IF;
+	END
+	$$`,
+	`CREATE INDEX IF NOT EXISTS undo_stack_user_idx ON undo_stack (user_id, id)`,
+	// Ranks order the todos within a list
+	`CREATE INDEX IF NOT EXISTS todo_list_rank_idx ON todo (list_id, rank)`,
+}
+
+func migrate(db *sql.DB) error {
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
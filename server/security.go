@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// SecurityEvent is an entry in a user's security log: logins, failed attempts and changes
+// to how the account can be accessed.
+type SecurityEvent struct {
+	ID        int64     `json:"id"`
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The kinds of security events.
+const (
+	eventLogin                  = "login"
+	eventLoginFailed            = "login_failed"
+	eventLoginLocked            = "login_locked"
+	eventLogout                 = "logout"
+	eventTwoFactorFailed        = "two_factor_failed"
+	eventTwoFactorEnabled       = "two_factor_enabled"
+	eventTwoFactorDisabled      = "two_factor_disabled"
+	eventTwoFactorReset         = "two_factor_reset"
+	eventTokenCreated           = "token_created"
+	eventTokenRevoked           = "token_revoked"
+	eventPasswordChanged        = "password_changed"
+	eventPasswordResetRequested = "password_reset_requested"
+	eventPasswordReset          = "password_reset"
+	eventEmailChanged           = "email_changed"
+)
+
+// clientInfo identifies where a request came from, for the security log.
+type clientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// PasswordChange is the body of a password change.
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// EmailChange is the body of an email change. Reset links go to the address, so changing it
+// takes the current password like a password change does.
+type EmailChange struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// PasswordReset is the body of both steps of a password reset: the request names the
+// account by username or email, the confirmation brings the token and the new password.
+type PasswordReset struct {
+	Login    string `json:"login,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
+
+var (
+	errWrongPassword     = errors.New("the current password is wrong")
+	errEmailTaken        = errors.New("that email address is taken")
+	errResetTokenInvalid = errors.New("the reset link is invalid, expired or already used")
+	errResetUnavailable  = errors.New("password reset needs the smtp or webhook notification channel")
+)
+
+// loginMaxFailures is how many wrong passwords in a row lock an account, 5 unless
+// LOGIN_MAX_FAILURES says otherwise.
+func loginMaxFailures() int {
+	return getEnvInt("LOGIN_MAX_FAILURES", 5)
+}
+
+// loginLockout is how long a locked account stays locked, 15 minutes unless LOGIN_LOCKOUT
+// says otherwise.
+func loginLockout() time.Duration {
+	return getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute)
+}
+
+// passwordResetTTL is how long a reset link works, an hour unless PASSWORD_RESET_TTL says otherwise.
+func passwordResetTTL() time.Duration {
+	return getEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+}
+
+func validatePassword(password string) error {
+	if len(password) < passwordMinLength {
+		return fmt.Errorf("password must be at least %d characters", passwordMinLength)
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	if email != "" && !emailPattern.MatchString(email) {
+		return errors.New("email must be an email address")
+	}
+	return nil
+}
+
+// clientFromRequest copies the client's address and user agent out of the request, so
+// they stay valid after the handler returns.
+func clientFromRequest(c *fiber.Ctx) clientInfo {
+	return clientInfo{IP: strings.Clone(c.IP()), UserAgent: strings.Clone(c.Get(fiber.HeaderUserAgent))}
+}
+
+// recordSecurityEvent adds an event to the user's security log.
+func recordSecurityEvent(db dbtx, userID int, event, detail string, client clientInfo) error {
+	_, err := db.Exec(`INSERT INTO security_event (user_id, event, detail, ip, user_agent)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)`, userID, event, detail, client.IP, client.UserAgent)
+	return err
+}
+
+// auditRequest records an event for the client of the request. By the time it is called
+// the change has been made, so a failure to record it is logged rather than failing the request.
+func auditRequest(db dbtx, c *fiber.Ctx, userID int, event, detail string) {
+	if err := recordSecurityEvent(db, userID, event, detail, clientFromRequest(c)); err != nil {
+		log.Printf("failed to record %s for user %d: %v", event, userID, err)
+	}
+}
+
+// getSecurityEvents returns the user's security log newest first, optionally only events
+// of one kind, and for paging only those before the event with id before.
+func getSecurityEvents(db *sql.DB, userID int, event string, before int64, limit int) ([]SecurityEvent, error) {
+	rows, err := db.Query(`SELECT id, event, COALESCE(detail, ''), ip, user_agent, created_at FROM security_event
+		WHERE user_id = $1 AND ($2::text = '' OR event = $2) AND ($3::bigint = 0 OR id < $3)
+		ORDER BY id DESC LIMIT $4`, userID, event, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.Detail, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// recordFailedLogin counts a wrong password and locks the account for loginLockout once
+// there have been loginMaxFailures in a row.
+func recordFailedLogin(db *sql.DB, userID int, client clientInfo) error {
+	var failures int
+	if err := db.QueryRow("UPDATE app_user SET failed_logins = failed_logins + 1 WHERE id = $1 RETURNING failed_logins",
+		userID).Scan(&failures); err != nil {
+		return err
+	}
+	if failures < loginMaxFailures() {
+		return recordSecurityEvent(db, userID, eventLoginFailed, "", client)
+	}
+
+	until := time.Now().Add(loginLockout())
+	if _, err := db.Exec("UPDATE app_user SET failed_logins = 0, locked_until = $1 WHERE id = $2", until, userID); err != nil {
+		return err
+	}
+	return recordSecurityEvent(db, userID, eventLoginLocked,
+		fmt.Sprintf("%d failed logins; locked until %s", failures, until.UTC().Format(time.RFC3339)), client)
+}
+
+// changePassword replaces the password of a logged-in user who knows the current one, ends
+// their other sessions and revokes their API tokens. Accounts created through single sign-on
+// have no password to change.
+func changePassword(db *sql.DB, userID int, pc PasswordChange, currentToken string, client clientInfo) error {
+	if err := validatePassword(pc.NewPassword); err != nil {
+		return err
+	}
+
+	var current sql.NullString
+	if err := db.QueryRow("SELECT password_hash FROM app_user WHERE id = $1", userID).Scan(&current); err != nil {
+		return err
+	}
+	if !checkPassword(current.String, pc.CurrentPassword) {
+		return errWrongPassword
+	}
+	hash, err := hashPassword(pc.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	return withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE app_user SET password_hash = $1 WHERE id = $2", hash, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM user_session WHERE user_id = $1 AND token_hash <> $2", userID, hashToken(currentToken)); err != nil {
+			return err
+		}
+		return revokeAllAPITokens(tx, userID, "a password change", client)
+	})
+}
+
+// setEmail sets or, with an empty address, removes the address password reset links go to,
+// for a user who knows their current password. It returns the previous address, empty if
+// there was none, so its owner can be told about the change.
+func setEmail(db *sql.DB, userID int, ec EmailChange) (string, error) {
+	if err := validateEmail(ec.Email); err != nil {
+		return "", err
+	}
+
+	var current, previous sql.NullString
+	if err := db.QueryRow("SELECT password_hash, email FROM app_user WHERE id = $1", userID).Scan(&current, &previous); err != nil {
+		return "", err
+	}
+	if !checkPassword(current.String, ec.CurrentPassword) {
+		return "", errWrongPassword
+	}
+
+	res, err := db.Exec("UPDATE app_user SET email = NULLIF($1, '') WHERE id = $2", ec.Email, userID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return "", errEmailTaken
+	}
+	return previous.String, requireAffected(res, err)
+}
+
+// notifyEmailChanged tells the previous address of an account that reset links no longer
+// go there, so the owner notices if someone else changed it.
+func notifyEmailChanged(notifier Notifier, username, previous string) error {
+	return notifier.Notify(Notification{
+		To:      previous,
+		Subject: "Your email address was changed",
+		Text: fmt.Sprintf("The email address of %s was changed, and password reset links no longer go to this address.\n\n"+
+			"If that was not you, change your password and check your account's security log.", username),
+	})
+}
+
+// requestPasswordReset sends a one-time reset link to the email address of the account
+// named by login, a username or an email address. Unknown accounts and accounts without an
+// address are silently ignored, so the endpoint cannot be used to find out who has an account.
+func requestPasswordReset(db *sql.DB, notifier Notifier, login string, client clientInfo) error {
+	// A reset link in the server log would let anyone who reads the log take over the account
+	if !deliversPrivately(notifier) {
+		return errResetUnavailable
+	}
+
+	var userID int
+	var username string
+	var email sql.NullString
+	err := db.QueryRow("SELECT id, username, email FROM app_user WHERE lower(username) = lower($1) OR lower(email) = lower($1)",
+		login).Scan(&userID, &username, &email)
+	if err == sql.ErrNoRows || (err == nil && !email.Valid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	ttl := passwordResetTTL()
+	if _, err := db.Exec("INSERT INTO password_reset (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashToken(token), userID, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	if err := recordSecurityEvent(db, userID, eventPasswordResetRequested, "", client); err != nil {
+		return err
+	}
+
+	link := getEnv("PASSWORD_RESET_URL", "http://localhost:5173/reset-password") + "?token=" + url.QueryEscape(token)
+	return notifier.Notify(Notification{
+		To:      email.String,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Someone asked to reset the password of %s. To choose a new one, open this link within %s:\n\n%s\n\n"+
+			"If that was not you, ignore this message; your password stays as it is.", username, ttl, link),
+	})
+}
+
+// resetPassword sets a new password with a reset token. The token is used up, and the
+// account's sessions, API tokens, other reset tokens and lockout are cleared.
+func resetPassword(db *sql.DB, pr PasswordReset, client clientInfo) error {
+	if err := validatePassword(pr.Password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(pr.Password)
+	if err != nil {
+		return err
+	}
+
+	return withTx(db, func(tx *sql.Tx) error {
+		var userID int
+		err := tx.QueryRow("DELETE FROM password_reset WHERE token_hash = $1 AND expires_at > now() RETURNING user_id",
+			hashToken(pr.Token)).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return errResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE app_user SET password_hash = $1, failed_logins = 0, locked_until = NULL WHERE id = $2",
+			hash, userID); err != nil {
+			return err
+		}
+		for _, table := range []string{"password_reset", "user_session", "login_challenge"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = $1", userID); err != nil {
+				return err
+			}
+		}
+		if err := revokeAllAPITokens(tx, userID, "a password reset", client); err != nil {
+			return err
+		}
+		return recordSecurityEvent(tx, userID, eventPasswordReset, "", client)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEmail(t *testing.T) {
+	assert.NoError(t, validateEmail(""))
+	assert.NoError(t, validateEmail("alice@example.com"))
+	assert.EqualError(t, validateEmail("alice"), "email must be an email address")
+	assert.EqualError(t, Credentials{Username: "alice", Password: "12345678", Email: "a@b@c"}.validate(),
+		"email must be an email address")
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	notifier := &recordingNotifier{}
+	client := clientInfo{IP: "127.0.0.1", UserAgent: "test"}
+
+	// Reset links are never written to the server log
+	assert.Equal(t, errResetUnavailable, requestPasswordReset(db, logNotifier{}, "alice", client))
+
+	// Unknown accounts and accounts without an address get nothing, and no error either
+	mock.ExpectQuery("SELECT id, username, email FROM app_user WHERE lower\\(username\\) = lower\\(\\$1\\) OR lower\\(email\\) = lower\\(\\$1\\)").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}))
+	assert.NoError(t, requestPasswordReset(db, notifier, "nobody", client))
+	mock.ExpectQuery("SELECT id, username, email FROM app_user").
+		WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}).AddRow(2, "bob", nil))
+	assert.NoError(t, requestPasswordReset(db, notifier, "bob", client))
+	assert.Empty(t, notifier.sent)
+
+	mock.ExpectQuery("SELECT id, username, email FROM app_user").
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}).AddRow(1, "alice", "alice@example.com"))
+	mock.ExpectExec("INSERT INTO password_reset \\(token_hash, user_id, expires_at\\)").
+		WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO security_event").
+		WithArgs(1, eventPasswordResetRequested, "", "127.0.0.1", "test").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(t, requestPasswordReset(db, notifier, "alice@example.com", client))
+
+	assert.Len(t, notifier.sent, 1)
+	assert.Equal(t, "alice@example.com", notifier.sent[0].To)
+	assert.Contains(t, notifier.sent[0].Text, "http://localhost:5173/reset-password?token=")
+	link := notifier.sent[0].Text[strings.Index(notifier.sent[0].Text, "http://"):]
+	u, err := url.Parse(strings.Fields(link)[0])
+	assert.NoError(t, err)
+	assert.NotEmpty(t, u.Query().Get("token"))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	client := clientInfo{IP: "127.0.0.1", UserAgent: "test"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM password_reset WHERE token_hash = \\$1 AND expires_at > now\\(\\) RETURNING user_id").
+		WithArgs(hashToken("used")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+	err = resetPassword(db, PasswordReset{Token: "used", Password: "a new password"}, client)
+	assert.Equal(t, errResetTokenInvalid, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM password_reset WHERE token_hash = \\$1").
+		WithArgs(hashToken("good")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectExec("UPDATE app_user SET password_hash = \\$1, failed_logins = 0, locked_until = NULL WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, table := range []string{"password_reset", "user_session", "login_challenge"} {
+		mock.ExpectExec("DELETE FROM " + table + " WHERE user_id = \\$1").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	// API tokens someone else may have created go too
+	mock.ExpectExec("DELETE FROM api_token WHERE user_id = \\$1").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO security_event").
+		WithArgs(1, eventTokenRevoked, "every token (2) after a password reset", "127.0.0.1", "test").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO security_event").
+		WithArgs(1, eventPasswordReset, "", "127.0.0.1", "test").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, resetPassword(db, PasswordReset{Token: "good", Password: "a new password"}, client))
+
+	assert.EqualError(t, resetPassword(db, PasswordReset{Token: "good", Password: "short"}, client),
+		"password must be at least 8 characters")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+	client := clientInfo{IP: "127.0.0.1", UserAgent: "test"}
+
+	mock.ExpectQuery("SELECT password_hash FROM app_user WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+	err = changePassword(db, 1, PasswordChange{CurrentPassword: "battery staple", NewPassword: "a new password"}, "current", client)
+	assert.Equal(t, errWrongPassword, err)
+
+	// Other sessions end; the one making the change stays
+	mock.ExpectQuery("SELECT password_hash FROM app_user WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE app_user SET password_hash = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM user_session WHERE user_id = \\$1 AND token_hash <> \\$2").
+		WithArgs(1, hashToken("current")).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM api_token WHERE user_id = \\$1").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO security_event").
+		WithArgs(1, eventTokenRevoked, "every token (1) after a password change", "127.0.0.1", "test").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, changePassword(db, 1, PasswordChange{CurrentPassword: "correct horse", NewPassword: "a new password"}, "current", client))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+
+	// A stolen session is not enough to redirect reset links
+	mock.ExpectQuery("SELECT password_hash, email FROM app_user WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash", "email"}).AddRow(hash, "alice@example.com"))
+	_, err = setEmail(db, 1, EmailChange{Email: "mallory@example.com", CurrentPassword: "battery staple"})
+	assert.Equal(t, errWrongPassword, err)
+
+	mock.ExpectQuery("SELECT password_hash, email FROM app_user WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash", "email"}).AddRow(hash, "alice@example.com"))
+	mock.ExpectExec("UPDATE app_user SET email = NULLIF\\(\\$1, ''\\) WHERE id = \\$2").
+		WithArgs("alice@example.org", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	previous, err := setEmail(db, 1, EmailChange{Email: "alice@example.org", CurrentPassword: "correct horse"})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", previous)
+
+	notifier := &recordingNotifier{}
+	assert.NoError(t, notifyEmailChanged(notifier, "alice", previous))
+	assert.Equal(t, "alice@example.com", notifier.sent[0].To)
+	assert.Contains(t, notifier.sent[0].Text, "The email address of alice was changed")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetSecurityEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	at := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM security_event\\s+WHERE user_id = \\$1 AND \\(\\$2::text = '' OR event = \\$2\\) AND \\(\\$3::bigint = 0 OR id < \\$3\\)\\s+ORDER BY id DESC LIMIT \\$4").
+		WithArgs(1, eventLoginFailed, int64(10), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event", "detail", "ip", "user_agent", "created_at"}).
+			AddRow(9, eventLoginFailed, "", "10.0.0.2", "curl/8.0", at).
+			AddRow(4, eventLoginFailed, "", "10.0.0.1", "curl/8.0", at.Add(-time.Hour)))
+
+	events, err := getSecurityEvents(db, 1, eventLoginFailed, 10, 2)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, int64(9), events[0].ID)
+	assert.Equal(t, "10.0.0.2", events[0].IP)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"time"
+)
+
+//go:embed templates/share.html
+var shareTemplates embed.FS
+
+var shareHTML = htmltemplate.Must(htmltemplate.ParseFS(shareTemplates, "templates/share.html"))
+
+// ShareLink is a public, read-only link to a list or a single todo. Anyone with the token
+// can view what it points to without logging in, until the link expires or is revoked.
+type ShareLink struct {
+	ID           int        `json:"id"`
+	ListID       *int       `json:"list_id"`
+	TodoID       *int       `json:"todo_id"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	// Token is only filled in on creation; afterwards only its hash exists
+	Token string `json:"token,omitempty"`
+}
+
+// SharedView is what a share link shows: a list and its todos, or a single todo. It leaves
+// out everything about the todos that only matters to their users, such as ids and owners.
+type SharedView struct {
+	List      *SharedList `json:"list,omitempty"`
+	Todo      *SharedTodo `json:"todo,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at"`
+}
+
+type SharedList struct {
+	Name  string       `json:"name"`
+	Todos []SharedTodo `json:"todos"`
+}
+
+type SharedTodo struct {
+	Title       string     `json:"title"`
+	Body        string     `json:"body"`
+	Done        bool       `json:"done"`
+	Category    *string    `json:"category"`
+	Deadline    *time.Time `json:"deadline"`
+	AllDay      bool       `json:"all_day"`
+	Priority    *string    `json:"priority"`
+	State       string     `json:"state"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+const shareLinkColumns = "id, list_id, todo_id, expires_at, last_viewed_at, created_at"
+
+var errShareLinkInvalid = errors.New("this link does not exist, has expired or was revoked")
+
+// shareLinkTTL is how long a share link works when no expiry is asked for, 30 days unless
+// SHARE_LINK_TTL says otherwise.
+func shareLinkTTL() time.Duration {
+	return getEnvDuration("SHARE_LINK_TTL", 30*24*time.Hour)
+}
+
+func (l *ShareLink) validate(now time.Time) error {
+	if l.ExpiresAt != nil && !l.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+// sharedTodo copies what a share link shows of a todo. The deadline is given in the zone it
+// was entered in, as there is no viewer whose zone could be used instead.
+func sharedTodo(t Todo) SharedTodo {
+	shared := SharedTodo{Title: t.Title, Body: t.Body, Done: t.Done, Category: t.Category,
+		AllDay: t.AllDay, Priority: t.Priority, State: t.State, CompletedAt: t.CompletedAt}
+	if t.Deadline != nil {
+		deadline := t.deadlineIn(nil)
+		shared.Deadline = &deadline
+	}
+	return shared
+}
+
+func scanShareLink(row rowScanner) (ShareLink, error) {
+	var l ShareLink
+	var listID, todoID sql.NullInt64
+	var expiresAt, lastViewedAt sql.NullTime
+	err := row.Scan(&l.ID, &listID, &todoID, &expiresAt, &lastViewedAt, &l.CreatedAt)
+	if listID.Valid {
+		id := int(listID.Int64)
+		l.ListID = &id
+	}
+	if todoID.Valid {
+		id := int(todoID.Int64)
+		l.TodoID = &id
+	}
+	if expiresAt.Valid {
+		l.ExpiresAt = &expiresAt.Time
+	}
+	if lastViewedAt.Valid {
+		l.LastViewedAt = &lastViewedAt.Time
+	}
+	return l, err
+}
+
+// getShareLinks lists the links a user created, newest first. Expired links are listed
+// until revoked.
+func getShareLinks(db *sql.DB, userID int) ([]ShareLink, error) {
+	rows, err := db.Query("SELECT "+shareLinkColumns+" FROM share_link WHERE created_by = $1 ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// createShareLink generates the token for a link to l.ListID or l.TodoID, stores its hash
+// and fills in l, including the token itself. Links without an expiry get one shareLinkTTL away.
+// Lists without an owner hold everyone's todos, so they cannot be shared as a whole and give
+// errListNotShareable; their todos can still be shared one by one.
+func createShareLink(db *sql.DB, userID int, l *ShareLink) error {
+	if l.ListID != nil {
+		var owner sql.NullInt64
+		if err := db.QueryRow("SELECT owner_id FROM todo_list WHERE id = $1", *l.ListID).Scan(&owner); err != nil {
+			return err
+		}
+		if !owner.Valid {
+			return errListNotShareable
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	l.Token = token
+	if l.ExpiresAt == nil {
+		expiresAt := time.Now().Add(shareLinkTTL())
+		l.ExpiresAt = &expiresAt
+	}
+
+	return db.QueryRow(`INSERT INTO share_link (token_hash, list_id, todo_id, created_by, expires_at) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`, hashToken(token), l.ListID, l.TodoID, userID, l.ExpiresAt).Scan(&l.ID, &l.CreatedAt)
+}
+
+// revokeShareLink deletes a link. Its creator can, and so can admins of the list it shows
+// or whose todo it shows, unless the list has no owner: there being admin of the installation
+// says nothing about other users' todos.
+func revokeShareLink(db *sql.DB, userID, id int) error {
+	res, err := db.Exec(`DELETE FROM share_link s WHERE id = $1 AND (created_by = $2
+		OR EXISTS (SELECT 1 FROM todo_list l WHERE l.id = COALESCE(s.list_id, (SELECT list_id FROM todo WHERE id = s.todo_id))
+			AND l.owner_id IS NOT NULL AND list_role(l.id, $2) IN ('admin', 'owner')))`,
+		id, userID)
+	return requireAffected(res, err)
+}
+
+// getSharedView returns what a live share link shows and records that it was viewed.
+// Links that are unknown, expired or revoked, whose todo is in the trash, or to a list
+// without an owner, give errShareLinkInvalid.
+func getSharedView(db *sql.DB, token string) (SharedView, error) {
+	var view SharedView
+	var listID, todoID sql.NullInt64
+	var expiresAt sql.NullTime
+	err := db.QueryRow(`UPDATE share_link SET last_viewed_at = now()
+		WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > now())
+		RETURNING list_id, todo_id, expires_at`, hashToken(token)).Scan(&listID, &todoID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return view, errShareLinkInvalid
+	}
+	if err != nil {
+		return view, err
+	}
+	if expiresAt.Valid {
+		view.ExpiresAt = &expiresAt.Time
+	}
+
+	if todoID.Valid {
+		todo, err := scanTodo(db.QueryRow("SELECT "+todoColumns+" FROM todo WHERE id = $1 AND deleted_at IS NULL", todoID.Int64))
+		if err == sql.ErrNoRows {
+			return view, errShareLinkInvalid
+		}
+		shared := sharedTodo(todo)
+		view.Todo = &shared
+		return view, err
+	}
+
+	view.List = &SharedList{Todos: []SharedTodo{}}
+	var owned bool
+	if err := db.QueryRow("SELECT name, owner_id IS NOT NULL FROM todo_list WHERE id = $1", listID.Int64).
+		Scan(&view.List.Name, &owned); err != nil {
+		return view, err
+	}
+	if !owned {
+		return SharedView{}, errShareLinkInvalid
+	}
+	rows, err := db.Query("SELECT "+todoColumns+" FROM todo WHERE list_id = $1 AND deleted_at IS NULL ORDER BY rank, id", listID.Int64)
+	if err != nil {
+		return view, err
+	}
+	todos, err := scanTodos(rows)
+	rows.Close()
+	for _, t := range todos {
+		view.List.Todos = append(view.List.Todos, sharedTodo(t))
+	}
+	return view, err
+}
+
+// HTML renders the view as a simple page for people opening the link in a browser.
+func (v SharedView) HTML() (string, error) {
+	var buf bytes.Buffer
+	err := shareHTML.Execute(&buf, v)
+	return buf.String(), err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateShareLink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	assert.EqualError(t, (&ShareLink{ExpiresAt: &past}).validate(now), "expires_at must be in the future")
+
+	// Without an expiry the link gets the default one
+	listID := 3
+	mock.ExpectQuery("SELECT owner_id FROM todo_list WHERE id = \\$1").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow(1))
+	mock.ExpectQuery("INSERT INTO share_link \\(token_hash, list_id, todo_id, created_by, expires_at\\)").
+		WithArgs(sqlmock.AnyArg(), &listID, nil, 1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+
+	link := &ShareLink{ListID: &listID}
+	assert.NoError(t, createShareLink(db, 1, link))
+	assert.Equal(t, 7, link.ID)
+	assert.Len(t, link.Token, 43)
+	assert.WithinDuration(t, now.Add(shareLinkTTL()), *link.ExpiresAt, time.Minute)
+
+	// The default list holds everyone's todos, so it cannot be shared as a whole
+	defaultID := 1
+	mock.ExpectQuery("SELECT owner_id FROM todo_list WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow(nil))
+	assert.Equal(t, errListNotShareable, createShareLink(db, 1, &ShareLink{ListID: &defaultID}))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetSharedView(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	const useLink = "UPDATE share_link SET last_viewed_at = now\\(\\)\\s+WHERE token_hash = \\$1 AND \\(expires_at IS NULL OR expires_at > now\\(\\)\\)"
+	at := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+
+	// Unknown, expired and revoked links all look the same
+	mock.ExpectQuery(useLink).
+		WithArgs(hashToken("gone")).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id", "todo_id", "expires_at"}))
+	_, err = getSharedView(db, "gone")
+	assert.Equal(t, errShareLinkInvalid, err)
+
+	// So does a link to a todo in the trash
+	mock.ExpectQuery(useLink).
+		WithArgs(hashToken("trashed")).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id", "todo_id", "expires_at"}).AddRow(nil, 5, nil))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 AND deleted_at IS NULL").
+		WithArgs(int64(5)).
+		WillReturnRows(todoRows())
+	_, err = getSharedView(db, "trashed")
+	assert.Equal(t, errShareLinkInvalid, err)
+
+	// A link to a list without an owner, made before those were refused, shows nothing
+	mock.ExpectQuery(useLink).
+		WithArgs(hashToken("inbox")).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id", "todo_id", "expires_at"}).AddRow(1, nil, at))
+	mock.ExpectQuery("SELECT name, owner_id IS NOT NULL FROM todo_list").
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "owned"}).AddRow("Inbox", false))
+	_, err = getSharedView(db, "inbox")
+	assert.Equal(t, errShareLinkInvalid, err)
+
+	mock.ExpectQuery(useLink).
+		WithArgs(hashToken("list")).
+		WillReturnRows(sqlmock.NewRows([]string{"list_id", "todo_id", "expires_at"}).AddRow(3, nil, at))
+	mock.ExpectQuery("SELECT name, owner_id IS NOT NULL FROM todo_list WHERE id = \\$1").
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "owned"}).AddRow("Groceries", true))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE list_id = \\$1 AND deleted_at IS NULL ORDER BY rank, id").
+		WithArgs(int64(3)).
+		WillReturnRows(todoRows().
+			AddRow(1, "Milk", "", true, nil, nil, nil, false, nil, at, at, at, nil, "a", 3, "done", 2).
+			AddRow(2, "<b>Eggs</b>", "free range", false, "Shop", at.Add(-10*time.Hour), "Europe/Berlin", true, nil, at, at, nil, nil, "b", 3, "backlog", 4))
+
+	view, err := getSharedView(db, "list")
+	assert.NoError(t, err)
+	assert.Equal(t, &at, view.ExpiresAt)
+	assert.Nil(t, view.Todo)
+	assert.Equal(t, "Groceries", view.List.Name)
+	assert.Equal(t, []string{"Milk", "<b>Eggs</b>"}, []string{view.List.Todos[0].Title, view.List.Todos[1].Title})
+
+	page, err := view.HTML()
+	assert.NoError(t, err)
+	assert.Contains(t, page, "<h1>Groceries</h1>")
+	assert.Contains(t, page, "&lt;b&gt;Eggs&lt;/b&gt;")
+	assert.Contains(t, page, "due Sep 1", "All-day deadlines keep the date they were entered with")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRevokeShareLink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM share_link s WHERE id = \\$1 AND \\(created_by = \\$2\\s+OR EXISTS (.+) "+
+		"AND l.owner_id IS NOT NULL AND list_role\\(l.id, \\$2\\) IN \\('admin', 'owner'\\)\\)\\)").
+		WithArgs(7, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, sql.ErrNoRows, revokeShareLink(db, 2, 7), "Only the creator and list admins can revoke")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// Roles on a list, from least to most powerful. Viewers see the list's todos, editors also
+// change them, admins also manage the list itself and who it is shared with, and the owner,
+// who created the list, is the only one who can delete it or grant and take away admin.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+	roleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleAdmin: 3, roleOwner: 4}
+
+// ListMember is someone with access to a list, or invited to it.
+type ListMember struct {
+	UserID     int        `json:"user_id"`
+	Username   string     `json:"username"`
+	Role       string     `json:"role"`
+	InvitedBy  string     `json:"invited_by,omitempty"`
+	InvitedAt  *time.Time `json:"invited_at,omitempty"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	// Pending is set until the invitation is accepted
+	Pending bool `json:"pending"`
+}
+
+// MemberInvite is the body of an invitation, and with only Role of a role change.
+type MemberInvite struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// Invitation is a list someone was invited to, as seen by the invitee.
+type Invitation struct {
+	ListID    int       `json:"list_id"`
+	ListName  string    `json:"list_name"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by,omitempty"`
+	InvitedAt time.Time `json:"invited_at"`
+}
+
+var (
+	errListReadOnly     = errors.New("you can only view that list")
+	errListNotShareable = errors.New("lists without an owner, like the default list, cannot be shared")
+	errAlreadyMember    = errors.New("that user already has access to the list or has been invited")
+	errNoSuchUser       = errors.New("no user with that username")
+	errOwnerOnly        = errors.New("only the list owner can grant or take away the admin role")
+	errNotListAdmin     = errors.New("only admins of the list can remove others from it")
+	errNoInvitation     = errors.New("no invitation to that list")
+)
+
+func roleAtLeast(role, min string) bool {
+	return roleRanks[role] >= roleRanks[min]
+}
+
+func validateMemberRole(role string) error {
+	if role != roleViewer && role != roleEditor && role != roleAdmin {
+		return errors.New("role must be viewer, editor or admin")
+	}
+	return nil
+}
+
+// visibleTo is the SQL condition for the todos user $n can see: their own in lists without
+// an owner, such as the default list, and every todo in the lists they have a role on.
+func visibleTo(n int) string {
+	return fmt.Sprintf("((owner_id = $%d AND list_id IN (SELECT id FROM todo_list WHERE owner_id IS NULL))"+
+		" OR list_id IN (SELECT list_id FROM list_access WHERE user_id = $%[1]d))", n)
+}
+
+// editableBy is visibleTo without the lists the user can only view.
+func editableBy(n int) string {
+	return fmt.Sprintf("((owner_id = $%d AND list_id IN (SELECT id FROM todo_list WHERE owner_id IS NULL))"+
+		" OR list_id IN (SELECT list_id FROM list_access WHERE user_id = $%[1]d AND role <> 'viewer'))", n)
+}
+
+// todoRole returns the user's role on a todo, trashed or not: the role on its list, or in
+// lists without an owner owner of their own todos and nothing on anyone else's. It returns
+// sql.ErrNoRows for todos that do not exist and "" for todos the user cannot see.
+func todoRole(db dbtx, userID, id int) (string, error) {
+	var role sql.NullString
+	err := db.QueryRow(`SELECT CASE WHEN l.owner_id IS NULL THEN CASE WHEN t.owner_id = $2 THEN 'owner' END
+		ELSE list_role(t.list_id, $2) END
+		FROM todo t JOIN todo_list l ON l.id = t.list_id WHERE t.id = $1`, id, userID).Scan(&role)
+	return role.String, err
+}
+
+// purgedTodoRole is todoRole for a todo that is gone, judged by the list and owner in the
+// last snapshot of its history. It returns sql.ErrNoRows for todos without history.
+func purgedTodoRole(db dbtx, userID, id int) (string, error) {
+	var role sql.NullString
+	err := db.QueryRow(`SELECT CASE WHEN l.owner_id IS NULL THEN CASE WHEN (h.last->>'owner_id')::int = $2 THEN 'owner' END
+		ELSE list_role(l.id, $2) END
+		FROM (SELECT COALESCE(after, before) AS last FROM todo_history WHERE todo_id = $1 ORDER BY id DESC LIMIT 1) h
+		JOIN todo_list l ON l.id = COALESCE((h.last->>'list_id')::int, `+defaultList+`)`, id, userID).Scan(&role)
+	return role.String, err
+}
+
+// listRole returns the user's role on a list, sql.ErrNoRows for lists that do not exist and
+// "" for lists the user has no access to.
+func listRole(db dbtx, userID, listID int) (string, error) {
+	var role sql.NullString
+	err := db.QueryRow("SELECT list_role(id, $2) FROM todo_list WHERE id = $1", listID, userID).Scan(&role)
+	return role.String, err
+}
+
+// checkListWritable makes sure the user may put todos in the list. Lists they cannot see
+// are reported as missing with sql.ErrNoRows; lists they can only view with
+// errListReadOnly. A listID of 0 means the default list, which everyone can write to.
+func checkListWritable(db dbtx, userID, listID int) error {
+	if listID == 0 {
+		return nil
+	}
+	role, err := listRole(db, userID, listID)
+	switch {
+	case err != nil:
+		return err
+	case role == "":
+		return sql.ErrNoRows
+	case !roleAtLeast(role, roleEditor):
+		return errListReadOnly
+	}
+	return nil
+}
+
+// sendListWriteError answers a request whose todo was headed for a list that failed
+// checkListWritable.
+func sendListWriteError(c *fiber.Ctx, err error, failure string) error {
+	switch err {
+	case sql.ErrNoRows:
+		return c.Status(fiber.StatusBadRequest).SendString("no list with that id")
+	case errListReadOnly:
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	}
+	return c.Status(500).SendString(failure)
+}
+
+// sendRoleError answers a request the user's role does not allow.
+func sendRoleError(c *fiber.Ctx, role, minRole string) error {
+	return c.Status(fiber.StatusForbidden).SendString(
+		fmt.Sprintf("your role on the list is %s; this needs %s or higher", role, minRole))
+}
+
+// todoAccess answers 404 for todos, trashed or not, the user cannot see and 403 for those
+// whose list gives them less than minRole. It guards every route that takes a todo id, so
+// handlers further down can trust the id.
+func todoAccess(db *sql.DB, minRole string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		role, err := todoRole(db, userFromRequest(c), id)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(500).SendString("Failed to retrieve todo")
+		}
+		if role == "" {
+			return c.Status(fiber.StatusNotFound).SendString("no todo with that id")
+		}
+		if !roleAtLeast(role, minRole) {
+			return sendRoleError(c, role, minRole)
+		}
+		return c.Next()
+	}
+}
+
+// historyAccess is todoAccess for the history of a todo, which outlives the todo itself. Once
+// the todo is purged, access is decided by where it was when it went.
+func historyAccess(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid todo ID")
+		}
+
+		role, err := todoRole(db, userFromRequest(c), id)
+		if err == sql.ErrNoRows {
+			role, err = purgedTodoRole(db, userFromRequest(c), id)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(500).SendString("Failed to retrieve history")
+		}
+		if role == "" {
+			return c.Status(fiber.StatusNotFound).SendString("no history for that id")
+		}
+		return c.Next()
+	}
+}
+
+// listAccess is todoAccess for routes that take a list id. The role is left in Locals
+// "listRole" for handlers that need to know more.
+func listAccess(db *sql.DB, minRole string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("listId")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid list ID")
+		}
+
+		role, err := listRole(db, userFromRequest(c), id)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(500).SendString("Failed to retrieve list")
+		}
+		if role == "" {
+			return c.Status(fiber.StatusNotFound).SendString("no list with that id")
+		}
+		if !roleAtLeast(role, minRole) {
+			return sendRoleError(c, role, minRole)
+		}
+		c.Locals("listRole", role)
+		return c.Next()
+	}
+}
+
+// getListMembers returns who has access to a list and who is invited to it: the owner
+// first, then the others from the most powerful role down.
+func getListMembers(db *sql.DB, listID int) ([]ListMember, error) {
+	rows, err := db.Query(`SELECT u.id, u.username, 'owner', '', NULL::timestamptz, NULL::timestamptz
+		FROM todo_list l JOIN app_user u ON u.id = l.owner_id WHERE l.id = $1
+		UNION ALL
+		SELECT u.id, u.username, m.role, COALESCE(i.username, ''), m.invited_at, m.accepted_at
+		FROM list_member m JOIN app_user u ON u.id = m.user_id LEFT JOIN app_user i ON i.id = m.invited_by
+		WHERE m.list_id = $1`, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ListMember{}
+	for rows.Next() {
+		var m ListMember
+		var invitedAt, acceptedAt sql.NullTime
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.InvitedBy, &invitedAt, &acceptedAt); err != nil {
+			return nil, err
+		}
+		if invitedAt.Valid {
+			m.InvitedAt = &invitedAt.Time
+		}
+		if acceptedAt.Valid {
+			m.AcceptedAt = &acceptedAt.Time
+		}
+		m.Pending = m.Role != roleOwner && !acceptedAt.Valid
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		if roleRanks[members[i].Role] != roleRanks[members[j].Role] {
+			return roleRanks[members[i].Role] > roleRanks[members[j].Role]
+		}
+		return strings.ToLower(members[i].Username) < strings.ToLower(members[j].Username)
+	})
+	return members, nil
+}
+
+// inviteMember invites a user to a list with a role. They get access once they accept.
+// Only the owner can invite admins.
+func inviteMember(db *sql.DB, listID, inviterID int, inviterRole string, inv MemberInvite) (ListMember, error) {
+	if err := validateMemberRole(inv.Role); err != nil {
+		return ListMember{}, err
+	}
+	if inv.Role == roleAdmin && inviterRole != roleOwner {
+		return ListMember{}, errOwnerOnly
+	}
+
+	m := ListMember{Role: inv.Role, Pending: true}
+	err := withTx(db, func(tx *sql.Tx) error {
+		var owner sql.NullInt64
+		if err := tx.QueryRow("SELECT owner_id FROM todo_list WHERE id = $1", listID).Scan(&owner); err != nil {
+			return err
+		}
+		if !owner.Valid {
+			return errListNotShareable
+		}
+
+		err := tx.QueryRow("SELECT id, username FROM app_user WHERE lower(username) = lower($1)", inv.Username).
+			Scan(&m.UserID, &m.Username)
+		if err == sql.ErrNoRows {
+			return errNoSuchUser
+		}
+		if err != nil {
+			return err
+		}
+		if int64(m.UserID) == owner.Int64 {
+			return errAlreadyMember
+		}
+
+		var invitedAt time.Time
+		err = tx.QueryRow(`INSERT INTO list_member (list_id, user_id, role, invited_by) VALUES ($1, $2, $3, $4)
+			RETURNING invited_at, (SELECT username FROM app_user WHERE id = $4)`,
+			listID, m.UserID, inv.Role, inviterID).Scan(&invitedAt, &m.InvitedBy)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return errAlreadyMember
+		}
+		m.InvitedAt = &invitedAt
+		return err
+	})
+	return m, err
+}
+
+// setMemberRole changes the role of someone invited to or sharing a list. Only the owner
+// can make someone an admin or change an admin's role.
+func setMemberRole(db *sql.DB, listID int, actorRole string, userID int, role string) error {
+	if err := validateMemberRole(role); err != nil {
+		return err
+	}
+
+	return withTx(db, func(tx *sql.Tx) error {
+		var current string
+		err := tx.QueryRow("SELECT role FROM list_member WHERE list_id = $1 AND user_id = $2 FOR UPDATE",
+			listID, userID).Scan(&current)
+		if err != nil {
+			return err
+		}
+		if (role == roleAdmin || current == roleAdmin) && actorRole != roleOwner {
+			return errOwnerOnly
+		}
+
+		_, err = tx.Exec("UPDATE list_member SET role = $1 WHERE list_id = $2 AND user_id = $3", role, listID, userID)
+		return err
+	})
+}
+
+// removeMember takes away someone's access to a list or withdraws their invitation. Anyone
+// can leave a list; removing others takes an admin, and removing an admin the owner. The
+// owner cannot be removed.
+func removeMember(db *sql.DB, listID, actorID int, actorRole string, userID int) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		var current string
+		err := tx.QueryRow("SELECT role FROM list_member WHERE list_id = $1 AND user_id = $2 FOR UPDATE",
+			listID, userID).Scan(&current)
+		if err != nil {
+			return err
+		}
+		if actorID != userID {
+			if !roleAtLeast(actorRole, roleAdmin) {
+				return errNotListAdmin
+			}
+			if current == roleAdmin && actorRole != roleOwner {
+				return errOwnerOnly
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM list_member WHERE list_id = $1 AND user_id = $2", listID, userID); err != nil {
+			return err
+		}
+		// Their todos in the list stay, but they are no longer assigned any
+		_, err = tx.Exec("DELETE FROM todo_assignee WHERE user_id = $2 AND todo_id IN (SELECT id FROM todo WHERE list_id = $1)",
+			listID, userID)
+		return err
+	})
+}
+
+// getInvitations returns the user's pending invitations, newest first.
+func getInvitations(db *sql.DB, userID int) ([]Invitation, error) {
+	rows, err := db.Query(`SELECT l.id, l.name, m.role, COALESCE(i.username, ''), m.invited_at
+		FROM list_member m JOIN todo_list l ON l.id = m.list_id LEFT JOIN app_user i ON i.id = m.invited_by
+		WHERE m.user_id = $1 AND m.accepted_at IS NULL ORDER BY m.invited_at DESC, l.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.ListID, &inv.ListName, &inv.Role, &inv.InvitedBy, &inv.InvitedAt); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// answerInvitation accepts the user's invitation to a list, giving them its role, or
+// declines it, which deletes it.
+func answerInvitation(db dbtx, userID, listID int, accept bool) error {
+	query := "UPDATE list_member SET accepted_at = now() WHERE list_id = $1 AND user_id = $2 AND accepted_at IS NULL"
+	if !accept {
+		query = "DELETE FROM list_member WHERE list_id = $1 AND user_id = $2 AND accepted_at IS NULL"
+	}
+	res, err := db.Exec(query, listID, userID)
+	err = requireAffected(res, err)
+	if err == sql.ErrNoRows {
+		return errNoInvitation
+	}
+	return err
+}
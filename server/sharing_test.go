@@ -0,0 +1,270 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleAtLeast(t *testing.T) {
+	assert.True(t, roleAtLeast(roleOwner, roleAdmin))
+	assert.True(t, roleAtLeast(roleEditor, roleEditor))
+	assert.False(t, roleAtLeast(roleViewer, roleEditor))
+	assert.False(t, roleAtLeast("", roleViewer))
+	assert.EqualError(t, validateMemberRole(roleOwner), "role must be viewer, editor or admin")
+}
+
+func TestTodoAccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", User{ID: 2, Username: "bob"})
+		return c.Next()
+	})
+	app.Patch("/api/todos/:id", todoAccess(db, roleEditor), func(c *fiber.Ctx) error {
+		return c.SendString("changed")
+	})
+
+	patch := func(role any) (int, string) {
+		mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) WHERE t.id = \\$1").
+			WithArgs(5, 2).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(role))
+		resp, err := app.Test(httptest.NewRequest(http.MethodPatch, "/api/todos/5", nil))
+		assert.NoError(t, err)
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	status, _ := patch(nil)
+	assert.Equal(t, fiber.StatusNotFound, status, "Todos of lists not shared with the user look missing")
+	status, body := patch(roleViewer)
+	assert.Equal(t, fiber.StatusForbidden, status)
+	assert.Equal(t, "your role on the list is viewer; this needs editor or higher", body)
+	status, _ = patch(roleEditor)
+	assert.Equal(t, fiber.StatusOK, status)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHistoryAccessAfterPurge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", User{ID: 2, Username: "bob"})
+		return c.Next()
+	})
+	app.Get("/api/todos/:id/history", historyAccess(db), func(c *fiber.Ctx) error {
+		return c.SendString("history")
+	})
+
+	get := func(role any) int {
+		mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) WHERE t.id = \\$1").
+			WithArgs(5, 2).
+			WillReturnRows(sqlmock.NewRows([]string{"role"}))
+		rows := sqlmock.NewRows([]string{"role"})
+		if role != "" {
+			rows.AddRow(role)
+		}
+		mock.ExpectQuery("FROM \\(SELECT COALESCE\\(after, before\\) AS last FROM todo_history WHERE todo_id = \\$1").
+			WithArgs(5, 2).
+			WillReturnRows(rows)
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/todos/5/history", nil))
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, fiber.StatusOK, get(roleViewer), "The history of a purged todo stays readable")
+	assert.Equal(t, fiber.StatusNotFound, get(nil), "Purged todos of lists not shared with the user look missing")
+	assert.Equal(t, fiber.StatusNotFound, get(""), "Todos without history are missing")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCheckBatchLists(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Each list is looked up once; the default list not at all
+	mock.ExpectQuery("SELECT list_role\\(id, \\$2\\) FROM todo_list WHERE id = \\$1").
+		WithArgs(3, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleViewer))
+	mock.ExpectQuery("SELECT list_role\\(id, \\$2\\) FROM todo_list WHERE id = \\$1").
+		WithArgs(4, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}))
+
+	todos := []*Todo{{Title: "a", ListID: 3}, {Title: "b"}, {Title: "c", ListID: 3}, {Title: "d", ListID: 4}}
+	kept, indexes, errs, err := checkBatchLists(db, 1, todos, []int{0, 2, 3, 4}, []BatchError{{Index: 1, Error: "invalid todo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []*Todo{todos[1]}, kept)
+	assert.Equal(t, []int{2}, indexes)
+	assert.Equal(t, []BatchError{
+		{Index: 0, Error: "you can only view that list"},
+		{Index: 1, Error: "invalid todo"},
+		{Index: 3, Error: "you can only view that list"},
+		{Index: 4, Error: "no list with that id"},
+	}, errs)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInviteMember(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	_, err = inviteMember(db, 3, 2, roleAdmin, MemberInvite{Username: "carol", Role: roleAdmin})
+	assert.Equal(t, errOwnerOnly, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT owner_id FROM todo_list WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow(nil))
+	mock.ExpectRollback()
+	_, err = inviteMember(db, 1, 1, roleAdmin, MemberInvite{Username: "carol", Role: roleEditor})
+	assert.Equal(t, errListNotShareable, err)
+
+	invitedAt := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT owner_id FROM todo_list WHERE id = \\$1").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"owner_id"}).AddRow(1))
+	mock.ExpectQuery("SELECT id, username FROM app_user WHERE lower\\(username\\) = lower\\(\\$1\\)").
+		WithArgs("Carol").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(3, "carol"))
+	mock.ExpectQuery("INSERT INTO list_member \\(list_id, user_id, role, invited_by\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\)").
+		WithArgs(3, 3, roleEditor, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"invited_at", "username"}).AddRow(invitedAt, "bob"))
+	mock.ExpectCommit()
+	member, err := inviteMember(db, 3, 2, roleAdmin, MemberInvite{Username: "Carol", Role: roleEditor})
+	assert.NoError(t, err)
+	assert.Equal(t, ListMember{UserID: 3, Username: "carol", Role: roleEditor, InvitedBy: "bob", InvitedAt: &invitedAt, Pending: true}, member)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestChangeAndRemoveMembers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	const selectRole = "SELECT role FROM list_member WHERE list_id = \\$1 AND user_id = \\$2 FOR UPDATE"
+
+	// Admins manage editors and viewers, but not other admins
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRole).WithArgs(3, 4).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleAdmin))
+	mock.ExpectRollback()
+	assert.Equal(t, errOwnerOnly, setMemberRole(db, 3, roleAdmin, 4, roleViewer))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRole).WithArgs(3, 5).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleViewer))
+	mock.ExpectExec("UPDATE list_member SET role = \\$1 WHERE list_id = \\$2 AND user_id = \\$3").
+		WithArgs(roleEditor, 3, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, setMemberRole(db, 3, roleAdmin, 5, roleEditor))
+
+	// Editors cannot remove others, but anyone can leave
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRole).WithArgs(3, 5).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleEditor))
+	mock.ExpectRollback()
+	assert.Equal(t, errNotListAdmin, removeMember(db, 3, 6, roleEditor, 5))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRole).WithArgs(3, 4).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(roleAdmin))
+	mock.ExpectExec("DELETE FROM list_member WHERE list_id = \\$1 AND user_id = \\$2").
+		WithArgs(3, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM todo_assignee WHERE user_id = \\$2 AND todo_id IN \\(SELECT id FROM todo WHERE list_id = \\$1\\)").
+		WithArgs(3, 4).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	assert.NoError(t, removeMember(db, 3, 4, roleAdmin, 4))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetListMembers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	at := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM todo_list l JOIN app_user u ON u.id = l.owner_id WHERE l.id = \\$1\\s+UNION ALL").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "role", "invited_by", "invited_at", "accepted_at"}).
+			AddRow(1, "alice", roleOwner, "", nil, nil).
+			AddRow(4, "dave", roleViewer, "alice", at, nil).
+			AddRow(3, "carol", roleAdmin, "alice", at, at).
+			AddRow(2, "Bob", roleViewer, "alice", at, at))
+
+	members, err := getListMembers(db, 3)
+	assert.NoError(t, err)
+	var names []string
+	for _, m := range members {
+		names = append(names, m.Username)
+	}
+	assert.Equal(t, []string{"alice", "carol", "Bob", "dave"}, names)
+	assert.False(t, members[0].Pending)
+	assert.True(t, members[3].Pending)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAnswerInvitation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE list_member SET accepted_at = now\\(\\) WHERE list_id = \\$1 AND user_id = \\$2 AND accepted_at IS NULL").
+		WithArgs(3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, answerInvitation(db, 2, 3, true))
+
+	mock.ExpectExec("DELETE FROM list_member WHERE list_id = \\$1 AND user_id = \\$2 AND accepted_at IS NULL").
+		WithArgs(3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, errNoInvitation, answerInvitation(db, 2, 3, false))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Template describes a recurring, structured todo. Title, Body and the checklist items may
+// contain placeholders such as {{date}}, filled in when the template is instantiated.
+// Templates are private: only their owner can see, change or instantiate them.
+type Template struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Category  *string   `json:"category"`
+	Priority  *string   `json:"priority"`
+	Checklist []string  `json:"checklist"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// InstantiateRequest supplies values for custom placeholders, an optional deadline and the
+// list the todo goes to, 0 for the default list.
+type InstantiateRequest struct {
+	Vars     map[string]string `json:"vars"`
+	Deadline *string           `json:"deadline"`
+	ListID   int               `json:"list_id"`
+}
+
+const templateColumns = "id, name, title, body, category, priority, checklist, created_at, updated_at"
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+func validateTemplate(t *Template) error {
+	if t.Name == "" {
+		return errors.New("template name must not be empty")
+	}
+	if t.Title == "" {
+		return errors.New("template title must not be empty")
+	}
+	if t.Priority != nil && !validPriority(*t.Priority) {
+		return errors.New("template priority must be low, medium or high")
+	}
+	return nil
+}
+
+func scanTemplate(row rowScanner) (Template, error) {
+	var t Template
+	var category, priority sql.NullString
+	err := row.Scan(&t.ID, &t.Name, &t.Title, &t.Body, &category, &priority, pq.Array(&t.Checklist), &t.CreatedAt, &t.UpdatedAt)
+	if category.Valid {
+		t.Category = &category.String
+	}
+	if priority.Valid {
+		t.Priority = &priority.String
+	}
+	if t.Checklist == nil {
+		t.Checklist = []string{}
+	}
+	return t, err
+}
+
+func getTemplates(db *sql.DB, owner int) ([]Template, error) {
+	rows, err := db.Query("SELECT "+templateColumns+" FROM todo_template WHERE owner_id = $1 ORDER BY name, id", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// getTemplate returns one of the owner's templates; other people's give sql.ErrNoRows.
+func getTemplate(db dbtx, owner, id int) (Template, error) {
+	return scanTemplate(db.QueryRow("SELECT "+templateColumns+" FROM todo_template WHERE id = $1 AND owner_id = $2", id, owner))
+}
+
+func createTemplate(db dbtx, owner int, t *Template) error {
+	if t.Checklist == nil {
+		t.Checklist = []string{}
+	}
+	return db.QueryRow(`INSERT INTO todo_template (name, title, body, category, priority, checklist, owner_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at, updated_at`,
+		t.Name, t.Title, t.Body, t.Category, t.Priority, pq.Array(t.Checklist), owner).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+}
+
+func updateTemplate(db dbtx, owner, id int, t *Template) error {
+	if t.Checklist == nil {
+		t.Checklist = []string{}
+	}
+	res, err := db.Exec(`UPDATE todo_template SET name=$1, title=$2, body=$3, category=$4, priority=$5, checklist=$6, updated_at=now()
+		WHERE id=$7 AND owner_id=$8`, t.Name, t.Title, t.Body, t.Category, t.Priority, pq.Array(t.Checklist), id, owner)
+	return requireAffected(res, err)
+}
+
+func deleteTemplate(db dbtx, owner, id int) error {
+	res, err := db.Exec("DELETE FROM todo_template WHERE id=$1 AND owner_id=$2", id, owner)
+	return requireAffected(res, err)
+}
+
+// placeholderValues are the built-in placeholders, computed for now in the caller's zone.
+// Custom vars override them.
+func placeholderValues(now time.Time, loc *time.Location, vars map[string]string) map[string]string {
+	local := now.In(loc)
+	values := map[string]string{
+		"date":     local.Format("2006-01-02"),
+		"time":     local.Format("15:04"),
+		"weekday":  local.Format("Monday"),
+		"month":    local.Format("January"),
+		"year":     local.Format("2006"),
+		"tomorrow": local.AddDate(0, 0, 1).Format("2006-01-02"),
+	}
+	for k, v := range vars {
+		values[k] = v
+	}
+	return values
+}
+
+// renderPlaceholders fills in every {{name}} in s, failing on names it has no value for.
+func renderPlaceholders(s string, values map[string]string) (string, error) {
+	var missing string
+	out := placeholderPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := placeholderPattern.FindStringSubmatch(m)[1]
+		v, ok := values[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("no value for placeholder {{%s}}", missing)
+	}
+	return out, nil
+}
+
+// instantiateTemplate builds the todo a template describes. Todos have no checklist of their
+// own, so the checklist is appended to the body as a Markdown task list.
+func instantiateTemplate(t Template, values map[string]string) (*Todo, error) {
+	title, err := renderPlaceholders(t.Title, values)
+	if err != nil {
+		return nil, err
+	}
+	body, err := renderPlaceholders(t.Body, values)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, item := range t.Checklist {
+		item, err := renderPlaceholders(item, values)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, "- [ ] "+item)
+	}
+	if len(lines) > 0 {
+		if body != "" {
+			body += "\n\n"
+		}
+		body += strings.Join(lines, "\n")
+	}
+
+	return &Todo{Title: title, Body: body, Category: t.Category, Priority: t.Priority}, nil
+}
+
+// cloneTodo copies a todo's content into a new, not yet done todo in the same list. The
+// workflow state is left out on purpose, so the copy starts in the list's first open state.
+func cloneTodo(todo Todo) *Todo {
+	return &Todo{
+		ListID:     todo.ListID,
+		Title:      todo.Title,
+		Body:       todo.Body,
+		Category:   todo.Category,
+		Deadline:   todo.Deadline,
+		DeadlineTZ: todo.DeadlineTZ,
+		AllDay:     todo.AllDay,
+		Priority:   todo.Priority,
+	}
+}
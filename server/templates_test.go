@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstantiateTemplate(t *testing.T) {
+	category := "Work"
+	template := Template{
+		Title:     "Weekly report for {{client}} ({{date}})",
+		Body:      "Covering the week up to {{ weekday }}",
+		Category:  &category,
+		Checklist: []string{"Collect numbers", "Send to {{client}}"},
+	}
+
+	now := time.Date(2024, time.September, 29, 23, 30, 0, 0, time.UTC)
+	copenhagen, _ := time.LoadLocation("Europe/Copenhagen")
+	values := placeholderValues(now, copenhagen, map[string]string{"client": "ACME"})
+
+	todo, err := instantiateTemplate(template, values)
+	assert.NoError(t, err)
+	assert.Equal(t, "Weekly report for ACME (2024-09-30)", todo.Title)
+	assert.Equal(t, "Covering the week up to Monday\n\n- [ ] Collect numbers\n- [ ] Send to ACME", todo.Body)
+	assert.Equal(t, &category, todo.Category)
+
+	_, err = instantiateTemplate(template, placeholderValues(now, time.UTC, nil))
+	assert.EqualError(t, err, "no value for placeholder {{client}}")
+}
+
+func TestCloneTodo(t *testing.T) {
+	completed := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	clone := cloneTodo(Todo{ID: 4, Title: "Ship it", Body: "Release notes too", Done: true, CompletedAt: &completed,
+		ListID: 3, State: "review", Rank: "m", OwnerID: 2})
+
+	assert.Equal(t, &Todo{Title: "Ship it", Body: "Release notes too", ListID: 3}, clone)
+}
+
+func TestTemplateCRUD(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	template := &Template{Name: "Report", Title: "Report {{date}}"}
+	assert.EqualError(t, validateTemplate(&Template{Title: "x"}), "template name must not be empty")
+	assert.NoError(t, validateTemplate(template))
+
+	mock.ExpectQuery("INSERT INTO todo_template \\(name, title, body, category, priority, checklist, owner_id\\)").
+		WithArgs("Report", "Report {{date}}", "", nil, nil, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(3, fixedTime, fixedTime))
+	assert.NoError(t, createTemplate(db, 1, template))
+	assert.Equal(t, 3, template.ID)
+	assert.Equal(t, []string{}, template.Checklist)
+
+	mock.ExpectQuery("SELECT (.+) FROM todo_template WHERE id = \\$1 AND owner_id = \\$2").
+		WithArgs(3, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "title", "body", "category", "priority", "checklist", "created_at", "updated_at"}).
+			AddRow(3, "Report", "Report {{date}}", "", nil, "high", "{Collect,\"Send it\"}", fixedTime, fixedTime))
+	got, err := getTemplate(db, 1, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Collect", "Send it"}, got.Checklist)
+	assert.Equal(t, "high", *got.Priority)
+
+	// Other people's templates look like missing ones
+	mock.ExpectQuery("SELECT (.+) FROM todo_template WHERE id = \\$1 AND owner_id = \\$2").
+		WithArgs(3, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	_, err = getTemplate(db, 2, 3)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	mock.ExpectExec("UPDATE todo_template SET (.+) WHERE id=\\$7 AND owner_id=\\$8").
+		WithArgs("Report", "Report {{date}}", "", nil, nil, sqlmock.AnyArg(), 3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, sql.ErrNoRows, updateTemplate(db, 2, 3, template))
+
+	mock.ExpectExec("DELETE FROM todo_template WHERE id=\\$1 AND owner_id=\\$2").
+		WithArgs(4, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, sql.ErrNoRows, deleteTemplate(db, 1, 4))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every state a todo has been in outside the trash is kept in todo_version, valid from
+// valid_from up to (but excluding) valid_to. The current version has no valid_to.
+
+// parseAsOf reads the optional as_of query parameter; a bare date is midnight in the caller's zone.
+func parseAsOf(c *fiber.Ctx) (*time.Time, error) {
+	value := c.Query("as_of")
+	if value == "" {
+		return nil, nil
+	}
+
+	loc, err := requestLocation(c, defaultTimezone())
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone")
+	}
+	at, _, err := parseDeadline(value, loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid as_of %q", value)
+	}
+	return &at, nil
+}
+
+// recordVersion closes the todo's current version and, unless it is now gone or trashed,
+// opens a new one holding the snapshot. It runs in the same transaction as the change.
+func recordVersion(tx dbtx, todoID int, after *Todo, afterJSON []byte) error {
+	_, err := tx.Exec("UPDATE todo_version SET valid_to = now() WHERE todo_id = $1 AND valid_to IS NULL", todoID)
+	if err != nil || after == nil || after.DeletedAt != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO todo_version (todo_id, valid_from, data, owner_id) VALUES ($1, now(), $2, NULLIF($3, 0))",
+		todoID, string(afterJSON), after.OwnerID)
+	return err
+}
+
+// backfillVersions gives todos written before versioning existed a version starting at their creation.
+func backfillVersions(db *sql.DB) error {
+	rows, err := db.Query("SELECT " + todoColumns + ` FROM todo
+		WHERE deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM todo_version v WHERE v.todo_id = todo.id)`)
+	if err != nil {
+		return err
+	}
+	todos, err := scanTodos(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, todo := range todos {
+		data, err := snapshot(&todo)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO todo_version (todo_id, valid_from, data, owner_id) VALUES ($1, $2, $3, NULLIF($4, 0))",
+			todo.ID, todo.CreatedAt, string(data), todo.OwnerID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTodosAsOf returns the todos the user can see as they were at the given moment, those
+// in shared lists included. Which lists the user can see is decided as of now; versions from
+// before there were lists count as being in the default list.
+func getTodosAsOf(db *sql.DB, owner int, at time.Time) ([]Todo, error) {
+	rows, err := db.Query(`SELECT data FROM (
+			SELECT todo_id, data, owner_id, COALESCE((data->>'list_id')::int, `+defaultList+`) AS list_id
+			FROM todo_version
+			WHERE valid_from <= $1 AND (valid_to IS NULL OR valid_to > $1)
+		) v WHERE `+visibleTo(2)+`
+		ORDER BY data->>'rank' COLLATE "C", todo_id`, at, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := []Todo{}
+	for rows.Next() {
+		todo, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+
+	return todos, rows.Err()
+}
+
+// getTodoAsOf returns a single todo as it was at the given moment.
+func getTodoAsOf(db *sql.DB, id int, at time.Time) (Todo, error) {
+	row := db.QueryRow(`SELECT data FROM todo_version
+		WHERE todo_id = $1 AND valid_from <= $2 AND (valid_to IS NULL OR valid_to > $2)`, id, at)
+
+	todo, err := scanVersion(row)
+	if err == sql.ErrNoRows {
+		return todo, fmt.Errorf("no todo found with id %d at %s", id, at.Format(time.RFC3339))
+	}
+	return todo, err
+}
+
+func scanVersion(row rowScanner) (Todo, error) {
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		return Todo{}, err
+	}
+
+	todo, err := decodeSnapshot(data)
+	if err != nil {
+		return Todo{}, err
+	}
+	return *todo, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	todo := &Todo{ID: 1, Title: "Buy milk", OwnerID: 2}
+	data, _ := snapshot(todo)
+
+	mock.ExpectExec("UPDATE todo_version SET valid_to = now\\(\\) WHERE todo_id = \\$1 AND valid_to IS NULL").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO todo_version \\(todo_id, valid_from, data, owner_id\\)").
+		WithArgs(1, string(data), 2).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	assert.NoError(t, recordVersion(db, 1, todo, data))
+
+	// A trashed todo only has its version closed
+	deleted := time.Now()
+	todo.DeletedAt = &deleted
+	mock.ExpectExec("UPDATE todo_version SET valid_to = now\\(\\)").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, recordVersion(db, 1, todo, data))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetTodosAsOf(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	at := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM todo_version WHERE valid_from <= \\$1 AND \\(valid_to IS NULL OR valid_to > \\$1\\) \\) v "+
+		"WHERE \\(\\(owner_id = \\$2 (.+) OR list_id IN \\(SELECT list_id FROM list_access WHERE user_id = \\$2\\)\\)").
+		WithArgs(at, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).
+			AddRow([]byte(`{"id":1,"title":"Pay rent","deadline":"2024-09-30","deadline_tz":"Europe/Copenhagen","all_day":true}`)).
+			AddRow([]byte(`{"id":2,"title":"Call mum","done":true}`)))
+
+	todos, err := getTodosAsOf(db, 1, at)
+	assert.NoError(t, err)
+	assert.Len(t, todos, 2)
+	assert.Equal(t, "Pay rent", todos[0].Title)
+	assert.Equal(t, time.Date(2024, time.September, 29, 22, 0, 0, 0, time.UTC), *todos[0].Deadline)
+	assert.True(t, todos[1].Done)
+
+	mock.ExpectQuery("SELECT data FROM todo_version WHERE todo_id = \\$1").
+		WithArgs(3, at).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	_, err = getTodoAsOf(db, 3, at)
+	assert.EqualError(t, err, "no todo found with id 3 at 2024-09-01T00:00:00Z")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
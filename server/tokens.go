@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// APIToken is a long-lived personal token for scripts and integrations. It is used like a
+// session token, as Authorization: Bearer, but carries a scope and an optional expiry.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Token is only filled in on creation; afterwards only its hash exists
+	Token string `json:"token,omitempty"`
+}
+
+// API tokens start with apiTokenPrefix, which tells them apart from session tokens and
+// makes them easy to spot in a leaked config file.
+const apiTokenPrefix = "tdp_"
+
+// Scopes of API tokens. A read token may only make safe requests; a write token may do
+// anything a session can except manage tokens.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+const apiTokenColumns = "id, name, scope, expires_at, last_used_at, created_at"
+
+func (t *APIToken) validate(now time.Time) error {
+	if t.Name == "" {
+		return errors.New("token name must not be empty")
+	}
+	if t.Scope != scopeRead && t.Scope != scopeWrite {
+		return errors.New("scope must be read or write")
+	}
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+// scopeAllows reports whether a request with the given method may be made with a token of
+// the given scope. Sessions have no scope and may make any request.
+func scopeAllows(scope, method string) bool {
+	switch scope {
+	case "", scopeWrite:
+		return true
+	case scopeRead:
+		return method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions
+	}
+	return false
+}
+
+func scanAPIToken(row rowScanner) (APIToken, error) {
+	var t APIToken
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.Name, &t.Scope, &expiresAt, &lastUsedAt, &t.CreatedAt)
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return t, err
+}
+
+// getAPITokens lists a user's tokens, newest first. Expired tokens are listed until revoked.
+func getAPITokens(db *sql.DB, userID int) ([]APIToken, error) {
+	rows, err := db.Query("SELECT "+apiTokenColumns+" FROM api_token WHERE user_id = $1 ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// createAPIToken generates the token, stores its hash and fills in t, including the token itself.
+func createAPIToken(db *sql.DB, userID int, t *APIToken) error {
+	secret, err := newToken()
+	if err != nil {
+		return err
+	}
+	t.Token = apiTokenPrefix + secret
+
+	return db.QueryRow(`INSERT INTO api_token (user_id, name, scope, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`, userID, t.Name, t.Scope, hashToken(t.Token), t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+// revokeAPIToken deletes one of the user's tokens.
+func revokeAPIToken(db *sql.DB, userID, id int) error {
+	res, err := db.Exec("DELETE FROM api_token WHERE id = $1 AND user_id = $2", id, userID)
+	return requireAffected(res, err)
+}
+
+// revokeAllAPITokens deletes every API token of a user, for when the password may have been
+// known to someone else, and records the revocation if there was anything to revoke.
+func revokeAllAPITokens(tx dbtx, userID int, reason string, client clientInfo) error {
+	res, err := tx.Exec("DELETE FROM api_token WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+	return recordSecurityEvent(tx, userID, eventTokenRevoked, fmt.Sprintf("every token (%d) after %s", n, reason), client)
+}
+
+// userForAPIToken returns the user a live API token belongs to and the token's scope, and
+// records that the token was used.
+func userForAPIToken(db *sql.DB, token string) (User, string, error) {
+	var u User
+	var scope string
+	err := db.QueryRow(`WITH used AS (
+			UPDATE api_token SET last_used_at = now()
+			WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > now())
+			RETURNING user_id, scope
+		)
+		SELECT u.id, u.username, u.created_at, used.scope FROM used JOIN app_user u ON u.id = used.user_id`,
+		hashToken(token)).Scan(&u.ID, &u.Username, &u.CreatedAt, &scope)
+	return u, scope, err
+}
+
+// isAPIToken reports whether a bearer token is an API token rather than a session token.
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// sessionOnly keeps API tokens away from routes that only an interactive login may use,
+// such as creating more tokens.
+func sessionOnly(c *fiber.Ctx) error {
+	if scope, _ := c.Locals("scope").(string); scope != "" {
+		return c.Status(fiber.StatusForbidden).SendString("API tokens cannot be used here; log in instead")
+	}
+	return c.Next()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAPIToken(t *testing.T) {
+	now := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	assert.NoError(t, (&APIToken{Name: "backup script", Scope: "read"}).validate(now))
+	assert.NoError(t, (&APIToken{Name: "zapier", Scope: "write", ExpiresAt: &future}).validate(now))
+	assert.EqualError(t, (&APIToken{Scope: "read"}).validate(now), "token name must not be empty")
+	assert.EqualError(t, (&APIToken{Name: "x", Scope: "admin"}).validate(now), "scope must be read or write")
+	assert.EqualError(t, (&APIToken{Name: "x", Scope: "read", ExpiresAt: &past}).validate(now), "expires_at must be in the future")
+}
+
+func TestScopeAllows(t *testing.T) {
+	assert.True(t, scopeAllows("", fiber.MethodDelete))
+	assert.True(t, scopeAllows(scopeWrite, fiber.MethodPost))
+	assert.True(t, scopeAllows(scopeRead, fiber.MethodGet))
+	assert.False(t, scopeAllows(scopeRead, fiber.MethodPatch))
+	assert.False(t, scopeAllows("unknown", fiber.MethodGet))
+}
+
+func TestCreateAPIToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO api_token \\(user_id, name, scope, token_hash, expires_at\\)").
+		WithArgs(1, "backup script", "read", sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, now))
+
+	token := &APIToken{Name: "backup script", Scope: "read"}
+	assert.NoError(t, createAPIToken(db, 1, token))
+	assert.Equal(t, 3, token.ID)
+	assert.True(t, isAPIToken(token.Token))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRequireAuthWithAPIToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	app := fiber.New()
+	app.Use("/api", requireAuth(db))
+	app.Get("/api/todos", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+	app.Post("/api/todos", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusCreated) })
+	app.Post("/api/tokens", sessionOnly, func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusCreated) })
+
+	send := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+	expectToken := func(token, scope string) {
+		mock.ExpectQuery("WITH used AS \\(\\s*UPDATE api_token SET last_used_at = now\\(\\)").
+			WithArgs(hashToken(token)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at", "scope"}).AddRow(1, "alice", time.Now(), scope))
+	}
+
+	expectToken("tdp_reader", scopeRead)
+	assert.Equal(t, fiber.StatusOK, send(http.MethodGet, "/api/todos", "tdp_reader"))
+	expectToken("tdp_reader", scopeRead)
+	assert.Equal(t, fiber.StatusForbidden, send(http.MethodPost, "/api/todos", "tdp_reader"))
+	expectToken("tdp_writer", scopeWrite)
+	assert.Equal(t, fiber.StatusCreated, send(http.MethodPost, "/api/todos", "tdp_writer"))
+	expectToken("tdp_writer", scopeWrite)
+	assert.Equal(t, fiber.StatusForbidden, send(http.MethodPost, "/api/tokens", "tdp_writer"))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Two-factor authentication uses TOTP (RFC 6238) with the parameters every authenticator
+// app supports: HMAC-SHA1, six digits and a 30 second step. A code from the step before or
+// after the current one is accepted to allow for clock drift, and each step can be used
+// only once.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
+// Wrong codes are rate limited per user: after totpMaxFailures in a row, codes are refused
+// for totpLockout, even correct ones.
+const (
+	totpMaxFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+// A login waiting for its second factor must be completed within loginChallengeTTL.
+const loginChallengeTTL = 5 * time.Minute
+
+// recoveryCodeCount is how many single-use recovery codes an enrollment hands out.
+const recoveryCodeCount = 10
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is handed out when 2FA is set up. The secret is only shown here.
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// TwoFactorStatus tells a user whether 2FA is on and how many recovery codes are left.
+type TwoFactorStatus struct {
+	Enabled           bool       `json:"enabled"`
+	EnabledAt         *time.Time `json:"enabled_at"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+}
+
+// TwoFactorChallenge is what login returns instead of a session when the account has 2FA
+// on. The token is exchanged for a session together with a code.
+type TwoFactorChallenge struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// TwoFactorCode is the body of requests that prove possession of the second factor.
+type TwoFactorCode struct {
+	MFAToken string `json:"mfa_token,omitempty"`
+	Code     string `json:"code"`
+}
+
+var (
+	errInvalidCode          = errors.New("wrong or already used code")
+	errTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	errTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	errTwoFactorNotEnrolled = errors.New("start enrollment first")
+	errChallengeExpired     = errors.New("the login has expired; log in again")
+)
+
+// tooManyAttemptsError refuses an attempt while the user is locked out.
+type tooManyAttemptsError struct {
+	until time.Time
+}
+
+func (e tooManyAttemptsError) Error() string {
+	return "too many failed attempts; try again after " + e.until.UTC().Format(time.RFC3339)
+}
+
+// retryAfter is the value of a Retry-After header for the lockout, in whole seconds.
+func (e tooManyAttemptsError) retryAfter(now time.Time) string {
+	return strconv.Itoa(int(e.until.Sub(now).Seconds()) + 1)
+}
+
+// totpCode computes the code for a time step (RFC 4226 with the step as counter).
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// matchTOTP returns the time step a code belongs to, if it is valid around now.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps import, usually as a QR code.
+func provisioningURI(issuer, username, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer) + ":" + url.PathEscape(username) + "?" + q.Encode()
+}
+
+// normalizeRecoveryCode strips the formatting users may or may not type.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes generates codes like "k3j9x-2mq7d"; only their hashes are stored.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// enrollTOTP generates a new secret for the user and keeps it pending until a code from it
+// is confirmed. Enrolling again before confirming replaces the pending secret.
+func enrollTOTP(db *sql.DB, u User) (TOTPEnrollment, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	secret := base32NoPadding.EncodeToString(b)
+
+	res, err := db.Exec(`UPDATE app_user SET totp_secret = $1, totp_last_step = 0
+		WHERE id = $2 AND totp_enabled_at IS NULL`, secret, u.ID)
+	if err := requireAffected(res, err); err == sql.ErrNoRows {
+		return TOTPEnrollment{}, errTwoFactorEnabled
+	} else if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI(getEnv("TOTP_ISSUER", "Todo"), u.Username, secret),
+	}, nil
+}
+
+// confirmTOTP turns 2FA on once the user proves their authenticator produces the right
+// codes, and returns a fresh set of recovery codes.
+func confirmTOTP(db *sql.DB, userID int, code string, now time.Time) ([]string, error) {
+	var enabled bool
+	var secret sql.NullString
+	if err := db.QueryRow("SELECT totp_enabled_at IS NOT NULL, totp_secret FROM app_user WHERE id = $1",
+		userID).Scan(&enabled, &secret); err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, errTwoFactorEnabled
+	}
+	if !secret.Valid {
+		return nil, errTwoFactorNotEnrolled
+	}
+	if err := verifySecondFactor(db, userID, code, false, now); err != nil {
+		return nil, err
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE app_user SET totp_enabled_at = $1 WHERE id = $2", now, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM totp_recovery_code WHERE user_id = $1", userID); err != nil {
+			return err
+		}
+		for _, c := range codes {
+			if _, err := tx.Exec("INSERT INTO totp_recovery_code (user_id, code_hash) VALUES ($1, $2)",
+				userID, hashToken(normalizeRecoveryCode(c))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return codes, err
+}
+
+// getTwoFactorStatus reports the user's 2FA state.
+func getTwoFactorStatus(db *sql.DB, userID int) (TwoFactorStatus, error) {
+	var s TwoFactorStatus
+	var enabledAt sql.NullTime
+	err := db.QueryRow(`SELECT totp_enabled_at, (SELECT count(*) FROM totp_recovery_code WHERE user_id = $1)
+		FROM app_user WHERE id = $1`, userID).Scan(&enabledAt, &s.RecoveryCodesLeft)
+	if enabledAt.Valid {
+		s.Enabled, s.EnabledAt = true, &enabledAt.Time
+	}
+	return s, err
+}
+
+// disableTOTP turns 2FA off after checking a current code or recovery code.
+func disableTOTP(db *sql.DB, userID int, code string, now time.Time) error {
+	var enabled bool
+	if err := db.QueryRow("SELECT totp_enabled_at IS NOT NULL FROM app_user WHERE id = $1", userID).Scan(&enabled); err != nil {
+		return err
+	}
+	if !enabled {
+		return errTwoFactorNotEnabled
+	}
+	if err := verifySecondFactor(db, userID, code, true, now); err != nil {
+		return err
+	}
+	return resetTwoFactor(db, userID)
+}
+
+// resetTwoFactor removes a user's 2FA, including pending logins and any lockout. Admins
+// use it for users who lost both their authenticator and their recovery codes.
+func resetTwoFactor(db *sql.DB, userID int) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE app_user SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0,
+			totp_failures = 0, totp_locked_until = NULL WHERE id = $1`, userID)
+		if err := requireAffected(res, err); err != nil {
+			return err
+		}
+		for _, table := range []string{"totp_recovery_code", "login_challenge"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = $1", userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// verifySecondFactor checks a TOTP code, or a recovery code if allowRecovery, for the
+// user. Wrong codes count towards the lockout; a right one resets the count. The check
+// runs with the user's row locked, so a code cannot be used twice by racing requests.
+func verifySecondFactor(db *sql.DB, userID int, code string, allowRecovery bool, now time.Time) error {
+	var result error
+	err := withTx(db, func(tx *sql.Tx) error {
+		var secret string
+		var lastStep int64
+		var failures int
+		var lockedUntil sql.NullTime
+		err := tx.QueryRow(`SELECT totp_secret, totp_last_step, totp_failures, totp_locked_until
+			FROM app_user WHERE id = $1 AND totp_secret IS NOT NULL FOR UPDATE`, userID).
+			Scan(&secret, &lastStep, &failures, &lockedUntil)
+		if err == sql.ErrNoRows {
+			result = errTwoFactorNotEnabled
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(now) {
+			result = tooManyAttemptsError{until: lockedUntil.Time}
+			return nil
+		}
+
+		key, err := base32NoPadding.DecodeString(secret)
+		if err != nil {
+			return err
+		}
+		if step, ok := matchTOTP(key, strings.TrimSpace(code), now); ok && step > lastStep {
+			_, err := tx.Exec("UPDATE app_user SET totp_last_step = $1, totp_failures = 0 WHERE id = $2", step, userID)
+			return err
+		}
+		if allowRecovery {
+			res, err := tx.Exec("DELETE FROM totp_recovery_code WHERE user_id = $1 AND code_hash = $2",
+				userID, hashToken(normalizeRecoveryCode(code)))
+			if err := requireAffected(res, err); err == nil {
+				_, err := tx.Exec("UPDATE app_user SET totp_failures = 0 WHERE id = $1", userID)
+				return err
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		// The failure has to be committed, so it is reported outside the transaction
+		result = errInvalidCode
+		failures++
+		if failures < totpMaxFailures {
+			_, err = tx.Exec("UPDATE app_user SET totp_failures = $1 WHERE id = $2", failures, userID)
+			return err
+		}
+		_, err = tx.Exec("UPDATE app_user SET totp_failures = 0, totp_locked_until = $1 WHERE id = $2",
+			now.Add(totpLockout), userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// startTwoFactorLogin is the first half of a login with 2FA: the password was right, and
+// the returned challenge can be exchanged for a session with a code.
+func startTwoFactorLogin(db dbtx, u User) (TwoFactorChallenge, error) {
+	ch := TwoFactorChallenge{MFARequired: true}
+	var err error
+	if ch.MFAToken, err = newToken(); err != nil {
+		return ch, err
+	}
+	err = db.QueryRow("INSERT INTO login_challenge (token_hash, user_id, expires_at) VALUES ($1, $2, $3) RETURNING expires_at",
+		hashToken(ch.MFAToken), u.ID, time.Now().Add(loginChallengeTTL)).Scan(&ch.ExpiresAt)
+	return ch, err
+}
+
+// finishTwoFactorLogin exchanges a login challenge and a code for a session. The challenge
+// survives wrong codes until it expires; the lockout keeps guessing in check. It stays locked
+// until the session is created, so racing requests with it get one session between them.
+func finishTwoFactorLogin(db *sql.DB, req TwoFactorCode, client clientInfo, now time.Time) (Session, error) {
+	var u User
+	var s Session
+	err := withTx(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT u.id, u.username, u.created_at FROM login_challenge c JOIN app_user u ON u.id = c.user_id
+			WHERE c.token_hash = $1 AND c.expires_at > $2 FOR UPDATE OF c`, hashToken(req.MFAToken), now).Scan(&u.ID, &u.Username, &u.CreatedAt)
+		if err == sql.ErrNoRows {
+			return errChallengeExpired
+		}
+		if err != nil {
+			return err
+		}
+
+		// Checked in a transaction of its own, so a wrong code counts towards the lockout
+		// even though the challenge is kept
+		if err := verifySecondFactor(db, u.ID, req.Code, true, now); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM login_challenge WHERE token_hash = $1 OR expires_at <= $2",
+			hashToken(req.MFAToken), now); err != nil {
+			return err
+		}
+		s, err = createSession(tx, u)
+		return err
+	})
+	if err == errInvalidCode {
+		if err := recordSecurityEvent(db, u.ID, eventTwoFactorFailed, "", client); err != nil {
+			return Session{}, err
+		}
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return s, recordSecurityEvent(db, u.ID, eventLogin, "with two-factor authentication", client)
+}
+
+// requireAdmin lets only admins through. It must run after requireAuth.
+func requireAdmin(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var admin bool
+		err := db.QueryRow("SELECT is_admin FROM app_user WHERE id = $1", userFromRequest(c)).Scan(&admin)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(500).SendString("Failed to authenticate")
+		}
+		if !admin {
+			return c.Status(fiber.StatusForbidden).SendString("admins only")
+		}
+		return c.Next()
+	}
+}
+
+// sendSecondFactorError maps the errors of verifySecondFactor and its callers to responses.
+func sendSecondFactorError(c *fiber.Ctx, err error) error {
+	var locked tooManyAttemptsError
+	switch {
+	case errors.As(err, &locked):
+		c.Set(fiber.HeaderRetryAfter, locked.retryAfter(time.Now()))
+		return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+	case err == errInvalidCode, err == errChallengeExpired:
+		return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+	case err == errTwoFactorEnabled:
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case err == errTwoFactorNotEnabled, err == errTwoFactorNotEnrolled:
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	return c.Status(500).SendString("Failed to check the code")
+}
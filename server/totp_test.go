@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors for SHA1, truncated to six digits
+	secret := []byte("12345678901234567890")
+	assert.Equal(t, "287082", totpCode(secret, 59/30))
+	assert.Equal(t, "081804", totpCode(secret, 1111111109/30))
+	assert.Equal(t, "050471", totpCode(secret, 1111111111/30))
+	assert.Equal(t, "005924", totpCode(secret, 1234567890/30))
+
+	now := time.Unix(1111111109, 0)
+	step, ok := matchTOTP(secret, "081804", now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1111111109/30), step)
+	_, ok = matchTOTP(secret, "081804", now.Add(30*time.Second))
+	assert.True(t, ok, "The previous step should still be accepted")
+	_, ok = matchTOTP(secret, "081804", now.Add(90*time.Second))
+	assert.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(provisioningURI("Todo", "alice", "JBSWY3DPEHPK3PXP"))
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Todo:alice", uri.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	assert.Equal(t, "Todo", uri.Query().Get("issuer"))
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	assert.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, codes[0])
+	assert.NotEqual(t, codes[0], codes[1])
+	assert.Equal(t, "k3j9x2mq7d", normalizeRecoveryCode("K3J9X-2MQ7D "))
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // base32 of 12345678901234567890
+	now := time.Unix(1111111109, 0)
+	userRow := func(lastStep int64, failures int, lockedUntil any) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"totp_secret", "totp_last_step", "totp_failures", "totp_locked_until"}).
+			AddRow(secret, lastStep, failures, lockedUntil)
+	}
+	const selectUser = "SELECT totp_secret, totp_last_step, totp_failures, totp_locked_until\\s+FROM app_user WHERE id = \\$1 AND totp_secret IS NOT NULL FOR UPDATE"
+
+	// A right code is accepted and its step remembered
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectUser).WithArgs(1).WillReturnRows(userRow(0, 2, nil))
+	mock.ExpectExec("UPDATE app_user SET totp_last_step = \\$1, totp_failures = 0 WHERE id = \\$2").
+		WithArgs(int64(1111111109/30), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, verifySecondFactor(db, 1, "081804", false, now))
+
+	// The same code cannot be used twice
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectUser).WithArgs(1).WillReturnRows(userRow(1111111109/30, 0, nil))
+	mock.ExpectExec("UPDATE app_user SET totp_failures = \\$1 WHERE id = \\$2").
+		WithArgs(1, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Equal(t, errInvalidCode, verifySecondFactor(db, 1, "081804", false, now))
+
+	// A recovery code is used up
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectUser).WithArgs(1).WillReturnRows(userRow(0, 0, nil))
+	mock.ExpectExec("DELETE FROM totp_recovery_code WHERE user_id = \\$1 AND code_hash = \\$2").
+		WithArgs(1, hashToken("k3j9x2mq7d")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE app_user SET totp_failures = 0 WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, verifySecondFactor(db, 1, "K3J9X-2MQ7D", true, now))
+
+	// The last failure before the limit locks the user out
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectUser).WithArgs(1).WillReturnRows(userRow(0, totpMaxFailures-1, nil))
+	mock.ExpectExec("UPDATE app_user SET totp_failures = 0, totp_locked_until = \\$1 WHERE id = \\$2").
+		WithArgs(now.Add(totpLockout), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Equal(t, errInvalidCode, verifySecondFactor(db, 1, "000000", false, now))
+
+	// While locked out even a right code is refused
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectUser).WithArgs(1).WillReturnRows(userRow(0, 0, now.Add(totpLockout)))
+	mock.ExpectCommit()
+	err = verifySecondFactor(db, 1, "081804", false, now)
+	assert.Equal(t, tooManyAttemptsError{until: now.Add(totpLockout)}, err)
+	assert.Equal(t, "901", err.(tooManyAttemptsError).retryAfter(now))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginWithTwoFactor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash, err := hashPassword("correct horse")
+	assert.NoError(t, err)
+	expires := time.Now().Add(loginChallengeTTL)
+
+	mock.ExpectQuery("SELECT id, username, created_at, password_hash, totp_enabled_at IS NOT NULL").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at", "password_hash", "two_factor", "failed_logins", "locked_until"}).
+			AddRow(1, "alice", time.Now(), hash, true, 0, nil))
+	mock.ExpectQuery("INSERT INTO login_challenge \\(token_hash, user_id, expires_at\\)").
+		WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"expires_at"}).AddRow(expires))
+
+	session, challenge, err := login(db, Credentials{Username: "alice", Password: "correct horse"}, clientInfo{})
+	assert.NoError(t, err)
+	assert.Empty(t, session.Token, "No session before the second factor")
+	assert.True(t, challenge.MFARequired)
+	assert.NotEmpty(t, challenge.MFAToken)
+
+	now := time.Now()
+	const selectChallenge = "FROM login_challenge c JOIN app_user u ON u.id = c.user_id\\s+WHERE c.token_hash = \\$1 AND c.expires_at > \\$2 FOR UPDATE OF c"
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectChallenge).
+		WithArgs(hashToken("stale"), now).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}))
+	mock.ExpectRollback()
+	_, err = finishTwoFactorLogin(db, TwoFactorCode{MFAToken: "stale", Code: "123456"}, clientInfo{}, now)
+	assert.Equal(t, errChallengeExpired, err)
+
+	// The challenge is locked while the code is checked and used up with the session created
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	codeTime := time.Unix(1111111109, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectChallenge).
+		WithArgs(hashToken(challenge.MFAToken), codeTime).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at"}).AddRow(1, "alice", now))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT totp_secret, (.+) FROM app_user WHERE id = \\$1 AND totp_secret IS NOT NULL FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_last_step", "totp_failures", "totp_locked_until"}).AddRow(secret, 0, 0, nil))
+	mock.ExpectExec("UPDATE app_user SET totp_last_step = \\$1, totp_failures = 0 WHERE id = \\$2").
+		WithArgs(int64(1111111109/30), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("DELETE FROM login_challenge WHERE token_hash = \\$1 OR expires_at <= \\$2").
+		WithArgs(hashToken(challenge.MFAToken), codeTime).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO user_session").
+		WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"expires_at"}).AddRow(now.Add(sessionTTL())))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO security_event").
+		WithArgs(1, eventLogin, "with two-factor authentication", "", "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	session, err = finishTwoFactorLogin(db, TwoFactorCode{MFAToken: challenge.MFAToken, Code: "081804"}, clientInfo{}, codeTime)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, session.Token)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+func getTrashedTodos(db *sql.DB, owner int) ([]Todo, error) {
+	rows, err := db.Query("SELECT "+todoColumns+" FROM todo WHERE deleted_at IS NOT NULL AND "+visibleTo(1)+" ORDER BY deleted_at DESC, id", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTodos(rows)
+}
+
+func restoreTodo(db dbtx, id int) error {
+	res, err := db.Exec("UPDATE todo SET deleted_at=NULL, updated_at=now() WHERE id=$1 AND deleted_at IS NOT NULL", id)
+	return requireAffected(res, err)
+}
+
+// purgeTodo permanently deletes a single todo from the trash.
+func purgeTodo(db dbtx, id int) error {
+	res, err := db.Exec("DELETE FROM todo WHERE id=$1 AND deleted_at IS NOT NULL", id)
+	return requireAffected(res, err)
+}
+
+// purgeTrash permanently deletes the todos the owner may edit that were trashed before
+// cutoff and reports how many were removed. Owner 0 empties everyone's trash.
+func purgeTrash(db *sql.DB, owner int, cutoff time.Time) (int64, error) {
+	if eventSourced() {
+		return purgeTrashLogged(db, owner, cutoff)
+	}
+
+	res, err := db.Exec("DELETE FROM todo WHERE deleted_at < $1 AND ($2::int = 0 OR "+editableBy(2)+")", cutoff, owner)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runTrashPurger empties todos that have been in the trash longer than TRASH_RETENTION
+// (30 days by default), checking once an hour. It never returns.
+func runTrashPurger(db *sql.DB) {
+	retention := getEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+
+	for {
+		n, err := purgeTrash(db, 0, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("failed to purge trash: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d todos from the trash", n)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreTodo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE todo SET deleted_at=NULL, updated_at=now\\(\\) WHERE id=\\$1 AND deleted_at IS NOT NULL").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, restoreTodo(db, 1))
+
+	// Not in the trash, or no such todo
+	mock.ExpectExec("UPDATE todo SET deleted_at=NULL").
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, sql.ErrNoRows, restoreTodo(db, 2))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeTodo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM todo WHERE id=\\$1 AND deleted_at IS NOT NULL").
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, sql.ErrNoRows, purgeTodo(db, 3), "Todos outside the trash must not be purged")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	cutoff := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("DELETE FROM todo WHERE deleted_at < \\$1 AND \\(\\$2::int = 0 OR \\(\\(owner_id = \\$2 (.+) role <> 'viewer'\\)\\)\\)").
+		WithArgs(cutoff, 0).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	n, err := purgeTrash(db, 0, cutoff)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
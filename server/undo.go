@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Changes that can be undone. Undo and redo themselves are recorded in the history but
+// never pushed, and a purge is final.
+var undoableActions = map[string]bool{
+	"create":     true,
+	"update":     true,
+	"toggle":     true,
+	"delete":     true,
+	"restore":    true,
+	"move":       true,
+	"transition": true,
+}
+
+var (
+	errNothingToUndo = errors.New("nothing to undo")
+	errNothingToRedo = errors.New("nothing to redo")
+	errUndoForbidden = errors.New("you can no longer edit this todo, so the change cannot be reverted")
+)
+
+// undoConflictError means the todo was changed after the change being undone or redone.
+type undoConflictError struct {
+	todoID int
+}
+
+func (e undoConflictError) Error() string {
+	return fmt.Sprintf("todo %d has been modified since, so the change can no longer be reverted", e.todoID)
+}
+
+// UndoResult describes the change that was reverted or reapplied and the todo as it is now.
+type UndoResult struct {
+	HistoryID int64  `json:"history_id"`
+	TodoID    int    `json:"todo_id"`
+	Action    string `json:"action"`
+	Todo      *Todo  `json:"todo"`
+}
+
+// undoLimit is how many changes each user can undo.
+func undoLimit() int {
+	return getEnvInt("UNDO_LIMIT", 20)
+}
+
+// pushUndo puts a change on top of the user's undo stack, dropping the oldest entries beyond undoLimit.
+func pushUndo(tx dbtx, userID int, historyID int64) error {
+	// A new change forks history, so nothing undone before it can be redone
+	if _, err := tx.Exec("DELETE FROM undo_stack WHERE user_id = $1 AND undone_at IS NOT NULL", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO undo_stack (user_id, history_id) VALUES ($1, $2)", userID, historyID); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`DELETE FROM undo_stack WHERE user_id = $1 AND undone_at IS NULL AND id NOT IN (
+			SELECT id FROM undo_stack WHERE user_id = $1 AND undone_at IS NULL ORDER BY id DESC LIMIT $2
+		)`, userID, undoLimit())
+	return err
+}
+
+// undo reverts the user's most recent change that has not been undone yet. actor names the
+// user in the history.
+func undo(db *sql.DB, actor string, userID int) (UndoResult, error) {
+	return travel(db, actor, userID, true)
+}
+
+// redo reapplies the change the user undid most recently.
+func redo(db *sql.DB, actor string, userID int) (UndoResult, error) {
+	return travel(db, actor, userID, false)
+}
+
+// travel undoes or redoes a change. The user may have lost access to the todo or its list
+// since making the change, so they must still be able to edit the todo where it is now and
+// where the change puts it.
+func travel(db *sql.DB, actor string, userID int, backwards bool) (UndoResult, error) {
+	query := `SELECT s.id, h.id, h.todo_id, h.action, h.before, h.after
+		FROM undo_stack s JOIN todo_history h ON h.id = s.history_id
+		WHERE s.user_id = $1 AND s.undone_at IS NULL ORDER BY s.id DESC LIMIT 1 FOR UPDATE OF s`
+	action, empty := "undo", errNothingToUndo
+	if !backwards {
+		query = `SELECT s.id, h.id, h.todo_id, h.action, h.before, h.after
+		FROM undo_stack s JOIN todo_history h ON h.id = s.history_id
+		WHERE s.user_id = $1 AND s.undone_at IS NOT NULL ORDER BY s.undone_at DESC, s.id LIMIT 1 FOR UPDATE OF s`
+		action, empty = "redo", errNothingToRedo
+	}
+
+	var result UndoResult
+	err := withTx(db, func(tx *sql.Tx) error {
+		var stackID int64
+		var before, after []byte
+		err := tx.QueryRow(query, userID).Scan(&stackID, &result.HistoryID, &result.TodoID, &result.Action, &before, &after)
+		if err == sql.ErrNoRows {
+			return empty
+		}
+		if err != nil {
+			return err
+		}
+
+		from, to := before, after
+		if backwards {
+			from, to = after, before
+		}
+
+		current, err := lockTodo(tx, result.TodoID)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			role, err := todoRole(tx, userID, result.TodoID)
+			if err != nil {
+				return err
+			}
+			if !roleAtLeast(role, roleEditor) {
+				return errUndoForbidden
+			}
+		}
+		if same, err := sameSnapshot(current, from); err != nil || !same {
+			if err == nil {
+				err = undoConflictError{result.TodoID}
+			}
+			return err
+		}
+
+		target, err := decodeSnapshot(to)
+		if err != nil {
+			return err
+		}
+		if target != nil && (current == nil || target.ListID != current.ListID) {
+			switch err := checkListWritable(tx, userID, target.ListID); {
+			case err == sql.ErrNoRows || err == errListReadOnly:
+				return errUndoForbidden
+			case err != nil:
+				return err
+			}
+		}
+		if err := writeSnapshot(tx, result.TodoID, target); err != nil {
+			return err
+		}
+
+		if result.Todo, err = lockTodo(tx, result.TodoID); err != nil {
+			return err
+		}
+		if _, err := recordHistory(tx, result.TodoID, actor, action, current, result.Todo); err != nil {
+			return err
+		}
+
+		var undoneAt any
+		if backwards {
+			undoneAt = time.Now()
+		}
+		_, err = tx.Exec("UPDATE undo_stack SET undone_at = $1 WHERE id = $2", undoneAt, stackID)
+		return err
+	})
+	return result, err
+}
+
+// sameSnapshot reports whether todo still matches a recorded snapshot, ignoring updated_at.
+func sameSnapshot(todo *Todo, recorded []byte) (bool, error) {
+	if todo == nil || recorded == nil {
+		return todo == nil && recorded == nil, nil
+	}
+
+	current, err := snapshot(todo)
+	if err != nil {
+		return false, err
+	}
+	changes, err := diffSnapshots(current, recorded)
+	return len(changes) == 0, err
+}
+
+func decodeSnapshot(b []byte) (*Todo, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	var todo Todo
+	if err := json.Unmarshal(b, &todo); err != nil {
+		return nil, err
+	}
+	// Snapshots carry their own zone, so the fallback is never used for them
+	if err := normalizeDeadline(&todo, time.UTC); err != nil {
+		return nil, err
+	}
+	return &todo, nil
+}
+
+// writeSnapshot makes the stored row match todo, recreating or removing it as needed.
+func writeSnapshot(tx dbtx, id int, todo *Todo) error {
+	if todo == nil {
+		_, err := tx.Exec("DELETE FROM todo WHERE id = $1", id)
+		return err
+	}
+
+	_, err := tx.Exec(`INSERT INTO todo (id, title, text, iscompleted, category, deadline, deadline_tz, all_day, priority,
+			created_at, updated_at, completed_at, deleted_at, rank, list_id, state, owner_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, now(), $11, $12, $13, COALESCE(NULLIF($14, 0), `+defaultList+`), NULLIF($15, ''),
+			NULLIF($16, 0))
+		ON CONFLICT (id) DO UPDATE SET title = EXCLUDED.title, text = EXCLUDED.text, iscompleted = EXCLUDED.iscompleted,
+			category = EXCLUDED.category, deadline = EXCLUDED.deadline, deadline_tz = EXCLUDED.deadline_tz,
+			all_day = EXCLUDED.all_day, priority = EXCLUDED.priority, created_at = EXCLUDED.created_at,
+			updated_at = now(), completed_at = EXCLUDED.completed_at, deleted_at = EXCLUDED.deleted_at, rank = EXCLUDED.rank,
+			list_id = EXCLUDED.list_id, state = EXCLUDED.state`,
+		id, todo.Title, todo.Body, todo.Done, todo.Category, todo.Deadline, todo.DeadlineTZ, todo.AllDay, todo.Priority,
+		todo.CreatedAt, todo.CompletedAt, todo.DeletedAt, todo.Rank, todo.ListID, todo.State, todo.OwnerID)
+	return err
+}
+
+func respondUndo(c *fiber.Ctx, result UndoResult, err error) error {
+	var conflict undoConflictError
+	switch {
+	case err == errNothingToUndo || err == errNothingToRedo:
+		return c.Status(fiber.StatusNotFound).SendString(err.Error())
+	case err == errUndoForbidden:
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	case errors.As(err, &conflict):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case err != nil:
+		return c.Status(500).SendString("Failed to revert change")
+	}
+
+	return c.JSON(result)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeSnapshotRoundTrip(t *testing.T) {
+	zone := "Europe/Copenhagen"
+	category := "Home"
+	deadline := time.Date(2024, time.September, 30, 22, 0, 0, 0, time.UTC)
+	created := time.Date(2024, time.September, 1, 8, 0, 0, 0, time.UTC)
+	original := Todo{
+		ID: 3, Title: "Water plants", Body: "All of them, twice", Category: &category,
+		Deadline: &deadline, DeadlineTZ: &zone, AllDay: true, CreatedAt: created, UpdatedAt: created,
+	}
+
+	b, err := snapshot(&original)
+	assert.NoError(t, err)
+
+	decoded, err := decodeSnapshot(b)
+	assert.NoError(t, err)
+	assert.Equal(t, deadline, *decoded.Deadline)
+	assert.True(t, decoded.AllDay)
+	assert.Equal(t, zone, *decoded.DeadlineTZ)
+	assert.True(t, created.Equal(decoded.CreatedAt))
+
+	same, err := sameSnapshot(decoded, b)
+	assert.NoError(t, err)
+	assert.True(t, same)
+
+	decoded.Title = "Water some plants"
+	same, err = sameSnapshot(decoded, b)
+	assert.NoError(t, err)
+	assert.False(t, same)
+
+	// A missing row only matches a missing snapshot
+	same, _ = sameSnapshot(nil, nil)
+	assert.True(t, same)
+	same, _ = sameSnapshot(nil, b)
+	assert.False(t, same)
+}
+
+func TestUndoNothingToUndo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM undo_stack s JOIN todo_history h (.+) AND s.undone_at IS NULL").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "todo_id", "action", "before", "after"}))
+	mock.ExpectRollback()
+
+	_, err = undo(db, "alice", 1)
+	assert.Equal(t, errNothingToUndo, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUndoConflict(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	after, err := snapshot(&Todo{ID: 1, Title: "Renamed by alice", Body: "Some description", ListID: 1, CreatedAt: fixedTime, UpdatedAt: fixedTime})
+	assert.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM undo_stack s JOIN todo_history h").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "todo_id", "action", "before", "after"}).
+			AddRow(5, 9, 1, "update", []byte(`{"id":1,"title":"Original"}`), after))
+	// Bob renamed the todo again after alice's change
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Renamed by bob", "Some description", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 1, nil, nil))
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) FROM todo t JOIN todo_list l").
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("editor"))
+	mock.ExpectRollback()
+
+	_, err = undo(db, "alice", 1)
+	assert.Equal(t, undoConflictError{todoID: 1}, err)
+	assert.EqualError(t, err, "todo 1 has been modified since, so the change can no longer be reverted")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUndoRevertsUpdate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	before, _ := snapshot(&Todo{ID: 1, Title: "Original", Body: "Some description", ListID: 1, CreatedAt: fixedTime, UpdatedAt: fixedTime})
+	after, _ := snapshot(&Todo{ID: 1, Title: "Renamed", Body: "Some description", ListID: 1, CreatedAt: fixedTime, UpdatedAt: fixedTime})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM undo_stack s JOIN todo_history h").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "todo_id", "action", "before", "after"}).
+			AddRow(5, 9, 1, "update", before, after))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Renamed", "Some description", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 1, nil, nil))
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) FROM todo t JOIN todo_list l").
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("editor"))
+	mock.ExpectExec("INSERT INTO todo \\(id, (.+) ON CONFLICT \\(id\\) DO UPDATE").
+		WithArgs(1, "Original", "Some description", false, nil, nil, nil, false, nil, fixedTime, nil, nil, "", 1, "", 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Original", "Some description", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 1, nil, nil))
+	mock.ExpectQuery("INSERT INTO todo_history").
+		WithArgs(1, "undo", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	mock.ExpectExec("UPDATE todo_version SET valid_to = now\\(\\)").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO todo_version \\(todo_id, valid_from, data, owner_id\\) VALUES \\(\\$1, now\\(\\), \\$2, NULLIF\\(\\$3, 0\\)\\)").
+		WithArgs(1, sqlmock.AnyArg(), 0).
+		WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectExec("UPDATE undo_stack SET undone_at = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	result, err := undo(db, "alice", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), result.HistoryID)
+	assert.Equal(t, "update", result.Action)
+	assert.Equal(t, "Original", result.Todo.Title)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUndoForbiddenAfterLosingAccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	before, _ := snapshot(&Todo{ID: 1, Title: "Original", ListID: 2, CreatedAt: fixedTime, UpdatedAt: fixedTime})
+	after, _ := snapshot(&Todo{ID: 1, Title: "Renamed", ListID: 2, CreatedAt: fixedTime, UpdatedAt: fixedTime})
+
+	// Alice has since been made a viewer of the list
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM undo_stack s JOIN todo_history h").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "todo_id", "action", "before", "after"}).
+			AddRow(5, 9, 1, "update", before, after))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Renamed", "", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 2, nil, nil))
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) FROM todo t JOIN todo_list l").
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("viewer"))
+	mock.ExpectRollback()
+
+	_, err = undo(db, "alice", 1)
+	assert.Equal(t, errUndoForbidden, err)
+
+	// Redoing a move needs write access to the list the todo goes back to
+	moved, _ := snapshot(&Todo{ID: 1, Title: "Renamed", ListID: 3, CreatedAt: fixedTime, UpdatedAt: fixedTime})
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM undo_stack s JOIN todo_history h (.+) AND s.undone_at IS NOT NULL").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "id", "todo_id", "action", "before", "after"}).
+			AddRow(6, 10, 1, "move", after, moved))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE id = \\$1 FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(todoRows().AddRow(1, "Renamed", "", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, nil, 2, nil, nil))
+	mock.ExpectQuery("SELECT CASE WHEN l.owner_id IS NULL (.+) FROM todo t JOIN todo_list l").
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("owner"))
+	mock.ExpectQuery("SELECT list_role\\(id, \\$2\\) FROM todo_list WHERE id = \\$1").
+		WithArgs(3, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"list_role"}).AddRow(nil))
+	mock.ExpectRollback()
+
+	_, err = redo(db, "alice", 1)
+	assert.Equal(t, errUndoForbidden, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Every todo is in one of its list's workflow states. A list without states of its own
+// uses defaultWorkflow. Done is derived from the state: the todo_sync_state trigger (see
+// schema.go) keeps iscompleted in line with the state, and moves the todo to the first done
+// or not-done state when something only changes iscompleted, like toggling.
+
+// WorkflowState is a column on the board. Done states count as completed.
+type WorkflowState struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	Done bool   `json:"done"`
+}
+
+type WorkflowTransition struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Workflow is the ordered states of a list and the moves allowed between them.
+type Workflow struct {
+	States      []WorkflowState      `json:"states"`
+	Transitions []WorkflowTransition `json:"transitions"`
+	// Default is true when the list has no workflow of its own
+	Default bool `json:"default"`
+}
+
+// BoardColumn is a state with the todos in it, in rank order.
+type BoardColumn struct {
+	WorkflowState
+	Todos []Todo `json:"todos"`
+}
+
+// defaultWorkflow must stay in line with the fallback keys in the todo_sync_state trigger.
+var defaultWorkflow = Workflow{
+	States: []WorkflowState{
+		{Key: "backlog", Name: "Backlog"},
+		{Key: "in_progress", Name: "In Progress"},
+		{Key: "review", Name: "Review"},
+		{Key: "done", Name: "Done", Done: true},
+	},
+	Transitions: []WorkflowTransition{
+		{From: "backlog", To: "in_progress"},
+		{From: "in_progress", To: "backlog"},
+		{From: "in_progress", To: "review"},
+		{From: "review", To: "in_progress"},
+		{From: "review", To: "done"},
+		{From: "done", To: "in_progress"},
+	},
+	Default: true,
+}
+
+var stateKeyPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// errUnknownState and transitionError are returned by transitionTodo.
+var errUnknownState = errors.New("no such state in this list's workflow")
+
+type transitionError struct {
+	from, to string
+}
+
+func (e transitionError) Error() string {
+	return fmt.Sprintf("cannot move a todo from %s to %s", e.from, e.to)
+}
+
+func (w Workflow) state(key string) (WorkflowState, bool) {
+	for _, s := range w.States {
+		if s.Key == key {
+			return s, true
+		}
+	}
+	return WorkflowState{}, false
+}
+
+func (w Workflow) allows(from, to string) bool {
+	for _, t := range w.Transitions {
+		if t.From == from && t.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a workflow sent by a client: unique, well-formed keys, at least one done
+// and one open state, and transitions only between known states.
+func (w Workflow) validate() error {
+	if len(w.States) == 0 {
+		return errors.New("a workflow needs states")
+	}
+
+	seen := map[string]bool{}
+	var open, done bool
+	for _, s := range w.States {
+		if !stateKeyPattern.MatchString(s.Key) {
+			return fmt.Errorf("state key %q must be 1-32 lowercase letters, digits or underscores", s.Key)
+		}
+		if seen[s.Key] {
+			return fmt.Errorf("state key %q is used twice", s.Key)
+		}
+		if s.Name == "" {
+			return fmt.Errorf("state %q needs a name", s.Key)
+		}
+		seen[s.Key] = true
+		open = open || !s.Done
+		done = done || s.Done
+	}
+	if !open || !done {
+		return errors.New("a workflow needs at least one open and one done state")
+	}
+
+	for _, t := range w.Transitions {
+		if !seen[t.From] || !seen[t.To] {
+			return fmt.Errorf("transition from %q to %q refers to an unknown state", t.From, t.To)
+		}
+		if t.From == t.To {
+			return fmt.Errorf("transition from %q to itself is not allowed", t.From)
+		}
+	}
+	return nil
+}
+
+// getWorkflow returns the list's own workflow, or the default one if it has none.
+func getWorkflow(db dbtx, listID int) (Workflow, error) {
+	rows, err := db.Query("SELECT key, name, is_done FROM workflow_state WHERE list_id = $1 ORDER BY position", listID)
+	if err != nil {
+		return Workflow{}, err
+	}
+	w := Workflow{States: []WorkflowState{}, Transitions: []WorkflowTransition{}}
+	for rows.Next() {
+		var s WorkflowState
+		if err := rows.Scan(&s.Key, &s.Name, &s.Done); err != nil {
+			rows.Close()
+			return Workflow{}, err
+		}
+		w.States = append(w.States, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Workflow{}, err
+	}
+	if len(w.States) == 0 {
+		return defaultWorkflow, nil
+	}
+
+	rows, err = db.Query("SELECT from_key, to_key FROM workflow_transition WHERE list_id = $1 ORDER BY from_key, to_key", listID)
+	if err != nil {
+		return Workflow{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t WorkflowTransition
+		if err := rows.Scan(&t.From, &t.To); err != nil {
+			return Workflow{}, err
+		}
+		w.Transitions = append(w.Transitions, t)
+	}
+	return w, rows.Err()
+}
+
+// setWorkflow replaces a list's workflow; a workflow without states reverts the list to the
+// default one. Todos in a state that no longer exists fall back to the first done or open
+// state, whichever matches them.
+func setWorkflow(db *sql.DB, listID int, w Workflow) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM workflow_transition WHERE list_id = $1", listID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM workflow_state WHERE list_id = $1", listID); err != nil {
+			return err
+		}
+
+		for i, s := range w.States {
+			_, err := tx.Exec("INSERT INTO workflow_state (list_id, key, name, is_done, position) VALUES ($1, $2, $3, $4, $5)",
+				listID, s.Key, s.Name, s.Done, i)
+			if err != nil {
+				return err
+			}
+		}
+		for _, t := range w.Transitions {
+			_, err := tx.Exec(`INSERT INTO workflow_transition (list_id, from_key, to_key) VALUES ($1, $2, $3)
+				ON CONFLICT DO NOTHING`, listID, t.From, t.To)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Rewriting the state runs it past todo_sync_state again, which moves todos out of
+		// removed states and updates done for states that changed sides
+		_, err := tx.Exec("UPDATE todo SET state = state WHERE list_id = $1", listID)
+		return err
+	})
+}
+
+// transitionTodo moves a todo to another state of its list's workflow, if the workflow allows it.
+func transitionTodo(db dbtx, id int, to string) error {
+	var from string
+	var listID int
+	err := db.QueryRow("SELECT state, list_id FROM todo WHERE id = $1 AND deleted_at IS NULL", id).Scan(&from, &listID)
+	if err != nil {
+		return err
+	}
+
+	w, err := getWorkflow(db, listID)
+	if err != nil {
+		return err
+	}
+	if _, ok := w.state(to); !ok {
+		return errUnknownState
+	}
+	if !w.allows(from, to) {
+		return transitionError{from, to}
+	}
+
+	_, err = db.Exec("UPDATE todo SET state=$1, updated_at=now() WHERE id=$2", to, id)
+	return err
+}
+
+// getBoard groups the owner's todos in a list by workflow state.
+func getBoard(db *sql.DB, owner, listID int) ([]BoardColumn, error) {
+	w, err := getWorkflow(db, listID)
+	if err != nil {
+		return nil, err
+	}
+
+	todos, err := getAllTodos(db, todoQuery{owner: owner, listID: listID, sort: "rank"})
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]BoardColumn, len(w.States))
+	index := map[string]int{}
+	for i, s := range w.States {
+		columns[i] = BoardColumn{WorkflowState: s, Todos: []Todo{}}
+		index[s.Key] = i
+	}
+	for _, todo := range todos {
+		if i, ok := index[todo.State]; ok {
+			columns[i].Todos = append(columns[i].Todos, todo)
+		}
+	}
+	return columns, nil
+}
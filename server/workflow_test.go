@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateWorkflow(t *testing.T) {
+	assert.NoError(t, defaultWorkflow.validate())
+	assert.EqualError(t, Workflow{}.validate(), "a workflow needs states")
+
+	open := WorkflowState{Key: "todo", Name: "To do"}
+	done := WorkflowState{Key: "shipped", Name: "Shipped", Done: true}
+	assert.EqualError(t, Workflow{States: []WorkflowState{open}}.validate(), "a workflow needs at least one open and one done state")
+	assert.EqualError(t, Workflow{States: []WorkflowState{open, open, done}}.validate(), `state key "todo" is used twice`)
+	assert.EqualError(t, Workflow{States: []WorkflowState{{Key: "To Do", Name: "x"}, done}}.validate(),
+		`state key "To Do" must be 1-32 lowercase letters, digits or underscores`)
+	assert.EqualError(t, Workflow{States: []WorkflowState{open, done},
+		Transitions: []WorkflowTransition{{From: "todo", To: "review"}}}.validate(),
+		`transition from "todo" to "review" refers to an unknown state`)
+	assert.NoError(t, Workflow{States: []WorkflowState{open, done},
+		Transitions: []WorkflowTransition{{From: "todo", To: "shipped"}}}.validate())
+}
+
+func TestTransitionTodo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectTodo := func(state string) {
+		mock.ExpectQuery("SELECT state, list_id FROM todo WHERE id = \\$1 AND deleted_at IS NULL").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"state", "list_id"}).AddRow(state, 1))
+		mock.ExpectQuery("SELECT key, name, is_done FROM workflow_state WHERE list_id = \\$1").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"key", "name", "is_done"}))
+	}
+
+	expectTodo("backlog")
+	assert.Equal(t, errUnknownState, transitionTodo(db, 1, "shipped"))
+
+	expectTodo("backlog")
+	assert.EqualError(t, transitionTodo(db, 1, "done"), "cannot move a todo from backlog to done")
+
+	expectTodo("review")
+	mock.ExpectExec("UPDATE todo SET state=\\$1, updated_at=now\\(\\) WHERE id=\\$2").
+		WithArgs("done", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, transitionTodo(db, 1, "done"))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetBoard(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	fixedTime := time.Date(2023, time.October, 10, 15, 30, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT key, name, is_done FROM workflow_state WHERE list_id = \\$1").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "name", "is_done"}).
+			AddRow("todo", "To do", false).
+			AddRow("shipped", "Shipped", true))
+	mock.ExpectQuery("SELECT from_key, to_key FROM workflow_transition WHERE list_id = \\$1").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"from_key", "to_key"}).AddRow("todo", "shipped"))
+	mock.ExpectQuery("SELECT (.+) FROM todo WHERE deleted_at IS NULL AND \\(\\(owner_id = \\$1 (.+)\\) AND list_id = \\$2 ORDER BY rank").
+		WithArgs(1, 2).
+		WillReturnRows(todoRows().
+			AddRow(1, "Write", "", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, "a", 2, "todo", nil).
+			AddRow(2, "Ship", "", true, nil, nil, nil, false, nil, fixedTime, fixedTime, fixedTime, nil, "b", 2, "shipped", nil).
+			AddRow(3, "Test", "", false, nil, nil, nil, false, nil, fixedTime, fixedTime, nil, nil, "c", 2, "todo", nil))
+
+	columns, err := getBoard(db, 1, 2)
+	assert.NoError(t, err)
+	assert.Len(t, columns, 2)
+	assert.Equal(t, "todo", columns[0].Key)
+	assert.Equal(t, []int{1, 3}, []int{columns[0].Todos[0].ID, columns[0].Todos[1].ID})
+	assert.Equal(t, "shipped", columns[1].Key)
+	assert.True(t, columns[1].Done)
+	assert.Len(t, columns[1].Todos, 1)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}